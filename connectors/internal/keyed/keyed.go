@@ -0,0 +1,136 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package keyed delivers the items of each key in order and the items of different keys
+// concurrently, such as the messages of an event batch to webhooks or channels.
+package keyed
+
+import (
+	"sync"
+	"time"
+)
+
+// Queues serializes the work of each key and keeps the state of it, such as a rate limiter.
+// A key which has no work for the idle timeout is released, so the keys of dynamic routes
+// don't accumulate. The idle timeout should be longer than the period a rate limiter
+// recovers in, so releasing it doesn't loosen the limit.
+type Queues[S any] struct {
+	idle     time.Duration
+	newState func(key string) S
+
+	lock      sync.Mutex
+	queues    map[string]*queue[S]
+	lastSweep time.Time
+}
+
+type queue[S any] struct {
+	lock  sync.Mutex
+	state S
+	// refs and lastUsed are guarded by the lock of Queues.
+	refs     int
+	lastUsed time.Time
+}
+
+// NewQueues returns the queues whose state of a key is created by newState.
+func NewQueues[S any](idle time.Duration, newState func(key string) S) *Queues[S] {
+	return &Queues[S]{
+		idle:      idle,
+		newState:  newState,
+		queues:    map[string]*queue[S]{},
+		lastSweep: time.Now(),
+	}
+}
+
+// Do runs fn with the state of the key after the previous work of the key is done.
+func (q *Queues[S]) Do(key string, fn func(state S)) {
+	e := q.acquire(key)
+	defer q.release(e)
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	fn(e.state)
+}
+
+// Len returns the number of keys which are kept.
+func (q *Queues[S]) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.queues)
+}
+
+func (q *Queues[S]) acquire(key string) *queue[S] {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := time.Now()
+	if now.Sub(q.lastSweep) >= q.idle {
+		q.sweep(now)
+	}
+	e, ok := q.queues[key]
+	if !ok {
+		e = &queue[S]{state: q.newState(key)}
+		q.queues[key] = e
+	}
+	e.refs++
+	return e
+}
+
+func (q *Queues[S]) release(e *queue[S]) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	e.refs--
+	e.lastUsed = time.Now()
+}
+
+// sweep removes the keys which have no work for the idle timeout, it's called with the
+// lock held at most once per idle timeout, so it's cheap however many keys there are.
+func (q *Queues[S]) sweep(now time.Time) {
+	for key, e := range q.queues {
+		if e.refs == 0 && now.Sub(e.lastUsed) >= q.idle {
+			delete(q.queues, key)
+		}
+	}
+	q.lastSweep = now
+}
+
+// Group groups items by key, the items of a key and the keys are in the order they are added.
+type Group[T any] struct {
+	keys  []string
+	items map[string][]T
+}
+
+// Add appends the item to the items of the key.
+func (g *Group[T]) Add(key string, item T) {
+	if g.items == nil {
+		g.items = map[string][]T{}
+	}
+	if _, ok := g.items[key]; !ok {
+		g.keys = append(g.keys, key)
+	}
+	g.items[key] = append(g.items[key], item)
+}
+
+// Each runs fn with the items of each key concurrently, and returns the results in the order
+// of the keys.
+func Each[T, R any](g *Group[T], fn func(key string, items []T) R) []R {
+	results := make([]R, len(g.keys))
+	var wg sync.WaitGroup
+	for i, key := range g.keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			results[i] = fn(key, g.items[key])
+		}(i, key)
+	}
+	wg.Wait()
+	return results
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyed
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQueuesSerializeKey(t *testing.T) {
+	q := NewQueues(time.Minute, func(string) *int32 { return new(int32) })
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.Do("a", func(running *int32) {
+				if atomic.AddInt32(running, 1) != 1 {
+					t.Error("the work of a key runs concurrently")
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(running, -1)
+			})
+		}()
+	}
+	wg.Wait()
+}
+
+func TestQueuesDontBlockOtherKeys(t *testing.T) {
+	q := NewQueues(time.Minute, func(string) struct{} { return struct{}{} })
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go q.Do("slow", func(struct{}) {
+		close(started)
+		<-block
+	})
+	<-started
+	done := make(chan struct{})
+	go q.Do("fast", func(struct{}) { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a key is blocked by another key")
+	}
+	close(block)
+}
+
+func TestQueuesReleaseIdleKeys(t *testing.T) {
+	var created int32
+	q := NewQueues(20*time.Millisecond, func(string) struct{} {
+		atomic.AddInt32(&created, 1)
+		return struct{}{}
+	})
+	block := make(chan struct{})
+	started := make(chan struct{})
+	go q.Do("busy", func(struct{}) {
+		close(started)
+		<-block
+	})
+	<-started
+	for _, key := range []string{"a", "b", "c"} {
+		q.Do(key, func(struct{}) {})
+	}
+	q.Do("a", func(struct{}) {})
+	if n := atomic.LoadInt32(&created); n != 4 {
+		t.Fatalf("got %d states, want the state of a key reused", n)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	q.Do("d", func(struct{}) {})
+	if n := q.Len(); n != 2 {
+		t.Fatalf("got %d keys, want the idle keys released and the busy one kept", n)
+	}
+	close(block)
+}
+
+func TestEach(t *testing.T) {
+	var g Group[int]
+	for i, key := range []string{"b", "a", "b", "c", "a"} {
+		g.Add(key, i)
+	}
+	got := Each(&g, func(key string, items []int) []int {
+		return append([]int{int(key[0])}, items...)
+	})
+	want := [][]int{{'b', 0, 2}, {'a', 1, 4}, {'c', 3}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package placeholder expands the placeholders in the names which sinks resolve for each
+// event, such as an index name "logs-{yyyy.MM.dd}" or a collection name "{source}_events".
+package placeholder
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+)
+
+var (
+	placeholderRegexp = regexp.MustCompile(`\{([^{}]+)\}`)
+	timeLayoutRegexp  = regexp.MustCompile(`^(yyyy|yy|MM|dd|HH|mm|[._\-/])+$`)
+
+	timeLayoutReplacer = strings.NewReplacer(
+		"yyyy", "2006",
+		"yy", "06",
+		"MM", "01",
+		"dd", "02",
+		"HH", "15",
+		"mm", "04",
+	)
+)
+
+// IsStatic reports whether the template has no placeholder.
+func IsStatic(tpl string) bool {
+	return !placeholderRegexp.MatchString(tpl)
+}
+
+// Expand replaces the placeholders in the template. A placeholder made only of time tokens,
+// such as {yyyy.MM.dd}, is formatted with the event time in the location, the current time
+// if the event has none. Any other placeholder, such as {source}, is replaced by the event
+// attribute, and it's an error if the event doesn't have the attribute.
+func Expand(tpl string, e *ce.Event, loc *time.Location) (string, error) {
+	if IsStatic(tpl) {
+		return tpl, nil
+	}
+	var err error
+	result := placeholderRegexp.ReplaceAllStringFunc(tpl, func(s string) string {
+		key := s[1 : len(s)-1]
+		if timeLayoutRegexp.MatchString(key) {
+			return EventTime(e).In(loc).Format(timeLayoutReplacer.Replace(key))
+		}
+		val, ok := Attribute(e, key)
+		if !ok {
+			err = fmt.Errorf("attribute %s of placeholder %s not found", key, s)
+			return s
+		}
+		return val
+	})
+	if err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// Attribute returns the value of the attribute or extension of the event, an empty value is
+// treated as not found.
+func Attribute(e *ce.Event, key string) (string, bool) {
+	var val string
+	switch key {
+	case "id":
+		val = e.ID()
+	case "source":
+		val = e.Source()
+	case "type":
+		val = e.Type()
+	case "subject":
+		val = e.Subject()
+	default:
+		ext, ok := e.Extensions()[key]
+		if !ok || ext == nil {
+			return "", false
+		}
+		if str, ok := ext.(string); ok {
+			val = str
+		} else {
+			val = fmt.Sprintf("%v", ext)
+		}
+	}
+	return val, val != ""
+}
+
+// LoadLocation loads the location of a time_zone config, it's UTC if the name is empty.
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time_zone %s: %s", name, err.Error())
+	}
+	return loc, nil
+}
+
+// EventTime returns the time of the event which formats the time placeholders, it's the
+// current time if the event has none.
+func EventTime(e *ce.Event) time.Time {
+	if t := e.Time(); !t.IsZero() {
+		return t
+	}
+	return time.Now()
+}
@@ -0,0 +1,66 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package placeholder
+
+import (
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+)
+
+func TestExpand(t *testing.T) {
+	shanghai, err := LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := ce.NewEvent()
+	e.SetID("1")
+	e.SetSource("test")
+	e.SetType("order")
+	e.SetTime(time.Date(2023, 3, 31, 20, 0, 0, 0, time.UTC))
+	e.SetExtension("xvtenant", "t1")
+	e.SetExtension("xvshard", 3)
+
+	cases := []struct {
+		tpl  string
+		loc  *time.Location
+		want string
+	}{
+		{tpl: "logs", loc: time.UTC, want: "logs"},
+		{tpl: "logs-{yyyy.MM.dd}", loc: time.UTC, want: "logs-2023.03.31"},
+		{tpl: "logs-{yyyy.MM.dd}", loc: shanghai, want: "logs-2023.04.01"},
+		{tpl: "{source}-{yy_MM}-{HH/mm}", loc: time.UTC, want: "test-23_03-20/00"},
+		{tpl: "{type}_{xvtenant}_{xvshard}", loc: time.UTC, want: "order_t1_3"},
+	}
+	for _, c := range cases {
+		got, err := Expand(c.tpl, &e, c.loc)
+		if err != nil {
+			t.Fatalf("%s: %v", c.tpl, err)
+		}
+		if got != c.want {
+			t.Fatalf("%s: got %s, want %s", c.tpl, got, c.want)
+		}
+	}
+
+	for _, tpl := range []string{"{subject}", "{xvmissing}-{yyyy}"} {
+		if got, err := Expand(tpl, &e, time.UTC); err == nil {
+			t.Fatalf("%s: want error, got %s", tpl, got)
+		}
+	}
+	if _, err = LoadLocation("Mars/Olympus"); err == nil {
+		t.Fatal("want error for an unknown time zone")
+	}
+}
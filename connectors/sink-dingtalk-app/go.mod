@@ -4,7 +4,6 @@ go 1.18
 
 require (
 	github.com/cloudevents/sdk-go/v2 v2.14.0
-	github.com/open-dingtalk/dingtalk-stream-sdk-go v0.0.4
 	github.com/rs/zerolog v1.31.0
 	github.com/tidwall/gjson v1.14.4
 	github.com/vanus-labs/cdk-go v0.7.7
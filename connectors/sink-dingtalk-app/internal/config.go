@@ -1,16 +1,25 @@
 package internal
 
 import (
+	"strings"
+
 	cdkgo "github.com/vanus-labs/cdk-go"
 )
 
+const (
+	defaultOpenAPIEndpoint = "https://api.dingtalk.com"
+)
+
 var _ cdkgo.SinkConfigAccessor = &Config{}
 
 type Config struct {
 	cdkgo.SinkConfig `json:",inline" yaml:",inline"`
 
-	DingtalkAppKey    string `json:"dingtalk_app_key" yaml:"dingtalk_app_key"`
-	DingtalkAppSecret string `json:"dingtalk_app_secret" yaml:"dingtalk_app_secret"`
+	DingtalkAppKey    string `json:"dingtalk_app_key" yaml:"dingtalk_app_key" validate:"required"`
+	DingtalkAppSecret string `json:"dingtalk_app_secret" yaml:"dingtalk_app_secret" validate:"required"`
+	// RobotCode is the robot sending proactive messages, it's the app key by default.
+	RobotCode       string `json:"robot_code" yaml:"robot_code"`
+	OpenAPIEndpoint string `json:"openapi_endpoint" yaml:"openapi_endpoint"`
 }
 
 func NewConfig() cdkgo.SinkConfigAccessor {
@@ -18,5 +27,11 @@ func NewConfig() cdkgo.SinkConfigAccessor {
 }
 
 func (c *Config) Init() {
-
+	if c.RobotCode == "" {
+		c.RobotCode = c.DingtalkAppKey
+	}
+	if c.OpenAPIEndpoint == "" {
+		c.OpenAPIEndpoint = defaultOpenAPIEndpoint
+	}
+	c.OpenAPIEndpoint = strings.TrimSuffix(c.OpenAPIEndpoint, "/")
 }
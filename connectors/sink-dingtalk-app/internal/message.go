@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const (
+	xMessageType = "xvmsgtype"
+
+	textMessage       = "text"
+	markdownMessage   = "markdown"
+	actionCardMessage = "actionCard"
+)
+
+// message is a message converted from event data, its content is the same for the session
+// webhook and robot OpenAPI, though they are in different formats.
+type message struct {
+	msgType string
+	content map[string]interface{}
+}
+
+// parseMessage converts the event data to a message, the data is in the format of
+//
+//	{"content": "xxx"} for text message,
+//	{"title": "xxx", "text": "xxx"} for markdown message, the text is the content if it's missing,
+//	{"actionCard": {"title": "xxx", "text": "xxx", "singleTitle": "xxx", "singleURL": "xxx"}} or
+//	{"actionCard": {"title": "xxx", "text": "xxx", "btnOrientation": "0", "btns": [{"title": "xxx", "actionURL": "xxx"}]}}
+//	for ActionCard message.
+func parseMessage(msgType string, data gjson.Result) (*message, error) {
+	switch msgType {
+	case "", textMessage:
+		content := data.Get("content").String()
+		if content == "" {
+			return nil, errors.New("the content of text message is empty")
+		}
+		return &message{msgType: textMessage, content: map[string]interface{}{"content": content}}, nil
+	case markdownMessage:
+		text := data.Get("text").String()
+		if text == "" {
+			text = data.Get("content").String()
+		}
+		if text == "" {
+			return nil, errors.New("the text of markdown message is empty")
+		}
+		title := data.Get("title").String()
+		if title == "" {
+			// the title is shown in the notification and conversation list.
+			title = strings.TrimLeft(strings.SplitN(text, "\n", 2)[0], "# ")
+		}
+		return &message{msgType: markdownMessage, content: map[string]interface{}{
+			"title": title,
+			"text":  text,
+		}}, nil
+	case actionCardMessage:
+		card := data.Get("actionCard")
+		if !card.IsObject() {
+			return nil, errors.New("the actionCard of ActionCard message must be an object")
+		}
+		var content map[string]interface{}
+		if err := json.Unmarshal([]byte(card.Raw), &content); err != nil {
+			return nil, err
+		}
+		if card.Get("title").String() == "" || card.Get("text").String() == "" {
+			return nil, errors.New("the title and text of ActionCard message can't be empty")
+		}
+		if !card.Get("singleURL").Exists() && len(card.Get("btns").Array()) == 0 {
+			return nil, errors.New("the ActionCard message must have singleURL or btns")
+		}
+		return &message{msgType: actionCardMessage, content: content}, nil
+	default:
+		return nil, fmt.Errorf("unsupported message type: %s, only text, markdown and actionCard are supported", msgType)
+	}
+}
+
+// webhookBody returns the body of the message sent to the session webhook.
+func (m *message) webhookBody() map[string]interface{} {
+	return map[string]interface{}{
+		"msgtype": m.msgType,
+		m.msgType: m.content,
+	}
+}
+
+// openAPIParam returns the msgKey and msgParam of the message sent by robot OpenAPI, see
+// https://open.dingtalk.com/document/orgapp/types-of-messages-sent-by-robots
+func (m *message) openAPIParam() (string, string, error) {
+	var (
+		key   string
+		param map[string]interface{}
+	)
+	switch m.msgType {
+	case textMessage:
+		key, param = "sampleText", m.content
+	case markdownMessage:
+		key, param = "sampleMarkdown", m.content
+	case actionCardMessage:
+		data, _ := json.Marshal(m.content)
+		card := gjson.ParseBytes(data)
+		param = map[string]interface{}{
+			"title": card.Get("title").String(),
+			"text":  card.Get("text").String(),
+		}
+		btns := card.Get("btns").Array()
+		switch {
+		case len(btns) == 0:
+			key = "sampleActionCard"
+			param["singleTitle"] = card.Get("singleTitle").String()
+			param["singleURL"] = card.Get("singleURL").String()
+		case len(btns) == 1:
+			key = "sampleActionCard"
+			param["singleTitle"] = btns[0].Get("title").String()
+			param["singleURL"] = btns[0].Get("actionURL").String()
+		case len(btns) == 2 && card.Get("btnOrientation").String() == "1":
+			// the buttons are horizontal.
+			key = "sampleActionCard6"
+			for i, btn := range btns {
+				param["buttonTitle"+strconv.Itoa(i+1)] = btn.Get("title").String()
+				param["buttonUrl"+strconv.Itoa(i+1)] = btn.Get("actionURL").String()
+			}
+		case len(btns) <= 5:
+			key = "sampleActionCard" + strconv.Itoa(len(btns))
+			for i, btn := range btns {
+				param["actionTitle"+strconv.Itoa(i+1)] = btn.Get("title").String()
+				param["actionURL"+strconv.Itoa(i+1)] = btn.Get("actionURL").String()
+			}
+		default:
+			return "", "", errors.New("the ActionCard message sent by robot OpenAPI has at most 5 buttons")
+		}
+	}
+	data, err := json.Marshal(param)
+	if err != nil {
+		return "", "", err
+	}
+	return key, string(data), nil
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestActionCardOpenAPIParam(t *testing.T) {
+	cases := []struct {
+		name      string
+		card      string
+		wantKey   string
+		wantParam string
+	}{
+		{
+			name:      "single url",
+			card:      `{"title":"t","text":"x","singleTitle":"Read","singleURL":"https://a"}`,
+			wantKey:   "sampleActionCard",
+			wantParam: `{"singleTitle":"Read","singleURL":"https://a","text":"x","title":"t"}`,
+		},
+		{
+			name:      "one button",
+			card:      `{"title":"t","text":"x","btns":[{"title":"A","actionURL":"https://a"}]}`,
+			wantKey:   "sampleActionCard",
+			wantParam: `{"singleTitle":"A","singleURL":"https://a","text":"x","title":"t"}`,
+		},
+		{
+			name: "two vertical buttons",
+			card: `{"title":"t","text":"x","btns":[{"title":"A","actionURL":"https://a"},` +
+				`{"title":"B","actionURL":"https://b"}]}`,
+			wantKey: "sampleActionCard2",
+			wantParam: `{"actionTitle1":"A","actionTitle2":"B","actionURL1":"https://a","actionURL2":"https://b",` +
+				`"text":"x","title":"t"}`,
+		},
+		{
+			name: "two horizontal buttons",
+			card: `{"title":"t","text":"x","btnOrientation":"1","btns":[{"title":"A","actionURL":"https://a"},` +
+				`{"title":"B","actionURL":"https://b"}]}`,
+			wantKey: "sampleActionCard6",
+			wantParam: `{"buttonTitle1":"A","buttonTitle2":"B","buttonUrl1":"https://a","buttonUrl2":"https://b",` +
+				`"text":"x","title":"t"}`,
+		},
+		{
+			name: "three buttons",
+			card: `{"title":"t","text":"x","btnOrientation":"1","btns":[{"title":"A","actionURL":"https://a"},` +
+				`{"title":"B","actionURL":"https://b"},{"title":"C","actionURL":"https://c"}]}`,
+			wantKey: "sampleActionCard3",
+			wantParam: `{"actionTitle1":"A","actionTitle2":"B","actionTitle3":"C","actionURL1":"https://a",` +
+				`"actionURL2":"https://b","actionURL3":"https://c","text":"x","title":"t"}`,
+		},
+		{
+			name: "five buttons",
+			card: `{"title":"t","text":"x","btns":[{"title":"A","actionURL":"1"},{"title":"B","actionURL":"2"},` +
+				`{"title":"C","actionURL":"3"},{"title":"D","actionURL":"4"},{"title":"E","actionURL":"5"}]}`,
+			wantKey: "sampleActionCard5",
+			wantParam: `{"actionTitle1":"A","actionTitle2":"B","actionTitle3":"C","actionTitle4":"D",` +
+				`"actionTitle5":"E","actionURL1":"1","actionURL2":"2","actionURL3":"3","actionURL4":"4",` +
+				`"actionURL5":"5","text":"x","title":"t"}`,
+		},
+		{
+			name: "six buttons",
+			card: `{"title":"t","text":"x","btns":[{"title":"A"},{"title":"B"},{"title":"C"},{"title":"D"},` +
+				`{"title":"E"},{"title":"F"}]}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			msg, err := parseMessage(actionCardMessage, gjson.Parse(`{"actionCard":`+c.card+`}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, param, err := msg.openAPIParam()
+			if c.wantKey == "" {
+				if err == nil {
+					t.Fatalf("want error, got %s %s", key, param)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != c.wantKey || param != c.wantParam {
+				t.Fatalf("got %s %s, want %s %s", key, param, c.wantKey, c.wantParam)
+			}
+			// the session webhook gets the card as it is.
+			body := msg.webhookBody()
+			if body["msgtype"] != actionCardMessage ||
+				!reflect.DeepEqual(body[actionCardMessage], gjson.Parse(c.card).Value()) {
+				t.Fatalf("got webhook body %v", body)
+			}
+		})
+	}
+}
+
+func TestParseInvalidActionCard(t *testing.T) {
+	for _, data := range []string{
+		`{"actionCard":"card"}`,
+		`{"actionCard":{"text":"x","singleURL":"https://a"}}`,
+		`{"actionCard":{"title":"t","text":"x"}}`,
+		`{"actionCard":{"title":"t","text":"x","btns":[]}}`,
+	} {
+		if _, err := parseMessage(actionCardMessage, gjson.Parse(data)); err == nil {
+			t.Errorf("%s: want error", data)
+		}
+	}
+}
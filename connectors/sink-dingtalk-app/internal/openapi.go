@@ -0,0 +1,225 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	cdkgo "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/cdk-go/connector"
+)
+
+const (
+	// refresh the token before it expires, so it won't expire during a request.
+	tokenRefreshAhead = 5 * time.Minute
+	// the messages to the flow controlled users are sent again after the backoff, which is
+	// doubled for each retry.
+	maxFlowControlRetries     = 3
+	defaultFlowControlBackoff = time.Second
+)
+
+// openAPI calls the DingTalk OpenAPI with the access token of the app.
+type openAPI struct {
+	cfg                *Config
+	httpClient         *http.Client
+	logger             zerolog.Logger
+	flowControlBackoff time.Duration
+
+	lock     sync.Mutex
+	token    string
+	expireAt time.Time
+}
+
+func newOpenAPI(cfg *Config, logger zerolog.Logger) *openAPI {
+	return &openAPI{
+		cfg:                cfg,
+		httpClient:         &http.Client{Timeout: 10 * time.Second},
+		logger:             logger,
+		flowControlBackoff: defaultFlowControlBackoff,
+	}
+}
+
+// getToken returns the cached access token, it gets a new one if the cached is expiring.
+func (o *openAPI) getToken(ctx context.Context) (string, cdkgo.Result) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.token != "" && time.Now().Before(o.expireAt) {
+		return o.token, cdkgo.SuccessResult
+	}
+	var resp struct {
+		AccessToken string `json:"accessToken"`
+		ExpireIn    int    `json:"expireIn"`
+	}
+	result := o.post(ctx, "/v1.0/oauth2/accessToken", "", map[string]string{
+		"appKey":    o.cfg.DingtalkAppKey,
+		"appSecret": o.cfg.DingtalkAppSecret,
+	}, &resp)
+	if result != cdkgo.SuccessResult {
+		return "", result
+	}
+	o.token = resp.AccessToken
+	o.expireAt = time.Now().Add(time.Duration(resp.ExpireIn)*time.Second - tokenRefreshAhead)
+	return o.token, cdkgo.SuccessResult
+}
+
+func (o *openAPI) invalidateToken(token string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.token == token {
+		o.token = ""
+	}
+}
+
+// call calls an OpenAPI with the access token, it gets a new token and calls again if the token
+// is rejected.
+func (o *openAPI) call(ctx context.Context, path string, body, result interface{}) cdkgo.Result {
+	for attempt := 0; ; attempt++ {
+		token, res := o.getToken(ctx)
+		if res != cdkgo.SuccessResult {
+			return res
+		}
+		res = o.post(ctx, path, token, body, result)
+		if res.GetCode() != http.StatusUnauthorized || attempt > 0 {
+			return res
+		}
+		o.invalidateToken(token)
+	}
+}
+
+func (o *openAPI) post(ctx context.Context, path, token string, body, result interface{}) cdkgo.Result {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return cdkgo.NewResult(http.StatusBadRequest, "dingtalk: marshal request error: "+err.Error())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.cfg.OpenAPIEndpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return cdkgo.NewResult(http.StatusInternalServerError, "dingtalk: new request error: "+err.Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("x-acs-dingtalk-access-token", token)
+	}
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return cdkgo.NewResult(http.StatusInternalServerError, "dingtalk: call openapi error: "+err.Error())
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return cdkgo.NewResult(http.StatusInternalServerError, "dingtalk: read response error: "+err.Error())
+	}
+	if resp.StatusCode != http.StatusOK {
+		// the error is in the format of {"code": "xxx", "message": "xxx", "requestid": "xxx"}
+		var e struct {
+			Code string `json:"code"`
+		}
+		_ = json.Unmarshal(respBody, &e)
+		code := resp.StatusCode
+		switch {
+		case strings.Contains(e.Code, "QpsLimit"):
+			code = http.StatusTooManyRequests
+		case code == http.StatusUnauthorized, code == http.StatusTooManyRequests:
+		case code >= http.StatusInternalServerError:
+			code = http.StatusInternalServerError
+		default:
+			code = http.StatusBadRequest
+		}
+		return cdkgo.NewResult(connector.Code(code),
+			fmt.Sprintf("dingtalk: call %s failed: %s %s", path, resp.Status, string(respBody)))
+	}
+	if result != nil {
+		if err = json.Unmarshal(respBody, result); err != nil {
+			return cdkgo.NewResult(http.StatusInternalServerError, "dingtalk: unmarshal response error: "+err.Error())
+		}
+	}
+	return cdkgo.SuccessResult
+}
+
+// sendToUsers sends the message to the users by the robot, see
+// https://open.dingtalk.com/document/orgapp/chatbots-send-one-on-one-chat-messages-in-batches
+//
+// The message is sent again to the flow controlled users only. Once some users have got the
+// message, the users still flow controlled after the retries are logged instead of failing the
+// event, since the redelivered event would be sent to all the users again.
+func (o *openAPI) sendToUsers(ctx context.Context, msg *message, userIds []string) cdkgo.Result {
+	key, param, err := msg.openAPIParam()
+	if err != nil {
+		return cdkgo.NewResult(http.StatusBadRequest, "dingtalk: "+err.Error())
+	}
+	var (
+		invalid   []string
+		delivered bool
+		failure   = cdkgo.SuccessResult
+	)
+	backoff := o.flowControlBackoff
+	for attempt := 0; ; attempt++ {
+		var resp struct {
+			InvalidStaffIDList        []string `json:"invalidStaffIdList"`
+			FlowControlledStaffIDList []string `json:"flowControlledStaffIdList"`
+		}
+		failure = o.call(ctx, "/v1.0/robot/oToMessages/batchSend", map[string]interface{}{
+			"robotCode": o.cfg.RobotCode,
+			"userIds":   userIds,
+			"msgKey":    key,
+			"msgParam":  param,
+		}, &resp)
+		if failure != cdkgo.SuccessResult {
+			break
+		}
+		invalid = append(invalid, resp.InvalidStaffIDList...)
+		delivered = delivered || len(resp.InvalidStaffIDList)+len(resp.FlowControlledStaffIDList) < len(userIds)
+		userIds = resp.FlowControlledStaffIDList
+		if len(userIds) == 0 {
+			break
+		}
+		failure = cdkgo.NewResult(http.StatusTooManyRequests,
+			fmt.Sprintf("dingtalk: the messages to %v are flow controlled", userIds))
+		if attempt >= maxFlowControlRetries || !sleep(ctx, backoff) {
+			break
+		}
+		backoff <<= 1
+	}
+	if failure != cdkgo.SuccessResult {
+		if !delivered {
+			return failure
+		}
+		o.logger.Warn().Strs("user_ids", userIds).Str("error", failure.GetMsg()).
+			Msg("failed to send message to the flow controlled users, skip them")
+	}
+	if len(invalid) > 0 {
+		return cdkgo.NewResult(http.StatusBadRequest, fmt.Sprintf("dingtalk: the users %v are invalid", invalid))
+	}
+	return cdkgo.SuccessResult
+}
+
+// sleep waits for the duration, it returns false if the context is done.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// sendToGroup sends the message to the group by the robot, see
+// https://open.dingtalk.com/document/orgapp/the-robot-sends-a-group-message
+func (o *openAPI) sendToGroup(ctx context.Context, msg *message, openConversationID string) cdkgo.Result {
+	key, param, err := msg.openAPIParam()
+	if err != nil {
+		return cdkgo.NewResult(http.StatusBadRequest, "dingtalk: "+err.Error())
+	}
+	return o.call(ctx, "/v1.0/robot/groupMessages/send", map[string]interface{}{
+		"robotCode":          o.cfg.RobotCode,
+		"openConversationId": openConversationID,
+		"msgKey":             key,
+		"msgParam":           param,
+	}, nil)
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+	cdkgo "github.com/vanus-labs/cdk-go"
+)
+
+// newTestOpenAPI starts the OpenAPI which issues the tokens in order with the expireIn, and
+// calls handle with the token and body of the other requests.
+func newTestOpenAPI(t *testing.T, tokens []string, expireIn int,
+	handle func(w http.ResponseWriter, token string, body gjson.Result)) *openAPI {
+	var (
+		lock   sync.Mutex
+		issued int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1.0/oauth2/accessToken" {
+			lock.Lock()
+			token := tokens[issued]
+			issued++
+			lock.Unlock()
+			_, _ = fmt.Fprintf(w, `{"accessToken":%q,"expireIn":%d}`, token, expireIn)
+			return
+		}
+		var body json.RawMessage
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		handle(w, r.Header.Get("x-acs-dingtalk-access-token"), gjson.ParseBytes(body))
+	}))
+	t.Cleanup(srv.Close)
+	cfg := &Config{DingtalkAppKey: "key", DingtalkAppSecret: "secret", OpenAPIEndpoint: srv.URL}
+	cfg.Init()
+	o := newOpenAPI(cfg, zerolog.Nop())
+	o.flowControlBackoff = time.Millisecond
+	return o
+}
+
+func TestTokenIsCachedAndRefreshed(t *testing.T) {
+	var (
+		used    []string
+		revoked = map[string]bool{}
+	)
+	o := newTestOpenAPI(t, []string{"t1", "t2", "t3"}, 7200, func(w http.ResponseWriter, token string, body gjson.Result) {
+		used = append(used, token)
+		if revoked[token] {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"code":"InvalidAuthentication"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	})
+	msg := &message{msgType: textMessage, content: map[string]interface{}{"content": "hi"}}
+	send := func() cdkgo.Result {
+		return o.sendToGroup(context.Background(), msg, "cid")
+	}
+	for i := 0; i < 2; i++ {
+		if result := send(); result != cdkgo.SuccessResult {
+			t.Fatal(result.GetMsg())
+		}
+	}
+	// the rejected token is dropped, and the call is sent again with a new token.
+	revoked["t1"] = true
+	if result := send(); result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+	if want := []string{"t1", "t1", "t1", "t2"}; !reflect.DeepEqual(used, want) {
+		t.Fatalf("got tokens %v, want %v", used, want)
+	}
+	// the call is sent again only once.
+	revoked["t2"], revoked["t3"] = true, true
+	if result := send(); int(result.GetCode()) != http.StatusUnauthorized {
+		t.Fatalf("got %d %s, want 401", result.GetCode(), result.GetMsg())
+	}
+	if want := []string{"t1", "t1", "t1", "t2", "t2", "t3"}; !reflect.DeepEqual(used, want) {
+		t.Fatalf("got tokens %v, want %v", used, want)
+	}
+}
+
+func TestExpiringTokenIsRefreshed(t *testing.T) {
+	var used []string
+	// the token expiring within tokenRefreshAhead isn't cached.
+	o := newTestOpenAPI(t, []string{"t1", "t2"}, 60, func(w http.ResponseWriter, token string, body gjson.Result) {
+		used = append(used, token)
+		_, _ = w.Write([]byte(`{}`))
+	})
+	msg := &message{msgType: textMessage, content: map[string]interface{}{"content": "hi"}}
+	for i := 0; i < 2; i++ {
+		if result := o.sendToGroup(context.Background(), msg, "cid"); result != cdkgo.SuccessResult {
+			t.Fatal(result.GetMsg())
+		}
+	}
+	if want := []string{"t1", "t2"}; !reflect.DeepEqual(used, want) {
+		t.Fatalf("got tokens %v, want %v", used, want)
+	}
+}
+
+func TestSendToUsersRetriesFlowControlledUsers(t *testing.T) {
+	all := []string{"u1", "u2", "u3"}
+	cases := []struct {
+		name string
+		// responses are the flow controlled and invalid users of the requests in order, the last
+		// one is repeated.
+		responses    []string
+		wantRequests [][]string
+		wantCode     int
+	}{
+		{
+			name: "retried users get the message",
+			responses: []string{
+				`{"flowControlledStaffIdList":["u2","u3"]}`,
+				`{"flowControlledStaffIdList":["u3"]}`,
+				`{}`,
+			},
+			wantRequests: [][]string{all, {"u2", "u3"}, {"u3"}},
+		},
+		{
+			name:         "users still flow controlled are skipped",
+			responses:    []string{`{"flowControlledStaffIdList":["u3"]}`},
+			wantRequests: [][]string{all, {"u3"}, {"u3"}, {"u3"}},
+		},
+		{
+			name:         "no user gets the message",
+			responses:    []string{`{"flowControlledStaffIdList":["u1","u2","u3"]}`},
+			wantRequests: [][]string{all, all, all, all},
+			wantCode:     http.StatusTooManyRequests,
+		},
+		{
+			name: "invalid users",
+			responses: []string{
+				`{"invalidStaffIdList":["u1"],"flowControlledStaffIdList":["u2"]}`,
+				`{}`,
+			},
+			wantRequests: [][]string{all, {"u2"}},
+			wantCode:     http.StatusBadRequest,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var requests [][]string
+			o := newTestOpenAPI(t, []string{"t"}, 7200, func(w http.ResponseWriter, token string, body gjson.Result) {
+				var users []string
+				for _, id := range body.Get("userIds").Array() {
+					users = append(users, id.String())
+				}
+				requests = append(requests, users)
+				i := len(requests) - 1
+				if i >= len(c.responses) {
+					i = len(c.responses) - 1
+				}
+				_, _ = w.Write([]byte(c.responses[i]))
+			})
+			msg := &message{msgType: textMessage, content: map[string]interface{}{"content": "hi"}}
+			result := o.sendToUsers(context.Background(), msg, all)
+			if int(result.GetCode()) != c.wantCode {
+				t.Fatalf("got %d %s, want %d", result.GetCode(), result.GetMsg(), c.wantCode)
+			}
+			if !reflect.DeepEqual(requests, c.wantRequests) {
+				t.Fatalf("got requests %v, want %v", requests, c.wantRequests)
+			}
+		})
+	}
+}
@@ -1,20 +1,42 @@
 package internal
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
 	"github.com/cloudevents/sdk-go/v2"
-	"github.com/open-dingtalk/dingtalk-stream-sdk-go/chatbot"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
 	cdkgo "github.com/vanus-labs/cdk-go"
 	"github.com/vanus-labs/cdk-go/log"
 )
 
+const (
+	// the codes of the robot sending messages too fast.
+	codeSendTooFast = 130101
+)
+
+var (
+	errNoTarget = cdkgo.NewResult(http.StatusBadRequest,
+		"dingtalk: no target found, the data must have webhook, userIds or openConversationId")
+	errWebhookExpired = cdkgo.NewResult(http.StatusBadRequest,
+		"dingtalk: the session webhook is expired, and the data has no userIds or openConversationId")
+)
+
 var _ cdkgo.Sink = &DingtalkSink{}
 
 type DingtalkSink struct {
-	cfg    *Config
-	logger zerolog.Logger
+	cfg        *Config
+	logger     zerolog.Logger
+	httpClient *http.Client
+	api        *openAPI
 }
 
 func NewSink() cdkgo.Sink {
@@ -25,6 +47,8 @@ func (s *DingtalkSink) Initialize(ctx context.Context, cfg cdkgo.ConfigAccessor)
 	s.logger = log.FromContext(ctx)
 	s.cfg = cfg.(*Config)
 	s.cfg.Init()
+	s.httpClient = &http.Client{Timeout: 5 * time.Second}
+	s.api = newOpenAPI(s.cfg, s.logger)
 
 	return nil
 }
@@ -40,23 +64,102 @@ func (s *DingtalkSink) Destroy() error {
 func (s *DingtalkSink) Arrived(ctx context.Context, events ...*v2.Event) cdkgo.Result {
 	for idx := range events {
 		e := events[idx]
-		eStr, _ := e.MarshalJSON()
-		content := gjson.Get(string(eStr), "data.content").String()
-		webhook := gjson.Get(string(eStr), "data.webhook").String()
-		s.logger.Info().
-			Str("webhook", webhook).
-			Str("content", content).
-			Msg("Msg arrived")
-
-		s.replyText(ctx, webhook, content)
+		if result := s.send(ctx, e); result != cdkgo.SuccessResult {
+			s.logger.Warn().
+				Str("event_id", e.ID()).
+				Str("error", result.GetMsg()).
+				Msg("Failed to send message")
+			return result
+		}
 	}
 	return cdkgo.SuccessResult
 }
 
-func (s *DingtalkSink) replyText(ctx context.Context, webhook, content string) {
-	replier := chatbot.NewChatbotReplier()
-	err := replier.SimpleReplyText(ctx, webhook, []byte(content))
+// send replies the message to the session webhook in data, or sends it to the users or group in
+// data by robot OpenAPI if there is no session webhook or it's expired.
+func (s *DingtalkSink) send(ctx context.Context, e *v2.Event) cdkgo.Result {
+	data := gjson.ParseBytes(e.Data())
+	msgType, ok := e.Extensions()[xMessageType].(string)
+	if !ok {
+		msgType = data.Get("msgtype").String()
+	}
+	msg, err := parseMessage(msgType, data)
+	if err != nil {
+		return cdkgo.NewResult(http.StatusBadRequest, "dingtalk: "+err.Error())
+	}
+
+	webhook := data.Get("webhook").String()
+	// the expired time of session webhook in millisecond, the webhook is valid for about 90 minutes.
+	expiredTime := data.Get("sessionWebhookExpiredTime").Int()
+	expired := expiredTime > 0 && time.Now().UnixMilli() >= expiredTime
+	s.logger.Info().
+		Str("event_id", e.ID()).
+		Str("webhook", webhookPath(webhook)).
+		Str("msgtype", msg.msgType).
+		Msg("Msg arrived")
+
+	if webhook != "" && !expired {
+		return s.reply(ctx, webhook, msg)
+	}
+	var userIds []string
+	for _, id := range data.Get("userIds").Array() {
+		userIds = append(userIds, id.String())
+	}
+	switch {
+	case len(userIds) > 0:
+		return s.api.sendToUsers(ctx, msg, userIds)
+	case data.Get("openConversationId").String() != "":
+		return s.api.sendToGroup(ctx, msg, data.Get("openConversationId").String())
+	case expired:
+		return errWebhookExpired
+	}
+	return errNoTarget
+}
+
+// reply sends the message to the session webhook, it fails if dingtalk rejects the message.
+func (s *DingtalkSink) reply(ctx context.Context, webhook string, msg *message) cdkgo.Result {
+	body, _ := json.Marshal(msg.webhookBody())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return cdkgo.NewResult(http.StatusBadRequest, "dingtalk: invalid webhook: "+withoutURL(err).Error())
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return cdkgo.NewResult(http.StatusInternalServerError,
+			"dingtalk: reply message error: "+withoutURL(err).Error())
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return cdkgo.NewResult(http.StatusInternalServerError,
+			"dingtalk: reply message failed: "+resp.Status+" "+string(respBody))
+	}
+	// the session webhook responds {"errcode": 0, "errmsg": "ok"} even if the status is 200.
+	switch errCode := gjson.GetBytes(respBody, "errcode"); {
+	case resp.StatusCode == http.StatusOK && errCode.Int() == 0:
+		return cdkgo.SuccessResult
+	case errCode.Int() == codeSendTooFast:
+		return cdkgo.NewResult(http.StatusTooManyRequests, "dingtalk: reply message failed: "+string(respBody))
+	}
+	return cdkgo.NewResult(http.StatusBadRequest, "dingtalk: reply message failed: "+resp.Status+" "+string(respBody))
+}
+
+// webhookPath returns the host and path of the session webhook, the session in its query is a
+// credential, so the webhook isn't logged as it is.
+func webhookPath(webhook string) string {
+	u, err := url.Parse(webhook)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed SimpleReplyText")
+		return ""
 	}
-}
\ No newline at end of file
+	return u.Host + u.Path
+}
+
+// withoutURL removes the url from the error of a request, which has the session of the webhook.
+func withoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
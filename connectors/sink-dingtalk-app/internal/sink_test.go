@@ -0,0 +1,30 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+)
+
+func TestSessionIsNotExposed(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	webhook := srv.URL + "/robot/sendBySession?session=secret"
+	srv.Close()
+
+	if got := webhookPath(webhook); strings.Contains(got, "secret") || !strings.HasSuffix(got, "/robot/sendBySession") {
+		t.Fatalf("got webhook %s", got)
+	}
+	s := &DingtalkSink{httpClient: &http.Client{Timeout: time.Second}}
+	msg := &message{msgType: textMessage, content: map[string]interface{}{"content": "hi"}}
+	for _, hook := range []string{webhook, "http://a b/?session=secret"} {
+		result := s.reply(context.Background(), hook, msg)
+		if result == cdkgo.SuccessResult || strings.Contains(result.GetMsg(), "secret") {
+			t.Fatalf("got %s", result.GetMsg())
+		}
+	}
+}
@@ -8,8 +8,11 @@ require (
 	github.com/rs/zerolog v1.31.0
 	github.com/tidwall/gjson v1.14.4
 	github.com/vanus-labs/cdk-go v0.7.7
+	github.com/vanus-labs/connector/internal v0.0.0
 )
 
+replace github.com/vanus-labs/connector/internal v0.0.0 => ../internal
+
 require (
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd/v22 v22.5.0 // indirect
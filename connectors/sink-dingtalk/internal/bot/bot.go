@@ -15,26 +15,33 @@
 package bot
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	v2 "github.com/cloudevents/sdk-go/v2"
-	"github.com/cloudevents/sdk-go/v2/protocol/http"
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog"
 	"github.com/tidwall/gjson"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/connector/internal/keyed"
 )
 
 type messageType string
 
 const (
-	xChatGroupID = "xvchatgroup"
-	xMessageType = "xvmsgtype"
+	xChatGroupID  = "xvchatgroup"
+	xMessageType  = "xvmsgtype"
+	xBotURL       = "xvboturls"
+	xBotSignature = "xvbotsigns"
 
 	textMessage       = messageType("text")
 	linkMessage       = messageType("link")
@@ -43,23 +50,65 @@ const (
 	feedCardMessage   = messageType("feedCard")
 )
 
+var (
+	errInvalidAttributes      = cdkgo.NewResult(http.StatusBadRequest, "dingtalk: invalid xvboturls")
+	errInvalidAttributeNumber = cdkgo.NewResult(http.StatusBadRequest,
+		"dingtalk: the number of bot url and signature must be equal")
+	errNoWebhookFound = cdkgo.NewResult(http.StatusBadRequest, "dingtalk: no bot target webhook found")
+)
+
 type Bot struct {
+	cfg              Config
 	defaultChatGroup string
 	hookMap          map[string]WebHook
 	httpClient       *resty.Client
 	logger           zerolog.Logger
+	// robots posts to each robot webhook one message at a time within its rate limit.
+	robots *keyed.Queues[*sendWindow]
+}
+
+// sendWindow is the times of the messages posted to a robot in the last minute. DingTalk
+// counts the messages of a robot per minute and throttles it for 10 minutes over the limit,
+// so the count is kept rather than a token bucket, which may exceed it at the boundary.
+type sendWindow struct {
+	sent []time.Time
+}
+
+// reserve waits until one more message in the last minute is within the limit.
+func (w *sendWindow) reserve(ctx context.Context, limit int) error {
+	for len(w.sent) > 0 {
+		d := time.Until(w.sent[0].Add(time.Minute))
+		if d <= 0 {
+			w.sent = w.sent[1:]
+			continue
+		}
+		if len(w.sent) < limit {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(d):
+		}
+	}
+	w.sent = append(w.sent, time.Now())
+	return nil
 }
 
 func NewBot(logger zerolog.Logger) *Bot {
 	return &Bot{
 		httpClient: resty.New(),
 		logger:     logger,
+		robots: keyed.NewQueues(robotIdleTimeout, func(string) *sendWindow {
+			return &sendWindow{}
+		}),
 	}
 }
 
 func (b *Bot) Init(cfg Config) error {
+	b.cfg = cfg
 	b.hookMap = make(map[string]WebHook, len(cfg.Webhooks))
-	if cfg.Default == "" {
+	if cfg.Default == "" && len(cfg.Webhooks) > 0 {
 		b.defaultChatGroup = cfg.Webhooks[0].ChatGroup
 	} else {
 		b.defaultChatGroup = cfg.Default
@@ -70,6 +119,12 @@ func (b *Bot) Init(cfg Config) error {
 	return nil
 }
 
+type botAt struct {
+	AtMobiles []string `json:"atMobiles,omitempty"`
+	AtUserIds []string `json:"atUserIds,omitempty"`
+	IsAtAll   bool     `json:"isAtAll,omitempty"`
+}
+
 type botMessage struct {
 	MsgType    messageType            `json:"msgtype"`
 	Text       map[string]interface{} `json:"text,omitempty"`
@@ -77,44 +132,133 @@ type botMessage struct {
 	MarkDown   map[string]interface{} `json:"markdown,omitempty"`
 	ActionCard map[string]interface{} `json:"actionCard,omitempty"`
 	FeedCard   map[string]interface{} `json:"feedCard,omitempty"`
+	At         *botAt                 `json:"at,omitempty"`
+}
+
+// delivery is a message of an event to a robot.
+type delivery struct {
+	event *v2.Event
+	hook  WebHook
+	msg   *botMessage
 }
 
-func (b *Bot) SendMessage(e *v2.Event) (err error) {
-	defer func() {
+// SendMessages posts the messages of the events to their robots. A robot gets its messages in
+// the order of the events, robots are posted to in parallel, and the first failure is returned.
+func (b *Bot) SendMessages(ctx context.Context, events []*v2.Event) cdkgo.Result {
+	var byRobot keyed.Group[delivery]
+	for _, e := range events {
+		hooks, result := b.getWebhooks(e)
+		if result != cdkgo.SuccessResult {
+			return result
+		}
+		msgType, ok := e.Extensions()[xMessageType].(string)
+		if !ok {
+			msgType = string(textMessage)
+		}
+		botMsg, err := b.event2Message(e, messageType(msgType))
 		if err != nil {
-			d, _ := e.MarshalJSON()
-			b.logger.Warn().Str("event", string(d)).Err(err).Msg("failed to send message")
-		} else {
-			b.logger.Info().Str("event_id", e.ID()).Msg("success send message")
+			b.logger.Warn().Str("event_id", e.ID()).Err(err).Msg("failed to convert event to message")
+			return cdkgo.NewResult(http.StatusBadRequest, "dingtalk: event parse error: "+err.Error())
 		}
-	}()
+		for _, hook := range hooks {
+			byRobot.Add(hook.URL, delivery{event: e, hook: hook, msg: botMsg})
+		}
+	}
+	results := keyed.Each(&byRobot, func(url string, deliveries []delivery) cdkgo.Result {
+		return b.postAll(ctx, url, deliveries)
+	})
+	for _, result := range results {
+		if result != cdkgo.SuccessResult {
+			return result
+		}
+	}
+	return cdkgo.SuccessResult
+}
+
+func (b *Bot) getWebhooks(e *v2.Event) ([]WebHook, cdkgo.Result) {
+	var hooks []WebHook
 	chatGroup, ok := e.Extensions()[xChatGroupID].(string)
 	if ok {
-		_, exist := b.hookMap[chatGroup]
-		if !exist {
-			return fmt.Errorf("chat group %s is not exist", chatGroup)
+		hook, exist := b.hookMap[chatGroup]
+		if exist {
+			hooks = append(hooks, hook)
+		} else if !b.cfg.DynamicRoute {
+			return nil, cdkgo.NewResult(http.StatusBadRequest,
+				fmt.Sprintf("dingtalk: chat group %s is not exist", chatGroup))
 		}
-	} else {
-		chatGroup = b.defaultChatGroup
-	}
-	msgType, ok := e.Extensions()[xMessageType].(string)
-	if !ok {
-		msgType = string(textMessage)
+	} else if !b.cfg.DynamicRoute {
+		hooks = append(hooks, b.hookMap[b.defaultChatGroup])
 	}
 
-	botMsg, err := b.event2Message(e, messageType(msgType))
-	if err != nil {
-		return err
+	if b.cfg.DynamicRoute {
+		urlAttr, ok := e.Extensions()[xBotURL].(string)
+		if !ok {
+			return nil, errInvalidAttributes
+		}
+		urls := strings.Split(urlAttr, ",")
+		// the webhooks have no signature if xvbotsigns is missing.
+		signatures := make([]string, len(urls))
+		if signatureAttr, ok := e.Extensions()[xBotSignature].(string); ok {
+			signatures = strings.Split(signatureAttr, ",")
+		}
+		if len(urls) != len(signatures) {
+			return nil, errInvalidAttributeNumber
+		}
+		for idx := range urls {
+			hooks = append(hooks, WebHook{
+				URL:       urls[idx],
+				Signature: signatures[idx],
+			})
+		}
+	}
+	if len(hooks) == 0 {
+		return nil, errNoWebhookFound
 	}
-	return b.postMessage(botMsg, b.hookMap[chatGroup])
+	return hooks, cdkgo.SuccessResult
+}
+
+// postAll posts the messages to a robot. The messages after a failed one aren't posted, since
+// the events are redelivered together and a message must not overtake the failed one.
+func (b *Bot) postAll(ctx context.Context, url string, deliveries []delivery) cdkgo.Result {
+	result := cdkgo.SuccessResult
+	b.robots.Do(url, func(w *sendWindow) {
+		for _, d := range deliveries {
+			if err := w.reserve(ctx, b.cfg.RateLimit); err != nil {
+				result = cdkgo.NewResult(http.StatusInternalServerError, "dingtalk: wait rate limit error: "+err.Error())
+				return
+			}
+			if result = b.postMessage(ctx, d.msg, d.hook); result != cdkgo.SuccessResult {
+				e, _ := d.event.MarshalJSON()
+				b.logger.Warn().Str("event", string(e)).Str("error", result.GetMsg()).Msg("failed to send message")
+				return
+			}
+			b.logger.Info().Str("event_id", d.event.ID()).Msg("success send message")
+		}
+	})
+	return result
 }
 
 func (b *Bot) event2Message(e *v2.Event, msgType messageType) (*botMessage, error) {
 	switch msgType {
 	case textMessage:
-		return &botMessage{MsgType: textMessage, Text: map[string]interface{}{
+		botMsg := &botMessage{MsgType: textMessage, Text: map[string]interface{}{
 			"content": string(e.Data()),
-		}}, nil
+		}}
+		// the json data with content can mention users by at, e.g. {"content":"xxx","at":{...}}
+		if e.DataContentType() == v2.ApplicationJSON {
+			obj := gjson.ParseBytes(e.Data())
+			if content := obj.Get("content"); obj.IsObject() && content.Type == gjson.String {
+				botMsg.Text["content"] = content.String()
+				if at := obj.Get("at"); at.Exists() {
+					botMsg.At = &botAt{}
+					if err := json.Unmarshal([]byte(at.Raw), botMsg.At); err != nil {
+						return nil, fmt.Errorf("invalid at: %w", err)
+					}
+				}
+			}
+		}
+		b.setDefaultAt(botMsg)
+		return botMsg, nil
 	default:
 		var data map[string]interface{}
 		err := json.Unmarshal(e.Data(), &data)
@@ -122,6 +266,14 @@ func (b *Bot) event2Message(e *v2.Event, msgType messageType) (*botMessage, erro
 			return nil, err
 		}
 		botMsg := &botMessage{MsgType: msgType}
+		if at, ok := data["at"]; ok {
+			delete(data, "at")
+			botMsg.At = &botAt{}
+			raw, _ := json.Marshal(at)
+			if err = json.Unmarshal(raw, botMsg.At); err != nil {
+				return nil, fmt.Errorf("invalid at: %w", err)
+			}
+		}
 		switch msgType {
 		case linkMessage:
 			botMsg.Link = data
@@ -134,24 +286,43 @@ func (b *Bot) event2Message(e *v2.Event, msgType messageType) (*botMessage, erro
 		default:
 			return nil, fmt.Errorf("invalid message type:%s", msgType)
 		}
+		b.setDefaultAt(botMsg)
 		return botMsg, nil
 	}
 }
 
-func (b *Bot) postMessage(botMsg *botMessage, hook WebHook) error {
+// setDefaultAt mentions the users in config if the event doesn't mention anyone.
+func (b *Bot) setDefaultAt(botMsg *botMessage) {
+	if botMsg.At != nil {
+		return
+	}
+	at := b.cfg.At
+	if len(at.AtMobiles) == 0 && len(at.AtUserIds) == 0 && !at.IsAtAll {
+		return
+	}
+	botMsg.At = &botAt{
+		AtMobiles: at.AtMobiles,
+		AtUserIds: at.AtUserIds,
+		IsAtAll:   at.IsAtAll,
+	}
+}
+
+func (b *Bot) postMessage(ctx context.Context, botMsg *botMessage, hook WebHook) cdkgo.Result {
 	body, err := json.Marshal(botMsg)
 	if err != nil {
-		return err
-	}
-	t := time.Now().UnixMilli()
-	sign := b.genSignature(t, hook.Signature)
-	res, err := b.httpClient.R().
-		SetQueryParam(paramTimestamp, strconv.FormatInt(t, 10)).
-		SetQueryParam(paramSign, sign).
-		SetHeader(http.ContentType, "application/json; charset=utf-8").
-		SetBody(body).Post(hook.URL)
+		return cdkgo.NewResult(http.StatusBadRequest, "dingtalk: marshal message error: "+err.Error())
+	}
+	req := b.httpClient.R().SetContext(ctx).
+		SetHeader("Content-Type", "application/json; charset=utf-8").
+		SetBody(body)
+	if hook.Signature != "" {
+		t := time.Now().UnixMilli()
+		req.SetQueryParam(paramTimestamp, strconv.FormatInt(t, 10)).
+			SetQueryParam(paramSign, b.genSignature(t, hook.Signature))
+	}
+	res, err := req.Post(hook.URL)
 	if err != nil {
-		return err
+		return cdkgo.NewResult(http.StatusInternalServerError, "dingtalk: call dingtalk error: "+err.Error())
 	}
 	return b.processResponse(res)
 }
@@ -163,10 +334,18 @@ func (b *Bot) genSignature(milli int64, secret string) string {
 	return base64.StdEncoding.EncodeToString(h.Sum(nil))
 }
 
-func (b *Bot) processResponse(res *resty.Response) error {
+func (b *Bot) processResponse(res *resty.Response) cdkgo.Result {
+	if res.StatusCode() >= http.StatusInternalServerError {
+		return cdkgo.NewResult(http.StatusInternalServerError,
+			fmt.Sprintf("failed to call dingtalk: %s %s", res.Status(), string(res.Body())))
+	}
 	obj := gjson.ParseBytes(res.Body())
-	if obj.Get("errcode").Int() == 0 {
-		return nil
+	switch obj.Get("errcode").Int() {
+	case 0:
+		return cdkgo.SuccessResult
+	case codeSendTooFast, codeSendTooFast2:
+		return cdkgo.NewResult(http.StatusTooManyRequests,
+			fmt.Sprintf("failed to call dingtalk: %s", string(res.Body())))
 	}
-	return fmt.Errorf("failed to call dingtalk: %s", string(res.Body()))
+	return cdkgo.NewResult(http.StatusBadRequest, fmt.Sprintf("failed to call dingtalk: %s", string(res.Body())))
 }
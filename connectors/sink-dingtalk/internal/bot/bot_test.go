@@ -0,0 +1,208 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bot
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v2 "github.com/cloudevents/sdk-go/v2"
+	"github.com/rs/zerolog"
+	"github.com/tidwall/gjson"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+)
+
+// fakeRobots records the text messages posted to each robot, which is the path of the url.
+type fakeRobots struct {
+	*httptest.Server
+	lock     sync.Mutex
+	messages map[string][]string
+	signed   map[string]bool
+	// block is waited for before a message to /slow is handled.
+	block chan struct{}
+}
+
+func newFakeRobots(t *testing.T) *fakeRobots {
+	f := &fakeRobots{
+		messages: map[string][]string{},
+		signed:   map[string]bool{},
+		block:    make(chan struct{}),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-f.block
+		}
+		body, _ := io.ReadAll(r.Body)
+		content := gjson.GetBytes(body, "text.content").String()
+		f.lock.Lock()
+		f.messages[r.URL.Path] = append(f.messages[r.URL.Path], content)
+		f.signed[r.URL.Path] = r.URL.Query().Get(paramSign) != ""
+		f.lock.Unlock()
+		if strings.HasPrefix(content, "fail") {
+			_, _ = w.Write([]byte(`{"errcode":300001,"errmsg":"invalid"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"errcode":0,"errmsg":"ok"}`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeRobots) received(path string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.messages[path]...)
+}
+
+func newTestBot(t *testing.T, f *fakeRobots) *Bot {
+	cfg := Config{
+		Webhooks: []WebHook{
+			{ChatGroup: "a", URL: f.URL + "/a", Signature: "SECa"},
+			{ChatGroup: "b", URL: f.URL + "/b"},
+			{ChatGroup: "slow", URL: f.URL + "/slow"},
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBot(zerolog.Nop())
+	if err := b.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newTestEvent(chatGroup, text string) *v2.Event {
+	e := v2.NewEvent()
+	e.SetID(text)
+	e.SetExtension(xChatGroupID, chatGroup)
+	_ = e.SetData(v2.TextPlain, text)
+	return &e
+}
+
+func TestSendMessagesInOrderPerRobot(t *testing.T) {
+	f := newFakeRobots(t)
+	b := newTestBot(t, f)
+	result := b.SendMessages(context.Background(), []*v2.Event{
+		newTestEvent("a", "a1"),
+		newTestEvent("b", "b1"),
+		newTestEvent("a", "fail a2"),
+		newTestEvent("b", "b2"),
+		newTestEvent("a", "a3"),
+	})
+	if result.GetCode() != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want the failure of a2", result.GetCode(), result.GetMsg())
+	}
+	if got, want := f.received("/a"), []string{"a1", "fail a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v, a3 mustn't be posted after a2 fails", got, want)
+	}
+	if got, want := f.received("/b"), []string{"b1", "b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.signed["/a"] || f.signed["/b"] {
+		t.Errorf("got signed %v, want only the robot with a signature signed", f.signed)
+	}
+}
+
+func TestSlowRobotDoesNotBlockOthers(t *testing.T) {
+	f := newFakeRobots(t)
+	b := newTestBot(t, f)
+	done := make(chan cdkgo.Result, 1)
+	go func() {
+		done <- b.SendMessages(context.Background(), []*v2.Event{newTestEvent("slow", "s1")})
+	}()
+	if result := b.SendMessages(context.Background(), []*v2.Event{newTestEvent("b", "b1")}); result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+	close(f.block)
+	if result := <-done; result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+}
+
+func TestDynamicRouteSignatures(t *testing.T) {
+	f := newFakeRobots(t)
+	cfg := Config{DynamicRoute: true}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	b := NewBot(zerolog.Nop())
+	if err := b.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// the webhooks have no signature if xvbotsigns is missing.
+	e := newTestEvent("", "d1")
+	delete(e.Extensions(), xChatGroupID)
+	e.SetExtension(xBotURL, f.URL+"/x,"+f.URL+"/y")
+	if result := b.SendMessages(context.Background(), []*v2.Event{e}); result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+	e = newTestEvent("", "d2")
+	delete(e.Extensions(), xChatGroupID)
+	e.SetExtension(xBotURL, f.URL+"/x,"+f.URL+"/y")
+	e.SetExtension(xBotSignature, ",SECy")
+	if result := b.SendMessages(context.Background(), []*v2.Event{e}); result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+	if got, want := f.received("/x"), []string{"d1", "d2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := f.received("/y"), []string{"d1", "d2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	f.lock.Lock()
+	if f.signed["/x"] || !f.signed["/y"] {
+		t.Errorf("got signed %v, want the last message to /y signed only", f.signed)
+	}
+	f.lock.Unlock()
+
+	e.SetExtension(xBotSignature, "SECx")
+	if result := b.SendMessages(context.Background(), []*v2.Event{e}); result.GetCode() != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want 400 for the mismatched signatures", result.GetCode(), result.GetMsg())
+	}
+}
+
+func TestSendWindowReserve(t *testing.T) {
+	w := &sendWindow{}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if err := w.reserve(ctx, 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.reserve(ctx, 2); err == nil {
+		t.Fatal("want the third message in a minute to wait")
+	}
+
+	w = &sendWindow{sent: []time.Time{time.Now().Add(-2 * time.Minute), time.Now().Add(-time.Second)}}
+	if err := w.reserve(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.sent) != 2 {
+		t.Errorf("got %d messages in the window, want the expired one removed", len(w.sent))
+	}
+}
@@ -22,16 +22,30 @@ import (
 type WebHook struct {
 	ChatGroup string `json:"chat_group" yaml:"chat_group" validate:"required"`
 	URL       string `json:"url" yaml:"url" validate:"required"`
-	Signature string `json:"signature" yaml:"signature" validate:"required"`
+	// Signature signs the requests if the security setting of the robot is signing.
+	Signature string `json:"signature" yaml:"signature"`
+}
+
+// AtConfig is the users mentioned by the messages.
+type AtConfig struct {
+	AtMobiles []string `json:"at_mobiles" yaml:"at_mobiles"`
+	AtUserIds []string `json:"at_user_ids" yaml:"at_user_ids"`
+	IsAtAll   bool     `json:"is_at_all" yaml:"is_at_all"`
 }
 
 type Config struct {
-	Webhooks []WebHook `json:"webhooks" yaml:"webhooks" validate:"dive"`
-	Default  string    `json:"default" yaml:"default"`
+	Webhooks     []WebHook `json:"webhooks" yaml:"webhooks" validate:"dive"`
+	Default      string    `json:"default" yaml:"default"`
+	DynamicRoute bool      `json:"dynamic_route" yaml:"dynamic_route"`
+	// At is the default users mentioned by the messages, it's overridden by the at in event data.
+	At AtConfig `json:"at" yaml:"at"`
+	// RateLimit is the max number of messages per minute to a webhook, dingtalk throttles a robot
+	// for 10 minutes if it sends more than 20 messages in a minute.
+	RateLimit int `json:"rate_limit" yaml:"rate_limit"`
 }
 
 func (c *Config) Validate() error {
-	if len(c.Webhooks) == 0 {
+	if !c.DynamicRoute && len(c.Webhooks) == 0 {
 		return errors.New("the Bot.webhooks can't be empty when dynamic_route is false")
 	}
 	if c.Default != "" && !c.defaultExist() {
@@ -43,6 +57,12 @@ func (c *Config) Validate() error {
 			return err
 		}
 	}
+	if c.RateLimit < 0 {
+		return errors.New("the Bot.rate_limit can't be negative")
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = defaultRateLimit
+	}
 	return nil
 }
 
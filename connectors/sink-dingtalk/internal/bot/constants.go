@@ -14,8 +14,19 @@
 
 package bot
 
+import "time"
+
 const (
 	paramAccessToken = "access_token"
 	paramTimestamp   = "timestamp"
 	paramSign        = "sign"
+
+	defaultRateLimit = 20
+	// robotIdleTimeout releases the send window of a robot which isn't posted to, the window
+	// only covers the last minute.
+	robotIdleTimeout = 10 * time.Minute
+
+	// the codes of throttled requests.
+	codeSendTooFast  = 130101
+	codeSendTooFast2 = 410100
 )
@@ -16,7 +16,6 @@ package internal
 
 import (
 	"context"
-	"net/http"
 	"sync/atomic"
 
 	v2 "github.com/cloudevents/sdk-go/v2"
@@ -31,11 +30,6 @@ const (
 	name = "Dingtalk Sink"
 )
 
-var (
-	errSinkWrongEventNumber = cdkgo.NewResult(http.StatusBadRequest,
-		"the event number must be 1")
-)
-
 func NewSink() cdkgo.Sink {
 	return &dingtalkSink{}
 }
@@ -49,17 +43,13 @@ type dingtalkSink struct {
 	logger zerolog.Logger
 }
 
-func (f *dingtalkSink) Arrived(_ context.Context, events ...*v2.Event) cdkgo.Result {
-	if len(events) != 1 {
-		return errSinkWrongEventNumber
-	}
-	e := events[0]
-	atomic.AddInt64(&f.count, int64(len(events)))
-	f.logger.Info().Int64("count", atomic.LoadInt64(&f.count)).Str("event_id", e.ID()).Msg("receive a new event")
-	if err := f.b.SendMessage(e); err != nil {
-		return cdkgo.NewResult(http.StatusInternalServerError, err.Error())
+func (f *dingtalkSink) Arrived(ctx context.Context, events ...*v2.Event) cdkgo.Result {
+	if len(events) == 0 {
+		return cdkgo.SuccessResult
 	}
-	return cdkgo.SuccessResult
+	count := atomic.AddInt64(&f.count, int64(len(events)))
+	f.logger.Info().Int64("count", count).Int("events", len(events)).Msg("receive new events")
+	return f.b.SendMessages(ctx, events)
 }
 
 func (f *dingtalkSink) Initialize(ctx context.Context, cfg cdkgo.ConfigAccessor) error {
@@ -0,0 +1,94 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+
+	"github.com/pierrec/lz4/v4"
+)
+
+type Flavor string
+
+const (
+	FlavorDoris     Flavor = "doris"
+	FlavorStarRocks Flavor = "starrocks"
+)
+
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	CompressionGzip Compression = "gzip"
+	CompressionLZ4  Compression = "lz4"
+)
+
+// body returns the body of the batch. StarRocks doesn't read json lines, the rows are sent
+// as a json array instead.
+func (l *StreamLoad) body(batch *loadBatch) ([]byte, error) {
+	data := batch.bytes()
+	if l.config.Flavor == FlavorStarRocks && l.config.Format == FormatJSON {
+		rows := bytes.TrimSuffix(data, []byte{'\n'})
+		array := make([]byte, 0, len(rows)+2)
+		array = append(array, '[')
+		array = append(array, bytes.ReplaceAll(rows, []byte{'\n'}, []byte{','})...)
+		data = append(array, ']')
+	}
+	var (
+		buf bytes.Buffer
+		w   io.WriteCloser
+	)
+	switch l.config.Compression {
+	case CompressionGzip:
+		w = gzip.NewWriter(&buf)
+	case CompressionLZ4:
+		w = lz4.NewWriter(&buf)
+	default:
+		return data, nil
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setCompressionHeader sets the compression of the body, the header and its values are
+// different between Doris and StarRocks.
+func (l *StreamLoad) setCompressionHeader(header http.Header) {
+	if l.config.Compression == CompressionNone {
+		return
+	}
+	if l.config.Flavor == FlavorStarRocks {
+		switch l.config.Compression {
+		case CompressionGzip:
+			header.Set("compression", "gzip")
+		case CompressionLZ4:
+			header.Set("compression", "lz4_frame")
+		}
+		return
+	}
+	switch l.config.Compression {
+	case CompressionGzip:
+		header.Set("compress_type", "gz")
+	case CompressionLZ4:
+		header.Set("compress_type", "lz4")
+	}
+}
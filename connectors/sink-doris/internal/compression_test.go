@@ -0,0 +1,121 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pierrec/lz4/v4"
+	cdkgo "github.com/vanus-labs/cdk-go"
+)
+
+func TestCompressedLoads(t *testing.T) {
+	cases := []struct {
+		flavor      Flavor
+		compression Compression
+		// header and value of the compression.
+		header, value string
+		body          string
+	}{
+		{flavor: FlavorDoris, compression: CompressionGzip, header: "compress_type", value: "gz",
+			body: "{\"id\":1}\n{\"id\":2}\n"},
+		{flavor: FlavorDoris, compression: CompressionLZ4, header: "compress_type", value: "lz4",
+			body: "{\"id\":1}\n{\"id\":2}\n"},
+		{flavor: FlavorStarRocks, compression: CompressionNone, body: `[{"id":1},{"id":2}]`},
+		{flavor: FlavorStarRocks, compression: CompressionGzip, header: "compression", value: "gzip",
+			body: `[{"id":1},{"id":2}]`},
+		{flavor: FlavorStarRocks, compression: CompressionLZ4, header: "compression", value: "lz4_frame",
+			body: `[{"id":1},{"id":2}]`},
+	}
+	for _, c := range cases {
+		t.Run(string(c.flavor)+"-"+string(c.compression), func(t *testing.T) {
+			var header http.Header
+			var body string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header = r.Header.Clone()
+				var reader io.Reader = r.Body
+				switch c.compression {
+				case CompressionGzip:
+					zr, err := gzip.NewReader(r.Body)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					reader = zr
+				case CompressionLZ4:
+					reader = lz4.NewReader(r.Body)
+				}
+				data, err := io.ReadAll(reader)
+				if err != nil {
+					t.Error(err)
+				}
+				body = string(data)
+				_ = json.NewEncoder(w).Encode(loadResult{Status: "Success"})
+			}))
+			defer srv.Close()
+
+			cfg := testConfig(strings.TrimPrefix(srv.URL, "http://"))
+			cfg.LoadSize = 1 << 20
+			cfg.Flavor = c.flavor
+			cfg.Compression = c.compression
+			s := startSink(t, cfg)
+			defer func() { _ = s.Destroy() }()
+			// both events are loaded at once when the sink is destroyed.
+			done := make(chan cdkgo.Result, 1)
+			go func() {
+				done <- s.Arrived(context.Background(), jsonEvent("1", `{"id":1}`), jsonEvent("2", `{"id":2}`))
+			}()
+			l, err := s.getStreamLoad(target{database: "db", table: "events"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				l.lock.Lock()
+				buffered := l.current != nil
+				l.lock.Unlock()
+				if buffered {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			l.Stop()
+			if result := <-done; result != cdkgo.SuccessResult {
+				t.Fatal(result.Error())
+			}
+
+			if body != c.body {
+				t.Fatalf("got body %q, want %q", body, c.body)
+			}
+			if c.header != "" && header.Get(c.header) != c.value {
+				t.Fatalf("got %s %q, want %q", c.header, header.Get(c.header), c.value)
+			}
+			if c.flavor == FlavorStarRocks {
+				if header.Get("strip_outer_array") != "true" || header.Get("read_json_by_line") != "" {
+					t.Fatalf("got headers %v of a starrocks json load", header)
+				}
+			} else if header.Get("read_json_by_line") != "true" {
+				t.Fatalf("got headers %v of a doris json load", header)
+			}
+		})
+	}
+}
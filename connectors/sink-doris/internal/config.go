@@ -15,6 +15,9 @@
 package internal
 
 import (
+	"regexp"
+
+	"github.com/pkg/errors"
 	cdkgo "github.com/vanus-labs/cdk-go"
 )
 
@@ -23,16 +26,142 @@ type dorisConfig struct {
 
 	StreamLoad map[string]string `json:"stream_load" yaml:"stream_load"`
 
-	Timeout      int    `json:"timeout" yaml:"timeout"`
-	LoadInterval int    `json:"load_interval" yaml:"load_interval"`
-	LoadSize     int    `json:"load_size" yaml:"load_size"`
-	Secret       Secret `json:"secret" yaml:"secret"`
+	Timeout      int `json:"timeout" yaml:"timeout"`
+	LoadInterval int `json:"load_interval" yaml:"load_interval"`
+	LoadSize     int `json:"load_size" yaml:"load_size"`
+	// MaxRetries is the max retry times of a failed stream load, 0 means no retry, and it's 3
+	// if it's not set.
+	MaxRetries *int `json:"max_retries" yaml:"max_retries"`
+	// RetryInterval is the interval in second before the first retry, it's doubled for each retry.
+	RetryInterval int `json:"retry_interval" yaml:"retry_interval"`
+	// ExactlyOnce loads the events of each request alone with a label derived from them, so a
+	// retried or redelivered load is rejected by Doris rather than inserted twice.
+	ExactlyOnce bool `json:"exactly_once" yaml:"exactly_once"`
+	// TwoPhaseCommit pre-commits a load and then commits it, or aborts it if the load fails.
+	TwoPhaseCommit bool `json:"two_phase_commit" yaml:"two_phase_commit"`
+	// LabelPrefix is the prefix of labels, it's at most 64 letters, digits, '_', '-' or ':'.
+	LabelPrefix string `json:"label_prefix" yaml:"label_prefix"`
+	// Route picks the database and table of each event, db_name and table_name are used if
+	// the event has no value.
+	Route  RouteConfig `json:"route" yaml:"route"`
+	Format Format      `json:"format" yaml:"format"`
+	CSV    CSVConfig   `json:"csv" yaml:"csv"`
+	// Columns is the columns header of stream load, it maps the fields to columns and can
+	// compute columns with expressions.
+	Columns   string   `json:"columns" yaml:"columns"`
+	JSONPaths []string `json:"jsonpaths" yaml:"jsonpaths"`
+	// CDCDelete deletes the rows of events with the attribute xvop=d from unique key tables.
+	CDCDelete bool `json:"cdc_delete" yaml:"cdc_delete"`
+	// Flavor is the server, doris or starrocks, which has the compatible stream load api.
+	Flavor      Flavor      `json:"flavor" yaml:"flavor"`
+	Compression Compression `json:"compression" yaml:"compression"`
+	HTTPS       bool        `json:"https" yaml:"https"`
+	// InsecureSkipVerify skips the verification of the server certificate, only for testing.
+	InsecureSkipVerify bool `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
+	// HealthCheckInterval is the interval in second of the health check of fe nodes.
+	HealthCheckInterval int `json:"health_check_interval" yaml:"health_check_interval"`
+	// MaxTables is the max number of tables which are loaded concurrently.
+	MaxTables int    `json:"max_tables" yaml:"max_tables"`
+	Secret    Secret `json:"secret" yaml:"secret"`
 }
 
+// labelPrefixRegexp leaves room for the rest of a label within the label limit of Doris.
+var labelPrefixRegexp = regexp.MustCompile(`^[-_A-Za-z0-9:]{1,64}$`)
+
 func Config() cdkgo.SinkConfigAccessor {
 	return &dorisConfig{}
 }
 
+func (cfg *dorisConfig) Validate() error {
+	if cfg.Secret.TableName == "" && cfg.Route.Table == "" {
+		return errors.New("table_name or route.table is required")
+	}
+	if cfg.LabelPrefix != "" && !labelPrefixRegexp.MatchString(cfg.LabelPrefix) {
+		return errors.Errorf("invalid label_prefix %s, it must be at most 64 letters, digits, '_', '-' or ':'",
+			cfg.LabelPrefix)
+	}
+	if cfg.MaxRetries != nil && *cfg.MaxRetries < 0 {
+		return errors.New("max_retries can't be negative")
+	}
+	if cfg.MaxTables < 0 {
+		return errors.New("max_tables can't be negative")
+	}
+	switch cfg.Flavor {
+	case "", FlavorDoris:
+	case FlavorStarRocks:
+		// StarRocks has different apis of transactions and deletes.
+		if cfg.TwoPhaseCommit {
+			return errors.New("two_phase_commit isn't supported by starrocks")
+		}
+		if cfg.CDCDelete {
+			return errors.New("cdc_delete isn't supported by starrocks")
+		}
+	default:
+		return errors.Errorf("invalid flavor %s", cfg.Flavor)
+	}
+	switch cfg.Compression {
+	case CompressionNone, CompressionGzip, CompressionLZ4:
+	default:
+		return errors.Errorf("invalid compression %s", cfg.Compression)
+	}
+	if cfg.HealthCheckInterval < 0 {
+		return errors.New("health_check_interval can't be negative")
+	}
+	switch cfg.Format {
+	case "", FormatJSON:
+		if len(cfg.CSV.Fields) > 0 {
+			return errors.New("csv is set but format isn't csv")
+		}
+	case FormatCSV:
+		if err := cfg.CSV.Validate(); err != nil {
+			return err
+		}
+		if len(cfg.JSONPaths) > 0 {
+			return errors.New("jsonpaths can't be set if format is csv")
+		}
+		if cfg.CDCDelete && cfg.Columns == "" {
+			return errors.New("columns is required if format is csv and cdc_delete is true")
+		}
+	default:
+		return errors.Errorf("invalid format %s", cfg.Format)
+	}
+	return cfg.SinkConfig.Validate()
+}
+
+func (cfg *dorisConfig) initDefaults() {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	if cfg.LoadInterval == 0 {
+		cfg.LoadInterval = defaultLoadInterval
+	}
+	if cfg.LoadSize == 0 {
+		cfg.LoadSize = defaultLoadSize
+	}
+	if cfg.MaxRetries == nil {
+		maxRetries := defaultMaxRetries
+		cfg.MaxRetries = &maxRetries
+	}
+	if cfg.RetryInterval == 0 {
+		cfg.RetryInterval = defaultRetryInterval
+	}
+	if cfg.LabelPrefix == "" {
+		cfg.LabelPrefix = defaultLabelPrefix
+	}
+	if cfg.MaxTables == 0 {
+		cfg.MaxTables = defaultMaxTables
+	}
+	if cfg.Format == "" {
+		cfg.Format = FormatJSON
+	}
+	if cfg.Flavor == "" {
+		cfg.Flavor = FlavorDoris
+	}
+	if cfg.HealthCheckInterval == 0 {
+		cfg.HealthCheckInterval = defaultHealthCheckInterval
+	}
+}
+
 func (cfg *dorisConfig) GetSecret() cdkgo.SecretAccessor {
 	return &cfg.Secret
 }
@@ -40,7 +169,7 @@ func (cfg *dorisConfig) GetSecret() cdkgo.SecretAccessor {
 type Secret struct {
 	Fenodes   string `json:"fenodes" yaml:"fenodes" validate:"required"`
 	DbName    string `json:"db_name" yaml:"db_name" validate:"required"`
-	TableName string `json:"table_name" yaml:"table_name" validate:"required"`
+	TableName string `json:"table_name" yaml:"table_name"`
 	Username  string `json:"username" yaml:"username" validate:"required"`
 	Password  string `json:"password" yaml:"password" validate:"required"`
 }
@@ -17,24 +17,45 @@ package internal
 import (
 	"context"
 	"net/http"
+	"sync"
+	"time"
 
 	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/pkg/errors"
 	cdkgo "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/cdk-go/log"
 )
 
 type dorisSink struct {
-	streamLoad *StreamLoad
+	config  *dorisConfig
+	fe      *frontends
+	encoder encoder
+
+	lock   sync.Mutex
+	tables map[target]*StreamLoad
+	// stopping is the stream loads which are evicted and still loading.
+	stopping sync.WaitGroup
 }
 
 func Sink() cdkgo.Sink {
-	return &dorisSink{}
+	return &dorisSink{
+		tables: map[target]*StreamLoad{},
+	}
 }
 
 func (s *dorisSink) Initialize(_ context.Context, config cdkgo.ConfigAccessor) error {
 	cfg := config.(*dorisConfig)
-	// init stream load
-	s.streamLoad = NewStreamLoad(cfg)
-	return s.streamLoad.Start()
+	cfg.initDefaults()
+	s.config = cfg
+	s.encoder = newEncoder(cfg)
+	s.fe = newFrontends(cfg)
+	s.fe.start()
+	if cfg.Route.Table == "" {
+		// open the configured table early, so the misconfiguration is found at start.
+		_, err := s.getStreamLoad(target{database: cfg.Secret.DbName, table: cfg.Secret.TableName})
+		return err
+	}
+	return nil
 }
 
 func (s *dorisSink) Name() string {
@@ -42,18 +63,139 @@ func (s *dorisSink) Name() string {
 }
 
 func (s *dorisSink) Destroy() error {
-	if s.streamLoad != nil {
-		s.streamLoad.Stop()
+	s.lock.Lock()
+	tables := s.tables
+	s.tables = map[target]*StreamLoad{}
+	s.lock.Unlock()
+	var wg sync.WaitGroup
+	for _, l := range tables {
+		wg.Add(1)
+		go func(l *StreamLoad) {
+			defer wg.Done()
+			l.Stop()
+		}(l)
+	}
+	wg.Wait()
+	s.stopping.Wait()
+	if s.fe != nil {
+		s.fe.stop()
 	}
 	return nil
 }
 
 func (s *dorisSink) Arrived(ctx context.Context, events ...*ce.Event) cdkgo.Result {
+	if len(events) == 0 {
+		return cdkgo.SuccessResult
+	}
+	var targets []target
+	groups := map[target][]*ce.Event{}
 	for _, event := range events {
-		err := s.streamLoad.WriteEvent(ctx, event)
+		t, err := s.route(event)
+		if err != nil {
+			return cdkgo.NewResult(http.StatusBadRequest, err.Error())
+		}
+		if _, ok := groups[t]; !ok {
+			targets = append(targets, t)
+		}
+		groups[t] = append(groups[t], event)
+	}
+	reqs := make([]*loadRequest, 0, len(targets))
+	for _, t := range targets {
+		req, err := s.writeEvents(t, groups[t])
 		if err != nil {
+			// the events written to other tables are withdrawn, or waited for if they are loading,
+			// so none of them is loaded after the failure is returned.
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			waitAll(canceled, reqs)
+			if errors.As(err, &invalidEventError{}) {
+				return cdkgo.NewResult(http.StatusBadRequest, err.Error())
+			}
 			return cdkgo.NewResult(http.StatusInternalServerError, err.Error())
 		}
+		reqs = append(reqs, req)
+	}
+	if err := waitAll(ctx, reqs); err != nil {
+		return cdkgo.NewResult(http.StatusInternalServerError, err.Error())
 	}
 	return cdkgo.SuccessResult
 }
+
+// waitAll waits for all the requests and returns the first error, the requests after a failed
+// one are still waited for, so they are never loaded after the failure is returned.
+func waitAll(ctx context.Context, reqs []*loadRequest) error {
+	var first error
+	for _, req := range reqs {
+		if err := req.wait(ctx); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (s *dorisSink) writeEvents(t target, events []*ce.Event) (*loadRequest, error) {
+	for {
+		l, err := s.getStreamLoad(t)
+		if err != nil {
+			return nil, err
+		}
+		req, err := l.WriteEvents(events)
+		// the stream load is evicted after it's got, get a new one.
+		if err == errStreamLoadClosed {
+			continue
+		}
+		return req, err
+	}
+}
+
+func (s *dorisSink) getStreamLoad(t target) (*StreamLoad, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if l, ok := s.tables[t]; ok {
+		return l, nil
+	}
+	if len(s.tables) >= s.config.MaxTables && !s.evict() {
+		return nil, errors.Errorf("too many tables are being loaded, max_tables is %d", s.config.MaxTables)
+	}
+	l := NewStreamLoad(s.config, s.fe, s.encoder, t.database, t.table)
+	if err := l.Start(); err != nil {
+		return nil, errors.Wrapf(err, "start stream load of %s", t)
+	}
+	s.tables[t] = l
+	log.Info("open table", map[string]interface{}{
+		"table": t.String(),
+		"total": len(s.tables),
+	})
+	return l, nil
+}
+
+// evict stops the least recently used table which has no buffered events, it must be called
+// with the lock held.
+func (s *dorisSink) evict() bool {
+	var (
+		oldest target
+		found  *StreamLoad
+	)
+	now := time.Now()
+	for t, l := range s.tables {
+		if !l.Idle(now) {
+			continue
+		}
+		if found == nil || l.lastUsedTime().Before(found.lastUsedTime()) {
+			oldest, found = t, l
+		}
+	}
+	if found == nil {
+		return false
+	}
+	delete(s.tables, oldest)
+	log.Info("close table", map[string]interface{}{
+		"table": oldest.String(),
+	})
+	s.stopping.Add(1)
+	go func() {
+		defer s.stopping.Done()
+		found.Stop()
+	}()
+	return true
+}
@@ -0,0 +1,351 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	cdkgo "github.com/vanus-labs/cdk-go"
+)
+
+// streamLoadAPI serves the stream loads with handle, which returns the status of a load, and
+// returns the address of it as fenodes.
+func streamLoadAPI(t *testing.T, handle func(label, body string) string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		label := r.Header.Get("label")
+		body, _ := io.ReadAll(r.Body)
+		_ = json.NewEncoder(w).Encode(loadResult{Label: label, Status: handle(label, string(body))})
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// testConfig loads every request at once.
+func testConfig(fenodes string) *dorisConfig {
+	return &dorisConfig{
+		LoadSize:     1,
+		LoadInterval: 3600,
+		Secret: Secret{
+			Fenodes:   fenodes,
+			DbName:    "db",
+			TableName: "events",
+			Username:  "root",
+			Password:  "root",
+		},
+	}
+}
+
+func startSink(t *testing.T, cfg *dorisConfig) *dorisSink {
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := Sink().(*dorisSink)
+	if err := s.Initialize(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func jsonEvent(id, data string) *ce.Event {
+	e := ce.NewEvent()
+	e.SetID(id)
+	e.SetSource("test")
+	e.SetType("test")
+	_ = e.SetData(ce.ApplicationJSON, json.RawMessage(data))
+	return &e
+}
+
+func TestArrivedWaitsForLoadingBatch(t *testing.T) {
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	s := startSink(t, testConfig(streamLoadAPI(t, func(label, body string) string {
+		close(loading)
+		<-release
+		return "Success"
+	})))
+	defer func() { _ = s.Destroy() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	done := make(chan cdkgo.Result, 1)
+	go func() {
+		done <- s.Arrived(ctx, jsonEvent("1", `{"id":1}`))
+	}()
+	<-loading
+	select {
+	case <-done:
+		t.Fatal("the result is returned while the batch is loading")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	if result := <-done; result != cdkgo.SuccessResult {
+		t.Fatalf("got %s, want success since the batch is loaded", result.Error())
+	}
+}
+
+func TestArrivedWithdrawsUnsealedEvents(t *testing.T) {
+	var loads int32
+	cfg := testConfig(streamLoadAPI(t, func(label, body string) string {
+		atomic.AddInt32(&loads, 1)
+		return "Success"
+	}))
+	cfg.LoadSize = 1 << 20
+	s := startSink(t, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if result := s.Arrived(ctx, jsonEvent("1", `{"id":1}`)); result == cdkgo.SuccessResult {
+		t.Fatal("want failure when the context is done")
+	}
+	_ = s.Destroy()
+	if n := atomic.LoadInt32(&loads); n != 0 {
+		t.Fatalf("got %d loads, want the withdrawn events not loaded", n)
+	}
+}
+
+func TestStopInterruptsRetryBackoff(t *testing.T) {
+	failed := make(chan struct{}, 10)
+	cfg := testConfig(streamLoadAPI(t, func(label, body string) string {
+		failed <- struct{}{}
+		return "Fail"
+	}))
+	cfg.RetryInterval = 3600
+	s := startSink(t, cfg)
+
+	done := make(chan cdkgo.Result, 1)
+	go func() {
+		done <- s.Arrived(context.Background(), jsonEvent("1", `{"id":1}`))
+	}()
+	<-failed
+	stopped := make(chan struct{})
+	go func() {
+		_ = s.Destroy()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("destroy is blocked by the retry backoff")
+	}
+	if result := <-done; result == cdkgo.SuccessResult {
+		t.Fatal("want failure since the load failed")
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	cases := []struct {
+		maxRetries *int
+		want       int32
+	}{
+		{maxRetries: nil, want: 1 + defaultMaxRetries},
+		{maxRetries: new(int), want: 1},
+	}
+	for _, c := range cases {
+		var loads int32
+		cfg := testConfig(streamLoadAPI(t, func(label, body string) string {
+			atomic.AddInt32(&loads, 1)
+			return "Fail"
+		}))
+		cfg.MaxRetries = c.maxRetries
+		cfg.RetryInterval = 1
+		s := startSink(t, cfg)
+		// the backoff is shortened to keep the test fast.
+		l, err := s.getStreamLoad(target{database: "db", table: "events"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.retryInterval = time.Millisecond
+		if result := s.Arrived(context.Background(), jsonEvent("1", `{"id":1}`)); result == cdkgo.SuccessResult {
+			t.Fatal("want failure since the load failed")
+		}
+		_ = s.Destroy()
+		if n := atomic.LoadInt32(&loads); n != c.want {
+			t.Fatalf("max_retries %v: got %d loads, want %d", cfg.MaxRetries, n, c.want)
+		}
+	}
+
+	cfg := testConfig("localhost:8030")
+	negative := -1
+	cfg.MaxRetries = &negative
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("want error for negative max_retries")
+	}
+}
+
+func TestExactlyOnceLabelPerRequest(t *testing.T) {
+	var lock sync.Mutex
+	var labels, bodies []string
+	cfg := testConfig(streamLoadAPI(t, func(label, body string) string {
+		lock.Lock()
+		defer lock.Unlock()
+		labels = append(labels, label)
+		bodies = append(bodies, body)
+		return "Success"
+	}))
+	cfg.ExactlyOnce = true
+	cfg.LoadSize = 1 << 20
+	s := startSink(t, cfg)
+	defer func() { _ = s.Destroy() }()
+
+	a := []*ce.Event{jsonEvent("1", `{"id":1}`), jsonEvent("2", `{"id":2}`)}
+	b := []*ce.Event{jsonEvent("3", `{"id":3}`)}
+	ctx := context.Background()
+	for _, events := range [][]*ce.Event{a, b, a} {
+		if result := s.Arrived(ctx, events...); result != cdkgo.SuccessResult {
+			t.Fatal(result.Error())
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(labels) != 3 {
+		t.Fatalf("got %d loads, want a load per request", len(labels))
+	}
+	if labels[0] != labels[2] {
+		t.Errorf("got labels %s and %s for the same events", labels[0], labels[2])
+	}
+	if labels[0] == labels[1] {
+		t.Errorf("got the same label %s for different events", labels[0])
+	}
+	if bodies[1] != "{\"id\":3}\n" {
+		t.Errorf("got body %q, want the events of the request only", bodies[1])
+	}
+	for _, label := range labels {
+		if len(label) > maxLabelLength || !labelRegexp.MatchString(label) {
+			t.Errorf("invalid label %s", label)
+		}
+	}
+}
+
+func TestTimeLabel(t *testing.T) {
+	cfg := &dorisConfig{LabelPrefix: strings.Repeat("p", 64)}
+	cases := []struct {
+		table     string
+		wantTable bool
+	}{
+		{table: "events", wantTable: true},
+		{table: "事件"},
+		{table: "a.b"},
+		{table: strings.Repeat("t", 64)},
+	}
+	for _, c := range cases {
+		l := NewStreamLoad(cfg, nil, nil, "db", c.table)
+		label := l.timeLabel()
+		if len(label) > maxLabelLength || !labelRegexp.MatchString(label) {
+			t.Errorf("table %s: invalid label %s", c.table, label)
+		}
+		if got := strings.Contains(label, "_"+c.table+"_"); got != c.wantTable {
+			t.Errorf("table %s: got label %s", c.table, label)
+		}
+	}
+}
+
+func TestValidateLabelPrefix(t *testing.T) {
+	cases := []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: ""},
+		{prefix: "vanus-sink:1_a"},
+		{prefix: strings.Repeat("p", 64)},
+		{prefix: strings.Repeat("p", 65), wantErr: true},
+		{prefix: "a.b", wantErr: true},
+	}
+	for _, c := range cases {
+		cfg := &dorisConfig{
+			LabelPrefix: c.prefix,
+			Secret:      Secret{Fenodes: "localhost:8030", DbName: "db", TableName: "t", Username: "u", Password: "p"},
+		}
+		if err := cfg.Validate(); (err != nil) != c.wantErr {
+			t.Errorf("prefix %s: got error %v, want error %t", c.prefix, err, c.wantErr)
+		}
+	}
+}
+
+func TestSealDoesNotBlockWhileLoading(t *testing.T) {
+	var loads int32
+	loading := make(chan struct{}, 10)
+	release := make(chan struct{})
+	s := startSink(t, testConfig(streamLoadAPI(t, func(label, body string) string {
+		atomic.AddInt32(&loads, 1)
+		loading <- struct{}{}
+		<-release
+		return "Success"
+	})))
+
+	const n = 4
+	results := make(chan cdkgo.Result, n)
+	// the first batch is loading, the others are sealed while it's blocked.
+	go func() {
+		results <- s.Arrived(context.Background(), jsonEvent("0", `{"id":0}`))
+	}()
+	<-loading
+	for i := 1; i < n; i++ {
+		id := fmt.Sprint(i)
+		go func() {
+			results <- s.Arrived(context.Background(), jsonEvent(id, `{"id":`+id+`}`))
+		}()
+	}
+	l, err := s.getStreamLoad(target{database: "db", table: "events"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		l.lock.Lock()
+		sealed := len(l.pending)
+		l.lock.Unlock()
+		if sealed == n-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if l.Idle(time.Now()) {
+			t.Error("the table is idle while loading")
+		}
+		if _, err := s.getStreamLoad(target{database: "db", table: "other"}); err != nil {
+			t.Error(err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the table is blocked by the slow load")
+	}
+
+	close(release)
+	for i := 0; i < n; i++ {
+		if result := <-results; result != cdkgo.SuccessResult {
+			t.Fatal(result.Error())
+		}
+	}
+	_ = s.Destroy()
+	if got := atomic.LoadInt32(&loads); got != n {
+		t.Fatalf("got %d loads, want %d", got, n)
+	}
+}
@@ -0,0 +1,272 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatCSV  Format = "csv"
+
+	attributeOp = "xvop"
+	// deleteSign is the hidden column of unique key tables which marks a row deleted.
+	deleteSign = "__DORIS_DELETE_SIGN__"
+	csvNull    = `\N`
+)
+
+type CSVConfig struct {
+	// Fields are the json paths of the data, in the order of the columns.
+	Fields []string `json:"fields" yaml:"fields"`
+	// separators can be hex strings such as \x01, as same as the stream load headers.
+	ColumnSeparator string `json:"column_separator" yaml:"column_separator"`
+	LineDelimiter   string `json:"line_delimiter" yaml:"line_delimiter"`
+	Enclose         string `json:"enclose" yaml:"enclose"`
+	Escape          string `json:"escape" yaml:"escape"`
+}
+
+func (c *CSVConfig) Validate() error {
+	if len(c.Fields) == 0 {
+		return errors.New("csv.fields is required if format is csv")
+	}
+	for name, v := range map[string]string{
+		"column_separator": c.ColumnSeparator,
+		"line_delimiter":   c.LineDelimiter,
+	} {
+		if _, err := parseSeparator(v); err != nil {
+			return errors.Wrapf(err, "invalid csv.%s", name)
+		}
+	}
+	if len(c.Enclose) > 1 || len(c.Escape) > 1 {
+		return errors.New("csv.enclose and csv.escape must be a single character")
+	}
+	return nil
+}
+
+// parseSeparator parses a separator which is a hex string prefixed with \x or the literal one.
+func parseSeparator(s string) (string, error) {
+	if !strings.HasPrefix(s, `\x`) {
+		return s, nil
+	}
+	b, err := hex.DecodeString(s[2:])
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// encoder converts events to the rows of a stream load and sets the headers of the format.
+type encoder interface {
+	encode(buf *bytes.Buffer, event *ce.Event) error
+	setHeaders(header http.Header)
+}
+
+func newEncoder(cfg *dorisConfig) encoder {
+	if cfg.Format == FormatCSV {
+		enc := &csvEncoder{
+			cfg:       cfg,
+			separator: cfg.CSV.ColumnSeparator,
+			delimiter: cfg.CSV.LineDelimiter,
+			enclose:   cfg.CSV.Enclose,
+			escape:    cfg.CSV.Escape,
+		}
+		// validated already.
+		enc.separator, _ = parseSeparator(enc.separator)
+		enc.delimiter, _ = parseSeparator(enc.delimiter)
+		if enc.separator == "" {
+			enc.separator = ","
+		}
+		if enc.delimiter == "" {
+			enc.delimiter = "\n"
+		}
+		if enc.enclose != "" && enc.escape == "" {
+			enc.escape = `\`
+		}
+		return enc
+	}
+	return &jsonEncoder{cfg: cfg}
+}
+
+// isDelete reports whether the event is a delete of cdc, which has the attribute xvop=d.
+func isDelete(event *ce.Event) bool {
+	op, ok := event.Extensions()[attributeOp].(string)
+	return ok && op == "d"
+}
+
+func setCommonHeaders(cfg *dorisConfig, header http.Header) {
+	columns := cfg.Columns
+	if cfg.CDCDelete {
+		if columns != "" {
+			columns += "," + deleteSign
+		}
+		header.Set("merge_type", "MERGE")
+		header.Set("delete", deleteSign+"=1")
+	}
+	if columns != "" {
+		header.Set("columns", columns)
+	}
+}
+
+type jsonEncoder struct {
+	cfg *dorisConfig
+}
+
+func (e *jsonEncoder) encode(buf *bytes.Buffer, event *ce.Event) error {
+	start := buf.Len()
+	if err := json.Compact(buf, event.Data()); err != nil {
+		buf.Truncate(start)
+		return errors.Wrapf(err, "event %s data is invalid json", event.ID())
+	}
+	if e.cfg.CDCDelete {
+		row := buf.Bytes()[start:]
+		if len(row) < 2 || row[0] != '{' {
+			buf.Truncate(start)
+			return errors.Errorf("event %s data isn't a json object", event.ID())
+		}
+		// append the delete sign to the object.
+		buf.Truncate(buf.Len() - 1)
+		if len(row) > 2 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"` + deleteSign + `":`)
+		if isDelete(event) {
+			buf.WriteString("1}")
+		} else {
+			buf.WriteString("0}")
+		}
+	}
+	buf.WriteByte('\n')
+	return nil
+}
+
+func (e *jsonEncoder) setHeaders(header http.Header) {
+	header.Set("format", "json")
+	header.Set("read_json_by_line", "true")
+	if len(e.cfg.JSONPaths) > 0 {
+		paths := e.cfg.JSONPaths
+		if e.cfg.CDCDelete {
+			paths = append(paths[:len(paths):len(paths)], "$."+deleteSign)
+		}
+		b, _ := json.Marshal(paths)
+		header.Set("jsonpaths", string(b))
+	}
+	setCommonHeaders(e.cfg, header)
+}
+
+type csvEncoder struct {
+	cfg       *dorisConfig
+	separator string
+	delimiter string
+	enclose   string
+	escape    string
+}
+
+func (e *csvEncoder) encode(buf *bytes.Buffer, event *ce.Event) error {
+	data := event.Data()
+	if !gjson.ValidBytes(data) {
+		return errors.Errorf("event %s data is invalid json", event.ID())
+	}
+	start := buf.Len()
+	for i, path := range e.cfg.CSV.Fields {
+		if i > 0 {
+			buf.WriteString(e.separator)
+		}
+		result := gjson.GetBytes(data, path)
+		var err error
+		switch {
+		case !result.Exists() || result.Type == gjson.Null:
+			buf.WriteString(csvNull)
+		case result.IsObject() || result.IsArray():
+			err = e.writeField(buf, result.Raw)
+		default:
+			err = e.writeField(buf, result.String())
+		}
+		if err != nil {
+			buf.Truncate(start)
+			return errors.Wrapf(err, "event %s field %s", event.ID(), path)
+		}
+	}
+	if e.cfg.CDCDelete {
+		buf.WriteString(e.separator)
+		if isDelete(event) {
+			buf.WriteString("1")
+		} else {
+			buf.WriteString("0")
+		}
+	}
+	buf.WriteString(e.delimiter)
+	return nil
+}
+
+// writeField encloses the value if it contains separators, and escapes the enclose and the
+// escape characters in it. If enclose isn't set, a value containing separators can't be
+// loaded as one column, so it's rejected.
+func (e *csvEncoder) writeField(buf *bytes.Buffer, value string) error {
+	if e.enclose == "" {
+		if strings.Contains(value, e.separator) || strings.Contains(value, e.delimiter) {
+			return errors.New("the value contains the csv separators, set csv.enclose to load it")
+		}
+		buf.WriteString(value)
+		return nil
+	}
+	if !e.needEnclose(value) {
+		buf.WriteString(value)
+		return nil
+	}
+	buf.WriteString(e.enclose)
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c == e.escape[0] || c == e.enclose[0] {
+			buf.WriteByte(e.escape[0])
+		}
+		buf.WriteByte(c)
+	}
+	buf.WriteString(e.enclose)
+	return nil
+}
+
+func (e *csvEncoder) needEnclose(value string) bool {
+	return strings.Contains(value, e.separator) || strings.Contains(value, e.delimiter) ||
+		strings.Contains(value, e.enclose) || strings.Contains(value, e.escape)
+}
+
+func (e *csvEncoder) setHeaders(header http.Header) {
+	header.Set("format", "csv")
+	if e.cfg.CSV.ColumnSeparator != "" {
+		header.Set("column_separator", e.cfg.CSV.ColumnSeparator)
+	}
+	// a line feed can't be in a header, and it's the default of doris.
+	if e.delimiter != "\n" {
+		header.Set("line_delimiter", e.cfg.CSV.LineDelimiter)
+	}
+	if e.enclose != "" {
+		header.Set("enclose", e.enclose)
+	}
+	if e.escape != "" {
+		header.Set("escape", e.escape)
+	}
+	setCommonHeaders(e.cfg, header)
+}
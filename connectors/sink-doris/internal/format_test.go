@@ -0,0 +1,148 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestJSONEncoder(t *testing.T) {
+	cfg := &dorisConfig{CDCDelete: true, JSONPaths: []string{"$.id"}}
+	enc := newEncoder(cfg)
+	var buf bytes.Buffer
+	insert := jsonEvent("1", `{ "id": 1 }`)
+	del := jsonEvent("2", `{"id":2}`)
+	del.SetExtension(attributeOp, "d")
+	if err := enc.encode(&buf, insert); err != nil {
+		t.Fatal(err)
+	}
+	if err := enc.encode(&buf, del); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":1,"__DORIS_DELETE_SIGN__":0}` + "\n" + `{"id":2,"__DORIS_DELETE_SIGN__":1}` + "\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf.String(), want)
+	}
+	if err := enc.encode(&buf, jsonEvent("3", `[1]`)); err == nil {
+		t.Fatal("want error for an array with cdc_delete")
+	}
+	if buf.String() != want {
+		t.Fatalf("the rejected event is left in the buffer: %q", buf.String())
+	}
+
+	header := http.Header{}
+	enc.setHeaders(header)
+	if header.Get("jsonpaths") != `["$.id","$.__DORIS_DELETE_SIGN__"]` || header.Get("merge_type") != "MERGE" {
+		t.Fatalf("got headers %v", header)
+	}
+	// the configured jsonpaths aren't changed.
+	if len(cfg.JSONPaths) != 1 {
+		t.Fatalf("jsonpaths is changed to %v", cfg.JSONPaths)
+	}
+}
+
+func TestCSVEncoder(t *testing.T) {
+	data := `{"id":1,"user":{"name":"a,b","tags":["x"]},"note":"say \"hi\"\\","empty":null}`
+	cases := []struct {
+		name    string
+		csv     CSVConfig
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "default separators",
+			csv:  CSVConfig{Fields: []string{"id", "note", "empty", "missing"}},
+			want: `1,say "hi"\,\N,\N` + "\n",
+		},
+		{
+			name:    "separator without enclose",
+			csv:     CSVConfig{Fields: []string{"id", "user.name"}},
+			wantErr: true,
+		},
+		{
+			name: "hex separators",
+			csv:  CSVConfig{Fields: []string{"id", "user.name", "user.tags"}, ColumnSeparator: `\x01`, LineDelimiter: `\x02`},
+			want: "1\x01a,b\x01[\"x\"]\x02",
+		},
+		{
+			name: "enclose",
+			csv:  CSVConfig{Fields: []string{"id", "user.name", "note", "user.tags"}, Enclose: `"`},
+			// the array contains the enclose, so it's enclosed too.
+			want: `1,"a,b","say \"hi\"\\","[\"x\"]"` + "\n",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := &dorisConfig{Format: FormatCSV, CSV: c.csv}
+			if err := cfg.CSV.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			err := newEncoder(cfg).encode(&buf, jsonEvent("1", data))
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %q", buf.String())
+				}
+				if buf.Len() != 0 {
+					t.Fatalf("the rejected event is left in the buffer: %q", buf.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != c.want {
+				t.Fatalf("got %q, want %q", buf.String(), c.want)
+			}
+		})
+	}
+}
+
+func TestCSVHeaders(t *testing.T) {
+	cfg := &dorisConfig{
+		Format:    FormatCSV,
+		Columns:   "id,name",
+		CDCDelete: true,
+		CSV:       CSVConfig{Fields: []string{"id", "name"}, ColumnSeparator: `\x01`, Enclose: `'`},
+	}
+	header := http.Header{}
+	newEncoder(cfg).setHeaders(header)
+	want := map[string]string{
+		"format":           "csv",
+		"column_separator": `\x01`,
+		"line_delimiter":   "",
+		"enclose":          "'",
+		"escape":           `\`,
+		"columns":          "id,name," + deleteSign,
+		"delete":           deleteSign + "=1",
+	}
+	for k, v := range want {
+		if got := header.Get(k); got != v {
+			t.Errorf("header %s: got %q, want %q", k, got, v)
+		}
+	}
+
+	var buf bytes.Buffer
+	del := jsonEvent("1", `{"id":1,"name":"it's"}`)
+	del.SetExtension(attributeOp, "d")
+	if err := newEncoder(cfg).encode(&buf, del); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "1\x01'it\\'s'\x011\n" {
+		t.Fatalf("got %q", buf.String())
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/vanus-labs/cdk-go/log"
+)
+
+const (
+	defaultHealthCheckInterval = 10
+	maxRedirects               = 10
+)
+
+// frontends are the FE nodes of the cluster. A load is sent to a healthy FE in turn, an FE
+// is marked unhealthy if a request to it or the health check fails, and becomes healthy
+// again after it passes the health check.
+type frontends struct {
+	config       *dorisConfig
+	client       *http.Client
+	scheme       string
+	authEncoding string
+	nodes        []*frontend
+	next         uint32
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+type frontend struct {
+	host    string
+	healthy int32
+}
+
+func newFrontends(cfg *dorisConfig) *frontends {
+	fe := &frontends{
+		config:       cfg,
+		scheme:       "http",
+		authEncoding: base64.StdEncoding.EncodeToString([]byte(cfg.Secret.Username + ":" + cfg.Secret.Password)),
+	}
+	if cfg.HTTPS {
+		fe.scheme = "https"
+	}
+	for _, host := range strings.Split(cfg.Secret.Fenodes, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		fe.nodes = append(fe.nodes, &frontend{host: host, healthy: 1})
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	fe.client = &http.Client{
+		Transport: transport,
+		Timeout:   time.Second * time.Duration(cfg.Timeout),
+		CheckRedirect: fe.checkRedirect,
+	}
+	fe.ctx, fe.cancel = context.WithCancel(context.Background())
+	return fe
+}
+
+// checkRedirect follows the redirect of a stream load from an FE to a BE. The authorization
+// is removed by the client if the BE has a different host, so it's set again, but only for
+// an FE or the BE an FE redirects to, and a redirect from https to http is refused.
+func (fe *frontends) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return errors.Errorf("refused the redirect from https to %s", req.URL.Redacted())
+	}
+	auth := via[0].Header.Get("Authorization")
+	if auth == "" {
+		return nil
+	}
+	if fe.isNode(req.URL.Host) || fe.isNode(via[len(via)-1].URL.Host) {
+		req.Header.Set("Authorization", auth)
+	} else {
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+func (fe *frontends) isNode(host string) bool {
+	for _, node := range fe.nodes {
+		if node.host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (fe *frontends) start() {
+	if len(fe.nodes) < 2 {
+		return
+	}
+	fe.wg.Add(1)
+	go func() {
+		defer fe.wg.Done()
+		t := time.NewTicker(time.Second * time.Duration(fe.config.HealthCheckInterval))
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				fe.checkHealth()
+			case <-fe.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (fe *frontends) stop() {
+	fe.cancel()
+	fe.wg.Wait()
+}
+
+// pick returns the next healthy FE, or the next one if none is healthy.
+func (fe *frontends) pick() *frontend {
+	n := uint32(len(fe.nodes))
+	start := atomic.AddUint32(&fe.next, 1)
+	for i := uint32(0); i < n; i++ {
+		node := fe.nodes[(start+i)%n]
+		if atomic.LoadInt32(&node.healthy) == 1 {
+			return node
+		}
+	}
+	return fe.nodes[start%n]
+}
+
+func (fe *frontends) url(node *frontend, path string) string {
+	return fmt.Sprintf("%s://%s%s", fe.scheme, node.host, path)
+}
+
+func (fe *frontends) markDown(node *frontend, err error) {
+	if len(fe.nodes) < 2 {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&node.healthy, 1, 0) {
+		log.Warning("fe is unhealthy", map[string]interface{}{
+			log.KeyError: err,
+			"fe":         node.host,
+		})
+	}
+}
+
+func (fe *frontends) checkHealth() {
+	for _, node := range fe.nodes {
+		err := fe.ping(node)
+		if err != nil {
+			fe.markDown(node, err)
+			continue
+		}
+		if atomic.CompareAndSwapInt32(&node.healthy, 0, 1) {
+			log.Info("fe is healthy", map[string]interface{}{
+				"fe": node.host,
+			})
+		}
+	}
+}
+
+func (fe *frontends) ping(node *frontend) error {
+	ctx, cancel := context.WithTimeout(fe.ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fe.url(node, "/api/health"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fe.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("health check response status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (fe *frontends) setAuth(req *http.Request) {
+	req.Header.Set("Authorization", "Basic "+fe.authEncoding)
+}
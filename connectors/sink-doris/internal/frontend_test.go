@@ -0,0 +1,90 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirectAuthorization(t *testing.T) {
+	// the BE redirects to another host when the path is /other.
+	auths := make(chan string, 3)
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- "other:" + r.Header.Get("Authorization")
+	}))
+	defer other.Close()
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- "be:" + r.Header.Get("Authorization")
+		if r.URL.Path == "/other" {
+			http.Redirect(w, r, other.URL, http.StatusTemporaryRedirect)
+		}
+	}))
+	defer be.Close()
+	feSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, be.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer feSrv.Close()
+
+	cfg := testConfig(strings.TrimPrefix(feSrv.URL, "http://"))
+	cfg.initDefaults()
+	fe := newFrontends(cfg)
+	want := "Basic " + fe.authEncoding
+	for _, c := range []struct {
+		path string
+		want []string
+	}{
+		{path: "/", want: []string{"be:" + want}},
+		{path: "/other", want: []string{"be:" + want, "other:"}},
+	} {
+		req, _ := http.NewRequest(http.MethodPut, fe.url(fe.nodes[0], c.path), nil)
+		fe.setAuth(req)
+		resp, err := fe.client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		for _, w := range c.want {
+			if got := <-auths; got != w {
+				t.Fatalf("%s: got %q, want %q", c.path, got, w)
+			}
+		}
+	}
+}
+
+func TestRedirectDowngradeIsRefused(t *testing.T) {
+	be := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the load is redirected to http")
+	}))
+	defer be.Close()
+	feSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, be.URL, http.StatusTemporaryRedirect)
+	}))
+	defer feSrv.Close()
+
+	cfg := testConfig(strings.TrimPrefix(feSrv.URL, "https://"))
+	cfg.HTTPS = true
+	cfg.InsecureSkipVerify = true
+	cfg.initDefaults()
+	fe := newFrontends(cfg)
+	req, _ := http.NewRequest(http.MethodPut, fe.url(fe.nodes[0], "/"), nil)
+	fe.setAuth(req)
+	if resp, err := fe.client.Do(req); err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("want error for the redirect from https to http")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"github.com/tidwall/gjson"
+)
+
+// RouteConfig picks the database and table from the event, a value starting with "data." is
+// the json path of the data, otherwise it's the name of an event extension.
+type RouteConfig struct {
+	Database string `json:"database" yaml:"database"`
+	Table    string `json:"table" yaml:"table"`
+}
+
+type target struct {
+	database string
+	table    string
+}
+
+func (t target) String() string {
+	return t.database + "." + t.table
+}
+
+func (s *dorisSink) route(event *ce.Event) (target, error) {
+	t := target{
+		database: routeValue(event, s.config.Route.Database),
+		table:    routeValue(event, s.config.Route.Table),
+	}
+	if t.database == "" {
+		t.database = s.config.Secret.DbName
+	}
+	if t.table == "" {
+		t.table = s.config.Secret.TableName
+	}
+	if t.table == "" {
+		return t, fmt.Errorf("event %s has no table %s", event.ID(), s.config.Route.Table)
+	}
+	return t, nil
+}
+
+func routeValue(event *ce.Event, source string) string {
+	if source == "" {
+		return ""
+	}
+	if strings.HasPrefix(source, "data.") {
+		return gjson.GetBytes(event.Data(), source[len("data."):]).String()
+	}
+	v, ok := event.Extensions()[source]
+	if !ok {
+		return ""
+	}
+	str, _ := types.ToString(v)
+	return str
+}
@@ -17,13 +17,14 @@ package internal
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	pkgurl "net/url"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ce "github.com/cloudevents/sdk-go/v2"
@@ -32,86 +33,265 @@ import (
 )
 
 type StreamLoad struct {
-	config       *dorisConfig
-	loadUrl      *pkgurl.URL
-	authEncoding string
+	config     *dorisConfig
+	encoder    encoder
+	database   string
+	table      string
+	fe         *frontends
+	loadPath   string
+	commitPath string
 
-	client  *http.Client
-	timeout time.Duration
+	timeout       time.Duration
+	retryInterval time.Duration
 
-	eventCh      chan *ce.Event
-	lock         sync.Mutex
-	buffer       *bytes.Buffer
+	// lock guards the buffered events, it's never held while blocking, so writing to a table
+	// or checking whether it's idle doesn't wait for loads.
+	lock    sync.Mutex
+	current *loadBatch
+	// pending is the sealed batches which are waiting for the loader in order.
+	pending []*loadBatch
+	// wake notifies the loader of a sealed batch or the stop.
+	wake         chan struct{}
+	closed       bool
 	lastLoadTime time.Time
 	loadInterval time.Duration
+	lastUsed     time.Time
+	// loading is the number of batches which are sealed and not done.
+	loading int32
+
+	metricsLock sync.Mutex
+	metrics     loadMetrics
 
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 }
 
+// loadMetrics is the stream load statistics of a table since the last report.
+type loadMetrics struct {
+	loads       int
+	failedLoads int
+	rows        int
+	bytes       int
+	duration    time.Duration
+}
+
+// loadBatch is the events loaded by a stream load, each request of Arrived belongs
+// to exactly one batch, so it's acknowledged by the result of the load.
+type loadBatch struct {
+	requests []*loadRequest
+	size     int
+	count    int
+}
+
+// loadRequest is the encoded events of an Arrived call to a table.
+type loadRequest struct {
+	load  *StreamLoad
+	data  []byte
+	count int
+	// label is derived from the events if exactly_once is set.
+	label string
+	done  chan error
+}
+
 const (
-	defaultMaxSize      = 10 * 2 << 20
-	defaultLoadSize     = defaultMaxSize - 4*2<<10
-	defaultLoadInterval = 5
-	defaultTimeout      = 30
+	defaultMaxSize       = 10 * 2 << 20
+	defaultLoadSize      = defaultMaxSize - 4*2<<10
+	defaultLoadInterval  = 5
+	defaultTimeout       = 30
+	defaultMaxRetries    = 3
+	defaultRetryInterval = 1
+	defaultLabelPrefix   = "vanus_connect_sink"
+	defaultMaxTables     = 64
+	maxRetryInterval     = 60 * time.Second
+	metricsInterval      = time.Minute
+	// maxLabelLength is the max length of a label of Doris.
+	maxLabelLength = 128
 )
 
-func NewStreamLoad(config *dorisConfig) *StreamLoad {
+// labelRegexp is the characters of a label of Doris.
+var labelRegexp = regexp.MustCompile(`^[-_A-Za-z0-9:]+$`)
+
+var errStreamLoadClosed = errors.New("stream load is closed")
+
+// invalidEventError is the error of an event which can't be loaded, so it shouldn't be retried.
+type invalidEventError struct {
+	error
+}
+
+func NewStreamLoad(config *dorisConfig, fe *frontends, encoder encoder, database, table string) *StreamLoad {
 	l := &StreamLoad{
-		config:  config,
-		eventCh: make(chan *ce.Event, 100),
+		config:   config,
+		encoder:  encoder,
+		fe:       fe,
+		database: database,
+		table:    table,
+		wake:     make(chan struct{}, 1),
 	}
 	l.ctx, l.cancel = context.WithCancel(context.Background())
 	return l
 }
 
-func (l *StreamLoad) WriteEvent(ctx context.Context, event *ce.Event) error {
+// WriteEvents appends the events to the current batch, the returned request is done when
+// the batch is loaded.
+func (l *StreamLoad) WriteEvents(events []*ce.Event) (*loadRequest, error) {
+	var data bytes.Buffer
+	for _, event := range events {
+		if err := l.encoder.encode(&data, event); err != nil {
+			return nil, invalidEventError{err}
+		}
+	}
+	req := &loadRequest{
+		load:  l,
+		data:  data.Bytes(),
+		count: len(events),
+		done:  make(chan error, 1),
+	}
+	if l.config.ExactlyOnce {
+		req.label = l.eventsLabel(events)
+	}
+	if err := l.append(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// wait waits for the result of the load. If ctx is done before the batch of the request is
+// sealed, the request is withdrawn, otherwise the batch may be committed, so its result is
+// waited for rather than reporting the events as failed.
+func (r *loadRequest) wait(ctx context.Context) error {
 	select {
-	case l.eventCh <- event:
-		return nil
+	case err := <-r.done:
+		return err
 	case <-ctx.Done():
+	}
+	if r.load.withdraw(r) {
 		return ctx.Err()
 	}
+	return <-r.done
+}
+
+func (l *StreamLoad) append(req *loadRequest) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return errStreamLoadClosed
+	}
+	l.lastUsed = time.Now()
+	if l.config.ExactlyOnce {
+		// the request is loaded alone, so its label only depends on its events.
+		l.seal()
+		l.current = &loadBatch{requests: []*loadRequest{req}, size: len(req.data), count: req.count}
+		l.seal()
+		return nil
+	}
+	if l.current == nil {
+		l.current = &loadBatch{}
+	}
+	l.current.requests = append(l.current.requests, req)
+	l.current.size += len(req.data)
+	l.current.count += req.count
+	if l.current.size >= l.config.LoadSize {
+		l.seal()
+	}
+	return nil
+}
+
+// withdraw removes the request from the current batch, it returns false if the request has
+// been sealed in a batch.
+func (l *StreamLoad) withdraw(req *loadRequest) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.current == nil {
+		return false
+	}
+	for i, r := range l.current.requests {
+		if r != req {
+			continue
+		}
+		l.current.requests = append(l.current.requests[:i], l.current.requests[i+1:]...)
+		l.current.size -= len(req.data)
+		l.current.count -= req.count
+		if len(l.current.requests) == 0 {
+			l.current = nil
+		}
+		return true
+	}
+	return false
+}
+
+// bytes returns the encoded events of the batch.
+func (b *loadBatch) bytes() []byte {
+	data := make([]byte, 0, b.size)
+	for _, req := range b.requests {
+		data = append(data, req.data...)
+	}
+	return data
 }
 
-func (l *StreamLoad) initCfg() {
-	if l.config.Timeout == 0 {
-		l.config.Timeout = defaultTimeout
+// seal queues the current batch to the loader, it must be called with the lock held.
+func (l *StreamLoad) seal() {
+	if l.current == nil {
+		return
 	}
-	if l.config.LoadInterval == 0 {
-		l.config.LoadInterval = defaultLoadInterval
+	atomic.AddInt32(&l.loading, 1)
+	l.pending = append(l.pending, l.current)
+	l.current = nil
+	l.lastLoadTime = time.Now()
+	l.notifyLoader()
+}
+
+func (l *StreamLoad) notifyLoader() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+		// the loader has been notified.
 	}
-	if l.config.LoadSize == 0 {
-		l.config.LoadSize = defaultLoadSize
+}
+
+// next waits for the next sealed batch, it returns false if the stream load is stopped and
+// all the batches are loaded.
+func (l *StreamLoad) next() (*loadBatch, bool) {
+	for {
+		l.lock.Lock()
+		if len(l.pending) > 0 {
+			batch := l.pending[0]
+			l.pending[0] = nil
+			l.pending = l.pending[1:]
+			l.lock.Unlock()
+			return batch, true
+		}
+		closed := l.closed
+		l.lock.Unlock()
+		if closed {
+			return nil, false
+		}
+		<-l.wake
 	}
 }
+
 func (l *StreamLoad) Start() error {
-	l.initCfg()
 	l.timeout = time.Second * time.Duration(l.config.Timeout)
 	l.loadInterval = time.Second * time.Duration(l.config.LoadInterval)
-	l.buffer = bytes.NewBuffer(make([]byte, 0, l.config.LoadSize+4*2<<10))
+	l.retryInterval = time.Second * time.Duration(l.config.RetryInterval)
 
-	loadUrlStr := fmt.Sprintf("http://%s/api/%s/%s/_stream_load", l.config.Secret.Fenodes, l.config.Secret.DbName, l.config.Secret.TableName)
-	u, err := pkgurl.Parse(loadUrlStr)
-	if err != nil {
-		return err
-	}
-	l.loadUrl = u
-	l.authEncoding = base64.StdEncoding.EncodeToString([]byte(l.config.Secret.Username + ":" + l.config.Secret.Password))
+	l.loadPath = fmt.Sprintf("/api/%s/%s/_stream_load", pkgurl.PathEscape(l.database), pkgurl.PathEscape(l.table))
+	l.commitPath = fmt.Sprintf("/api/%s/_stream_load_2pc", pkgurl.PathEscape(l.database))
 	l.lastLoadTime = time.Now()
-	l.client = &http.Client{
-		Timeout: l.timeout,
-	}
+	l.lastUsed = time.Now()
 	l.wg.Add(1)
 	go func() {
 		defer l.wg.Done()
 		t := time.NewTicker(time.Second)
 		defer t.Stop()
+		m := time.NewTicker(metricsInterval)
+		defer m.Stop()
 		for {
 			select {
 			case <-t.C:
-				l.checkAndLoad(false)
+				l.checkAndSeal()
+			case <-m.C:
+				l.reportMetrics()
 			case <-l.ctx.Done():
 				return
 			}
@@ -121,105 +301,259 @@ func (l *StreamLoad) Start() error {
 	go func() {
 		defer l.wg.Done()
 		for {
-			select {
-			case event, ok := <-l.eventCh:
-				if !ok {
-					return
-				}
-				l.event2Buffer(event)
+			batch, ok := l.next()
+			if !ok {
+				return
 			}
+			l.loadBatch(batch)
 		}
 	}()
 	return nil
 }
 
+// Stop loads all the buffered events before it returns.
 func (l *StreamLoad) Stop() {
 	l.cancel()
-	close(l.eventCh)
+	l.lock.Lock()
+	l.closed = true
+	l.seal()
+	l.lock.Unlock()
+	l.notifyLoader()
 	l.wg.Wait()
-	l.checkAndLoad(true)
+	l.reportMetrics()
+}
+
+// Idle reports whether the table has no buffered events and isn't written since the time.
+func (l *StreamLoad) Idle(since time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.current == nil && atomic.LoadInt32(&l.loading) == 0 && l.lastUsed.Before(since)
 }
-func (l *StreamLoad) event2Buffer(event *ce.Event) {
+
+func (l *StreamLoad) lastUsedTime() time.Time {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	json.Compact(l.buffer, event.Data())
-	l.buffer.WriteString("\n")
-	if l.buffer.Len() >= l.config.LoadSize {
-		l.loadAndReset()
+	return l.lastUsed
+}
+
+func (l *StreamLoad) reportMetrics() {
+	l.metricsLock.Lock()
+	m := l.metrics
+	l.metrics = loadMetrics{}
+	l.metricsLock.Unlock()
+	if m.loads == 0 && m.failedLoads == 0 {
+		return
+	}
+	var avg time.Duration
+	if m.loads > 0 {
+		avg = m.duration / time.Duration(m.loads)
+	}
+	log.Info("stream load metrics", map[string]interface{}{
+		"database":     l.database,
+		"table":        l.table,
+		"loads":        m.loads,
+		"failed_loads": m.failedLoads,
+		"rows":         m.rows,
+		"bytes":        m.bytes,
+		"avg_latency":  avg,
+	})
+}
+
+func (l *StreamLoad) record(batch *loadBatch, duration time.Duration, err error) {
+	l.metricsLock.Lock()
+	defer l.metricsLock.Unlock()
+	if err != nil {
+		l.metrics.failedLoads++
+		return
 	}
+	l.metrics.loads++
+	l.metrics.rows += batch.count
+	l.metrics.bytes += batch.size
+	l.metrics.duration += duration
 }
 
-func (l *StreamLoad) checkAndLoad(force bool) {
+func (l *StreamLoad) checkAndSeal() {
 	l.lock.Lock()
 	defer l.lock.Unlock()
-	size := l.buffer.Len()
-	if size == 0 {
+	if l.current == nil {
 		return
 	}
-	if !force && time.Now().Sub(l.lastLoadTime) < l.loadInterval {
+	if time.Now().Sub(l.lastLoadTime) < l.loadInterval {
 		return
 	}
-	l.loadAndReset()
+	l.seal()
 }
 
-func (l *StreamLoad) loadAndReset() {
-	err := l.load()
+// loadBatch loads the batch with bounded retries and notifies the requests of the result.
+func (l *StreamLoad) loadBatch(batch *loadBatch) {
+	data, err := l.body(batch)
 	if err != nil {
-		log.Warning("stream load has error,will retry", map[string]interface{}{
+		l.notify(batch, errors.Wrap(err, "compress stream load body error"))
+		return
+	}
+	var attempt int
+	start := time.Now()
+	for ; ; attempt++ {
+		label := batch.requests[0].label
+		if label == "" {
+			label = l.timeLabel()
+		}
+		err = l.load(label, data)
+		if err == nil || attempt >= *l.config.MaxRetries {
+			break
+		}
+		backoff := l.retryInterval << attempt
+		if backoff > maxRetryInterval {
+			backoff = maxRetryInterval
+		}
+		log.Warning("stream load has error, will retry", map[string]interface{}{
 			log.KeyError: err,
+			"table":      l.table,
+			"attempt":    attempt + 1,
+			"backoff":    backoff,
 		})
-		return
+		if !l.sleep(backoff) {
+			// the sink is stopping, the events are redelivered rather than blocking the stop.
+			break
+		}
 	}
-	l.buffer.Reset()
-	l.lastLoadTime = time.Now()
+	l.record(batch, time.Since(start), err)
+	if err != nil {
+		log.Warning("stream load failed", map[string]interface{}{
+			log.KeyError: err,
+			"database":   l.database,
+			"table":      l.table,
+			"count":      batch.count,
+		})
+		err = errors.Wrapf(err, "stream load failed after %d attempts", attempt+1)
+	}
+	l.notify(batch, err)
+}
+
+// sleep waits for the duration, it returns false if the stream load is stopped.
+func (l *StreamLoad) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-l.ctx.Done():
+		return false
+	}
+}
+
+func (l *StreamLoad) notify(batch *loadBatch, err error) {
+	for _, req := range batch.requests {
+		req.done <- err
+	}
+	atomic.AddInt32(&l.loading, -1)
+}
+
+// timeLabel is a new label of each load attempt. The table is omitted if it has characters
+// which aren't allowed in labels or makes the label too long, a hash of it is used instead.
+func (l *StreamLoad) timeLabel() string {
+	label := fmt.Sprintf("%s_%s_%d", l.config.LabelPrefix, l.table, time.Now().UnixMilli())
+	if len(label) <= maxLabelLength && labelRegexp.MatchString(label) {
+		return label
+	}
+	h := sha256.Sum256([]byte(l.table))
+	return fmt.Sprintf("%s_%x_%d", l.config.LabelPrefix, h[:8], time.Now().UnixMilli())
+}
+
+// eventsLabel derives the label from the database, the table and the ids of the events, so
+// the same events of a request get the same label however many times they are loaded or
+// redelivered. Event ids may contain characters which aren't allowed in labels and are
+// unbounded, hence they are hashed, which keeps the label within 97 characters.
+func (l *StreamLoad) eventsLabel(events []*ce.Event) string {
+	h := sha256.New()
+	_, _ = h.Write([]byte(l.database))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(l.table))
+	for _, event := range events {
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(event.ID()))
+	}
+	return fmt.Sprintf("%s_%x", l.config.LabelPrefix, h.Sum(nil)[:16])
 }
 
-func (l *StreamLoad) load() error {
-	label := fmt.Sprintf("vanus_connect_sink_%s_%d", l.config.Secret.TableName, time.Now().UnixMilli())
-	ctx, cancel := context.WithTimeout(l.ctx, l.timeout)
+type loadResult struct {
+	TxnId             int64  `json:"TxnId"`
+	Label             string `json:"Label"`
+	Status            string `json:"Status"`
+	ExistingJobStatus string `json:"ExistingJobStatus"`
+	Message           string `json:"Message"`
+}
+
+func (l *StreamLoad) load(label string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
 	defer cancel()
-	req := l.makeRequest(label)
-	req = req.WithContext(ctx)
-	resp, err := l.client.Do(req)
+	node := l.fe.pick()
+	req, err := l.makeRequest(ctx, l.fe.url(node, l.loadPath), label, data)
 	if err != nil {
+		return err
+	}
+	resp, err := l.fe.client.Do(req)
+	if err != nil {
+		l.fe.markDown(node, err)
 		return errors.Wrapf(err, "%s load client do error", label)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("%s load response not ok", label)
 	}
-	var res map[string]interface{}
+	var res loadResult
 	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
 		return errors.Wrapf(err, "%s resp body json decode error", label)
 	}
-	status := res["Status"]
-	if status != "Success" && status != "Publish Timeout" {
-		return fmt.Errorf("%s resp status is %s not success", label, status)
+	switch res.Status {
+	case "Success", "Publish Timeout":
+	case "Label Already Exists":
+		// the events have been loaded by a previous attempt.
+		switch res.ExistingJobStatus {
+		case "FINISHED", "VISIBLE", "COMMITTED":
+			log.Info(fmt.Sprintf("label %s already loaded", label), nil)
+			return nil
+		case "PRECOMMITTED":
+			if l.config.TwoPhaseCommit {
+				return l.commitLabel(label)
+			}
+		}
+		return fmt.Errorf("%s label already exists, existing job status is %s", label, res.ExistingJobStatus)
+	default:
+		if l.config.TwoPhaseCommit && res.TxnId != 0 {
+			l.abort(label, res.TxnId)
+		}
+		return fmt.Errorf("%s resp status is %s not success, message: %s", label, res.Status, res.Message)
+	}
+	if l.config.TwoPhaseCommit {
+		if err = l.commit(label, res.TxnId); err != nil {
+			l.abort(label, res.TxnId)
+			return err
+		}
 	}
 	log.Debug(fmt.Sprintf("load success %s", label), nil)
 	return nil
 }
 
-func (l *StreamLoad) makeRequest(label string) *http.Request {
-	buf := l.buffer.Bytes()
-	req := &http.Request{
-		Method:        http.MethodPut,
-		URL:           l.loadUrl,
-		Header:        make(http.Header),
-		ContentLength: int64(l.buffer.Len()),
-		Body:          io.NopCloser(l.buffer),
-		GetBody: func() (io.ReadCloser, error) {
-			r := bytes.NewReader(buf)
-			return io.NopCloser(r), nil
-		},
+func (l *StreamLoad) makeRequest(ctx context.Context, url, label string, data []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
 	}
 	for k, v := range l.config.StreamLoad {
 		req.Header.Set(k, v)
 	}
 	req.Header.Set("Expect", "100-continue")
-	req.Header.Set("Authorization", "Basic "+l.authEncoding)
-	req.Header.Set("format", "json")
-	req.Header.Set("read_json_by_line", "true")
+	l.fe.setAuth(req)
+	l.encoder.setHeaders(req.Header)
+	l.setCompressionHeader(req.Header)
+	if l.config.Flavor == FlavorStarRocks && l.config.Format == FormatJSON {
+		req.Header.Set("strip_outer_array", "true")
+		req.Header.Del("read_json_by_line")
+	}
 	req.Header.Set("label", label)
-	return req
+	if l.config.TwoPhaseCommit {
+		req.Header.Set("two_phase_commit", "true")
+	}
+	return req, nil
 }
@@ -0,0 +1,83 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/vanus-labs/cdk-go/log"
+)
+
+const (
+	txnCommit = "commit"
+	txnAbort  = "abort"
+)
+
+func (l *StreamLoad) commit(label string, txnId int64) error {
+	return l.txnOperation(label, "txn_id", strconv.FormatInt(txnId, 10), txnCommit)
+}
+
+// commitLabel commits a pre-committed load of a previous attempt, whose txn id is unknown.
+func (l *StreamLoad) commitLabel(label string) error {
+	return l.txnOperation(label, "label", label, txnCommit)
+}
+
+func (l *StreamLoad) abort(label string, txnId int64) {
+	err := l.txnOperation(label, "txn_id", strconv.FormatInt(txnId, 10), txnAbort)
+	if err != nil {
+		log.Warning("stream load abort failed", map[string]interface{}{
+			log.KeyError: err,
+			"label":      label,
+		})
+	}
+}
+
+func (l *StreamLoad) txnOperation(label, key, value, operation string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	node := l.fe.pick()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, l.fe.url(node, l.commitPath), http.NoBody)
+	if err != nil {
+		return err
+	}
+	l.fe.setAuth(req)
+	req.Header.Set(key, value)
+	req.Header.Set("txn_operation", operation)
+	resp, err := l.fe.client.Do(req)
+	if err != nil {
+		l.fe.markDown(node, err)
+		return errors.Wrapf(err, "%s %s client do error", label, operation)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s response not ok", label, operation)
+	}
+	var res struct {
+		Status string `json:"status"`
+		Msg    string `json:"msg"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return errors.Wrapf(err, "%s %s resp body json decode error", label, operation)
+	}
+	if res.Status != "Success" {
+		return fmt.Errorf("%s %s status is %s, message: %s", label, operation, res.Status, res.Msg)
+	}
+	return nil
+}
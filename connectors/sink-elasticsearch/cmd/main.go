@@ -16,7 +16,7 @@ package main
 
 import (
 	cdkgo "github.com/vanus-labs/cdk-go"
-	"github.com/vanus-labs/sink-elasticsearch/internal"
+	"github.com/vanus-labs/connector/sink/elasticsearch/internal"
 )
 
 func main() {
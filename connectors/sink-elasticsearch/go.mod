@@ -1,4 +1,4 @@
-module github.com/vanus-labs/sink-elasticsearch
+module github.com/vanus-labs/connector/sink/elasticsearch
 
 go 1.18
 
@@ -8,8 +8,11 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/tidwall/gjson v1.14.0
 	github.com/vanus-labs/cdk-go v0.5.0
+	github.com/vanus-labs/connector/internal v0.0.0
 )
 
+replace github.com/vanus-labs/connector/internal v0.0.0 => ../internal
+
 require (
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd/v22 v22.3.2 // indirect
@@ -15,8 +15,13 @@
 package internal
 
 import (
-	"github.com/pkg/errors"
 	"strconv"
+	"strings"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/pkg/errors"
+
+	"github.com/vanus-labs/connector/internal/placeholder"
 )
 
 const (
@@ -24,6 +29,9 @@ const (
 	attributeOp     = attributePrefix + "op"
 	attributeIndex  = attributePrefix + "indexname"
 	attributeId     = attributePrefix + "id"
+	// attributes of the bulk request parameters
+	attributePipeline = attributePrefix + "pipeline"
+	attributeRouting  = attributePrefix + "routing"
 )
 
 func getAttr(extensions map[string]interface{}, key string) (string, error) {
@@ -42,6 +50,7 @@ type action string
 
 const (
 	actionIndex  action = "index"
+	actionCreate action = "create"
 	actionUpdate action = "update"
 	actionDelete action = "delete"
 )
@@ -61,6 +70,12 @@ func (s *elasticsearchSink) getAction(extensions map[string]interface{}) (action
 	switch op {
 	case "c":
 		return s.action, nil
+	case "u", "d":
+		if s.config.DataStream {
+			return "", errors.Errorf("data stream doesn't support attribute value %s=%s", attributeOp, op)
+		}
+	}
+	switch op {
 	case "u":
 		return actionUpdate, nil
 	case "d":
@@ -70,10 +85,17 @@ func (s *elasticsearchSink) getAction(extensions map[string]interface{}) (action
 	}
 }
 
-func (s *elasticsearchSink) getDocumentId(extensions map[string]interface{}) (string, error) {
-	val, exist := extensions[attributeId]
+func (s *elasticsearchSink) getDocumentId(event *ce.Event) (string, error) {
+	val, exist := event.Extensions()[attributeId]
 	if !exist {
-		return "", nil
+		if s.primaryKey.Type() == None {
+			return "", nil
+		}
+		id := s.primaryKey.Value(event)
+		if id == "" {
+			return "", errors.Errorf("primary key %s of event %s is empty", s.primaryKey.Name(), event.ID())
+		}
+		return id, nil
 	}
 	str, ok := val.(string)
 	if ok {
@@ -86,17 +108,39 @@ func (s *elasticsearchSink) getDocumentId(extensions map[string]interface{}) (st
 	return "", errors.Errorf("invalid attribute %s=%v", attributeId, val)
 }
 
-func (s *elasticsearchSink) getIndexName(extensions map[string]interface{}) (string, error) {
-	if len(extensions) == 0 {
-		return s.config.Secret.IndexName, nil
+func (s *elasticsearchSink) getIndexName(event *ce.Event) (string, error) {
+	tpl, err := getOptionalAttr(event.Extensions(), attributeIndex, s.config.Secret.IndexName)
+	if err != nil {
+		return "", err
 	}
-	val, exist := extensions[attributeIndex]
+	index, err := placeholder.Expand(tpl, event, s.location)
+	if err != nil {
+		return "", err
+	}
+	// index names must be lowercase.
+	return strings.ToLower(index), nil
+}
+
+func (s *elasticsearchSink) getPipeline(event *ce.Event) (string, error) {
+	return getOptionalAttr(event.Extensions(), attributePipeline, s.config.Pipeline)
+}
+
+func (s *elasticsearchSink) getRouting(event *ce.Event) (string, error) {
+	tpl, err := getOptionalAttr(event.Extensions(), attributeRouting, s.config.Routing)
+	if err != nil {
+		return "", err
+	}
+	return placeholder.Expand(tpl, event, s.location)
+}
+
+func getOptionalAttr(extensions map[string]interface{}, key, defaultValue string) (string, error) {
+	val, exist := extensions[key]
 	if !exist {
-		return s.config.Secret.IndexName, nil
+		return defaultValue, nil
 	}
 	str, ok := val.(string)
 	if !ok {
-		return "", errors.Errorf("invalid attribute %s=%v", attributeIndex, val)
+		return "", errors.Errorf("invalid attribute %s=%v", key, val)
 	}
 	return str, nil
 }
@@ -0,0 +1,437 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/cdk-go/log"
+	"github.com/vanus-labs/connector/internal/placeholder"
+)
+
+const maxRetryBackoff = 5 * time.Second
+
+// bulkItem is an operation of the bulk api built from an event.
+type bulkItem struct {
+	event      *ce.Event
+	index      string
+	action     action
+	documentId string
+	docType    string
+	pipeline   string
+	routing    string
+	// version is the external version of the document if versioned is true.
+	version     int64
+	versionType VersionType
+	versioned   bool
+	// updateBody is the body of the update action, it's the partial document if it's nil.
+	updateBody []byte
+	// payload is the encoded action and source lines.
+	payload []byte
+	// done is called when the item succeeds or fails finally.
+	done     func()
+	attempts int
+	// canceled is set when the event is given up, the item isn't sent if it's still queued.
+	canceled int32
+	// the status and error of the last attempt, rejected means the error is
+	// reported for the item rather than for the whole request.
+	status      int
+	errorType   string
+	errorReason string
+	rejected    bool
+}
+
+// isRetryable reports whether the failure of the item is transient, such as the
+// cluster is overloaded, and it is worth to send the item again.
+func (i *bulkItem) isRetryable() bool {
+	switch i.status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func (i *bulkItem) cancel() {
+	atomic.StoreInt32(&i.canceled, 1)
+}
+
+func (i *bulkItem) isCanceled() bool {
+	return atomic.LoadInt32(&i.canceled) == 1
+}
+
+func (i *bulkItem) isSuccess() bool {
+	if i.status >= 200 && i.status < 300 {
+		return true
+	}
+	// the document has already been deleted.
+	if i.action == actionDelete && i.status == http.StatusNotFound {
+		return true
+	}
+	// the document has a newer version, the event is out of date.
+	return i.versioned && i.status == http.StatusConflict
+}
+
+func (i *bulkItem) setResult(status int, errorType, errorReason string, rejected bool) {
+	i.status = status
+	i.errorType = errorType
+	i.errorReason = errorReason
+	i.rejected = rejected
+}
+
+func (i *bulkItem) encode() {
+	var buf bytes.Buffer
+	i.writeTo(&buf)
+	i.payload = buf.Bytes()
+}
+
+// https://www.elastic.co/guide/en/elasticsearch/reference/master/docs-bulk.html
+func (i *bulkItem) writeTo(buf *bytes.Buffer) {
+	buf.WriteRune('{')
+	buf.WriteString(strconv.Quote(string(i.action)))
+	buf.WriteRune(':')
+	buf.WriteRune('{')
+	buf.WriteString(`"_index":`)
+	buf.WriteString(strconv.Quote(i.index))
+	if i.documentId != "" {
+		buf.WriteRune(',')
+		buf.WriteString(`"_id":`)
+		buf.WriteString(strconv.Quote(i.documentId))
+	}
+	if i.docType != "" {
+		buf.WriteString(`,"_type":`)
+		buf.WriteString(strconv.Quote(i.docType))
+	}
+	if i.pipeline != "" && i.action != actionDelete {
+		buf.WriteString(`,"pipeline":`)
+		buf.WriteString(strconv.Quote(i.pipeline))
+	}
+	if i.routing != "" {
+		buf.WriteString(`,"routing":`)
+		buf.WriteString(strconv.Quote(i.routing))
+	}
+	if i.versioned {
+		buf.WriteString(`,"version":`)
+		buf.WriteString(strconv.FormatInt(i.version, 10))
+		buf.WriteString(`,"version_type":`)
+		buf.WriteString(strconv.Quote(string(i.versionType)))
+	}
+	buf.WriteRune('}')
+	buf.WriteRune('}')
+	buf.WriteRune('\n')
+	if i.action == actionDelete {
+		return
+	}
+	if i.action == actionIndex {
+		_ = json.Compact(buf, i.event.Data())
+	} else if i.action == actionCreate {
+		writeWithTimestamp(buf, i.event)
+	} else if i.action == actionUpdate && i.updateBody != nil {
+		buf.Write(i.updateBody)
+	} else if i.action == actionUpdate {
+		buf.WriteRune('{')
+		buf.WriteString(`"doc":`)
+		_ = json.Compact(buf, i.event.Data())
+		buf.WriteRune(',')
+		buf.WriteString(`"doc_as_upsert":true`)
+		buf.WriteRune('}')
+	}
+	buf.WriteRune('\n')
+}
+
+// writeWithTimestamp writes the event data and adds the @timestamp field required by data
+// streams from the event time if the data doesn't have it.
+func writeWithTimestamp(buf *bytes.Buffer, event *ce.Event) {
+	var compact bytes.Buffer
+	_ = json.Compact(&compact, event.Data())
+	data := compact.Bytes()
+	if len(data) < 2 || data[0] != '{' || gjson.GetBytes(data, `\@timestamp`).Exists() {
+		buf.Write(data)
+		return
+	}
+	buf.WriteString(`{"@timestamp":`)
+	buf.WriteString(strconv.Quote(placeholder.EventTime(event).UTC().Format(time.RFC3339Nano)))
+	if len(data) > 2 {
+		buf.WriteRune(',')
+	}
+	buf.Write(data[1:])
+}
+
+func (s *elasticsearchSink) newBulkItem(event *ce.Event) (*bulkItem, error) {
+	extensions := event.Extensions()
+	index, err := s.getIndexName(event)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := s.getPipeline(event)
+	if err != nil {
+		return nil, err
+	}
+	routing, err := s.getRouting(event)
+	if err != nil {
+		return nil, err
+	}
+	actionName, err := s.getAction(extensions)
+	if err != nil {
+		return nil, err
+	}
+	documentId, err := s.getDocumentId(event)
+	if err != nil {
+		return nil, err
+	}
+	if documentId == "" {
+		if actionName == actionUpdate || actionName == actionDelete {
+			return nil, errors.Errorf("action is %s but documentId is empty", actionName)
+		}
+	}
+	if actionName != actionDelete && !json.Valid(event.Data()) {
+		return nil, errors.Errorf("event %s data is not a valid json", event.ID())
+	}
+	item := &bulkItem{
+		event:      event,
+		index:      index,
+		action:     actionName,
+		documentId: documentId,
+		pipeline:   pipeline,
+		routing:    routing,
+	}
+	if s.esClient.requiresType() {
+		item.docType = "_doc"
+	}
+	if s.config.DocumentVersion.enabled() && actionName != actionCreate {
+		// the update api doesn't support external versions, and the partial document can't be
+		// indexed as the whole document, which loses the other fields.
+		if actionName == actionUpdate {
+			return nil, errors.Errorf("event %s: update action doesn't support document_version", event.ID())
+		}
+		if item.version, err = s.getVersion(event); err != nil {
+			return nil, err
+		}
+		item.versioned = true
+		item.versionType = s.config.DocumentVersion.versionType()
+	}
+	if item.action == actionUpdate && s.config.Script.enabled() {
+		if item.updateBody, err = s.scriptBody(event); err != nil {
+			return nil, err
+		}
+	}
+	item.encode()
+	return item, nil
+}
+
+// writeItems adds the items to the bulk indexer and waits for their results, the items
+// failed permanently are written to the dead letter index if it's configured. If ctx is done,
+// the queued items are dropped, and the items being sent are waited for, so an event reported
+// as failed is never written later.
+func (s *elasticsearchSink) writeItems(ctx context.Context, items []*bulkItem) cdkgo.Result {
+	var wg sync.WaitGroup
+	for idx, item := range items {
+		wg.Add(1)
+		item.done = wg.Done
+		if err := s.indexer.add(ctx, item); err != nil {
+			wg.Done()
+			for _, added := range items[:idx] {
+				added.cancel()
+			}
+			wg.Wait()
+			if err == errIndexerClosed {
+				return cdkgo.NewResult(http.StatusServiceUnavailable, err.Error())
+			}
+			return cdkgo.NewResult(http.StatusInternalServerError,
+				fmt.Sprintf("write to es canceled: %s", err.Error()))
+		}
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-ctx.Done():
+		for _, item := range items {
+			item.cancel()
+		}
+		<-finished
+	case <-finished:
+	}
+	var canceled, retryable, rejected, failed []*bulkItem
+	for _, item := range items {
+		switch {
+		case item.isSuccess():
+		case item.isCanceled():
+			canceled = append(canceled, item)
+		case item.isRetryable():
+			retryable = append(retryable, item)
+		case item.rejected:
+			rejected = append(rejected, item)
+		default:
+			failed = append(failed, item)
+		}
+	}
+	if len(canceled) > 0 {
+		return cdkgo.NewResult(http.StatusInternalServerError,
+			fmt.Sprintf("write to es canceled, events: %s", eventIds(canceled)))
+	}
+	if len(retryable) > 0 {
+		return cdkgo.NewResult(http.StatusServiceUnavailable,
+			fmt.Sprintf("write to es failed after %d retries, events: %s", s.maxRetries, eventIds(retryable)))
+	}
+	if len(failed) > 0 {
+		return cdkgo.NewResult(http.StatusInternalServerError,
+			fmt.Sprintf("write to es error, events: %s", eventIds(failed)))
+	}
+	if len(rejected) == 0 {
+		return cdkgo.SuccessResult
+	}
+	for _, item := range rejected {
+		log.Warning("event write to es failed", map[string]interface{}{
+			"id":          item.event.ID(),
+			"index":       item.index,
+			"action":      item.action,
+			"status":      item.status,
+			"errorType":   item.errorType,
+			"errorReason": item.errorReason,
+		})
+	}
+	if s.config.DeadLetterIndex != "" {
+		err := s.writeDeadLetters(ctx, rejected)
+		if err == nil {
+			return cdkgo.SuccessResult
+		}
+		log.Warning("write to dead letter index failed", map[string]interface{}{
+			log.KeyError: err,
+			"index":      s.config.DeadLetterIndex,
+		})
+	}
+	return cdkgo.NewResult(http.StatusBadRequest,
+		fmt.Sprintf("write to es failed, events: %s", eventIds(rejected)))
+}
+
+func (s *elasticsearchSink) retryBackoff(attempt int) time.Duration {
+	backoff := time.Duration(s.config.RetryBackoff) * time.Millisecond << attempt
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+// bulk sends the items and records the result of each item, if the whole request
+// failed, the items get the status of the response.
+func (s *elasticsearchSink) bulk(ctx context.Context, body *bytes.Buffer, items []*bulkItem) error {
+	timeoutCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	req := esapi.BulkRequest{
+		Body: body,
+	}
+	res, err := req.Do(timeoutCtx, s.esClient)
+	if err != nil {
+		setItemsResult(items, http.StatusServiceUnavailable, "request_error", err.Error())
+		return errors.Wrap(err, "es bulk do error")
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		setItemsResult(items, res.StatusCode, "response_error", res.String())
+		return errors.Errorf("es bulk response error: %s", res.String())
+	}
+	var blk esutil.BulkIndexerResponse
+	if err = json.NewDecoder(res.Body).Decode(&blk); err != nil {
+		setItemsResult(items, http.StatusInternalServerError, "parse_error", err.Error())
+		return errors.Wrap(err, "parse response error")
+	}
+	if len(blk.Items) != len(items) {
+		setItemsResult(items, http.StatusInternalServerError, "response_error", "mismatched bulk items")
+		return errors.Errorf("es bulk response has %d items, expected %d", len(blk.Items), len(items))
+	}
+	for i, blkItem := range blk.Items {
+		// each item has exactly one action as the key.
+		for _, v := range blkItem {
+			items[i].setResult(v.Status, v.Error.Type, v.Error.Reason, true)
+		}
+	}
+	return nil
+}
+
+// setItemsResult records the failure of the whole request to the items.
+func setItemsResult(items []*bulkItem, status int, errorType, errorReason string) {
+	for _, item := range items {
+		item.setResult(status, errorType, errorReason, false)
+	}
+}
+
+// writeDeadLetters indexes the failed items with their errors to the dead letter index.
+func (s *elasticsearchSink) writeDeadLetters(ctx context.Context, items []*bulkItem) error {
+	var body bytes.Buffer
+	letters := make([]*bulkItem, len(items))
+	for i, item := range items {
+		doc := map[string]interface{}{
+			"@timestamp":   time.Now().UTC().Format(time.RFC3339Nano),
+			"event_id":     item.event.ID(),
+			"event_source": item.event.Source(),
+			"event_type":   item.event.Type(),
+			"index":        item.index,
+			"action":       item.action,
+			"document_id":  item.documentId,
+			"status":       item.status,
+			"error_type":   item.errorType,
+			"error_reason": item.errorReason,
+			"data":         string(item.event.Data()),
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		e := ce.NewEvent()
+		e.SetID(item.event.ID())
+		e.DataEncoded = data
+		letters[i] = &bulkItem{
+			event:  &e,
+			index:  s.config.DeadLetterIndex,
+			action: actionIndex,
+		}
+		letters[i].writeTo(&body)
+	}
+	if err := s.bulk(ctx, &body, letters); err != nil {
+		return err
+	}
+	for _, letter := range letters {
+		if !letter.isSuccess() {
+			return errors.Errorf("event %s: %s %s", letter.event.ID(), letter.errorType, letter.errorReason)
+		}
+	}
+	return nil
+}
+
+func eventIds(items []*bulkItem) string {
+	ids := make([]string, len(items))
+	for i, item := range items {
+		ids[i] = item.event.ID()
+	}
+	return strings.Join(ids, ",")
+}
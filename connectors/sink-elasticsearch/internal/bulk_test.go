@@ -0,0 +1,76 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBulkItemWithVersion(t *testing.T) {
+	s := &elasticsearchSink{
+		config: &esConfig{
+			Secret:          Secret{IndexName: "orders"},
+			DocumentVersion: VersionConfig{Path: "ts_ms"},
+		},
+		action:     actionIndex,
+		primaryKey: none{},
+		esClient:   &esClient{flavor: FlavorElasticsearch, major: 8},
+		location:   time.UTC,
+	}
+	cases := []struct {
+		name    string
+		op      string
+		want    string
+		wantErr bool
+	}{
+		{name: "index", op: "c",
+			want: `{"index":{"_index":"orders","_id":"1","version":7,"version_type":"external"}}` + "\n" +
+				`{"ts_ms":7,"name":"a"}` + "\n"},
+		{name: "delete", op: "d",
+			want: `{"delete":{"_index":"orders","_id":"1","version":7,"version_type":"external"}}` + "\n"},
+		{name: "update", op: "u", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e := newTestEvent("e1", "1", `{"ts_ms":7,"name":"a"}`)
+			e.SetExtension(attributeOp, c.op)
+			item, err := s.newBulkItem(e)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %s", item.payload)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(item.payload) != c.want {
+				t.Fatalf("got %s, want %s", item.payload, c.want)
+			}
+		})
+	}
+}
+
+func TestConfigRejectsUpsertWithVersion(t *testing.T) {
+	cfg := &esConfig{
+		InsertMode:      Upsert,
+		DocumentVersion: VersionConfig{Path: "ts_ms"},
+		Secret:          Secret{Address: "http://localhost:9200", IndexName: "orders"},
+	}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("want error for insert_mode upsert with document_version")
+	}
+}
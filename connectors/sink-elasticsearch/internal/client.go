@@ -0,0 +1,239 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-elasticsearch/v7/estransport"
+	"github.com/pkg/errors"
+
+	"github.com/vanus-labs/cdk-go/log"
+)
+
+type Flavor string
+
+const (
+	FlavorElasticsearch Flavor = "elasticsearch"
+	FlavorOpenSearch    Flavor = "opensearch"
+)
+
+// esClient sends requests to an Elasticsearch or OpenSearch cluster. It uses the transport
+// rather than the Elasticsearch client, which refuses to work with servers other than
+// Elasticsearch, and keeps the server flavor and version to choose the request semantics.
+type esClient struct {
+	esapi.Transport
+	flavor Flavor
+	major  int
+	minor  int
+	// compatible sends the requests in the compatibility mode of Elasticsearch 8, which
+	// accepts the requests and returns the responses of the 7.x api.
+	compatible bool
+}
+
+const compatibleWith7 = "application/vnd.elasticsearch+json;compatible-with=7"
+
+func newClient(cfg *esConfig) (*esClient, error) {
+	urls, err := serverURLs(&cfg.Secret)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newHTTPTransport(&cfg.Secret)
+	if err != nil {
+		return nil, err
+	}
+	tp, err := estransport.New(estransport.Config{
+		URLs:                   urls,
+		Username:               cfg.Secret.Username,
+		Password:               cfg.Secret.Password,
+		APIKey:                 cfg.Secret.APIKey,
+		CertificateFingerprint: cfg.Secret.CertificateFingerprint,
+		// the indexer retries the failed items with backoff, so that the retries of a bulk
+		// request aren't multiplied by the transport.
+		DisableRetry: true,
+		Transport:    transport,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "new es transport error")
+	}
+	c := &esClient{Transport: tp}
+	if cfg.Flavor != "" && cfg.Version != "" {
+		c.flavor = cfg.Flavor
+		c.major, c.minor, err = parseVersion(cfg.Version)
+		if err != nil {
+			return nil, err
+		}
+	} else if err = c.detect(cfg.Flavor); err != nil {
+		return nil, err
+	}
+	c.compatible = c.flavor == FlavorElasticsearch && c.major >= 8
+	return c, nil
+}
+
+func (c *esClient) Perform(req *http.Request) (*http.Response, error) {
+	if c.compatible {
+		if req.Body != nil {
+			req.Header.Set("Content-Type", compatibleWith7)
+		}
+		req.Header.Set("Accept", compatibleWith7)
+	}
+	return c.Transport.Perform(req)
+}
+
+// detect gets the flavor and version from the info api, the configured flavor takes precedence.
+func (c *esClient) detect(flavor Flavor) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := esapi.InfoRequest{}.Do(ctx, c)
+	if err != nil {
+		return errors.Wrap(err, "es info api error")
+	}
+	defer resp.Body.Close()
+	if resp.IsError() {
+		return errors.Errorf("es info api response error: %s", resp.String())
+	}
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return errors.Wrap(err, "parse info response error")
+	}
+	c.major, c.minor, err = parseVersion(info.Version.Number)
+	if err != nil {
+		return err
+	}
+	switch {
+	case flavor != "":
+		c.flavor = flavor
+	case info.Version.Distribution == string(FlavorOpenSearch):
+		c.flavor = FlavorOpenSearch
+	default:
+		c.flavor = FlavorElasticsearch
+	}
+	log.Info("es connect success", map[string]interface{}{
+		"flavor":  c.flavor,
+		"version": info.Version.Number,
+	})
+	return nil
+}
+
+// requiresType reports whether the bulk api requires the _type of documents, which is
+// removed since Elasticsearch 7.
+func (c *esClient) requiresType() bool {
+	return c.flavor == FlavorElasticsearch && c.major < 7
+}
+
+// supportsDataStream reports whether the server has data streams, which are added in
+// Elasticsearch 7.9 and OpenSearch 1.0.
+func (c *esClient) supportsDataStream() bool {
+	if c.flavor == FlavorOpenSearch {
+		return c.major >= 1
+	}
+	return c.major > 7 || (c.major == 7 && c.minor >= 9)
+}
+
+func parseVersion(version string) (int, int, error) {
+	parts := strings.SplitN(version, ".", 3)
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, errors.Errorf("invalid version %s", version)
+	}
+	minor := 0
+	if len(parts) > 1 {
+		if minor, err = strconv.Atoi(parts[1]); err != nil {
+			return 0, 0, errors.Errorf("invalid version %s", version)
+		}
+	}
+	return major, minor, nil
+}
+
+func serverURLs(secret *Secret) ([]*url.URL, error) {
+	var addrs []string
+	if secret.CloudID != "" {
+		addr, err := addrFromCloudID(secret.CloudID)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	if secret.Address != "" {
+		addrs = append(addrs, strings.Split(secret.Address, ",")...)
+	}
+	urls := make([]*url.URL, 0, len(addrs))
+	for _, addr := range addrs {
+		u, err := url.Parse(strings.TrimRight(strings.TrimSpace(addr), "/"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid address %s", addr)
+		}
+		urls = append(urls, u)
+	}
+	return urls, nil
+}
+
+// addrFromCloudID decodes the Elasticsearch endpoint from a cloud id, which looks like
+// name:base64(host$es_uuid$kibana_uuid).
+func addrFromCloudID(cloudID string) (string, error) {
+	idx := strings.LastIndex(cloudID, ":")
+	if idx == -1 {
+		return "", errors.Errorf("invalid cloud_id %s", cloudID)
+	}
+	data, err := base64.StdEncoding.DecodeString(cloudID[idx+1:])
+	if err != nil {
+		return "", errors.Wrap(err, "invalid cloud_id")
+	}
+	parts := strings.Split(string(data), "$")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", errors.Errorf("invalid cloud_id %s", cloudID)
+	}
+	return fmt.Sprintf("https://%s.%s", parts[1], parts[0]), nil
+}
+
+func newHTTPTransport(secret *Secret) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: secret.InsecureSkipVerify,
+	}
+	if secret.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(secret.CACert)) {
+			return nil, errors.New("invalid ca_cert")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if secret.ClientCert != "" || secret.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(secret.ClientCert), []byte(secret.ClientKey))
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid client_cert or client_key")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
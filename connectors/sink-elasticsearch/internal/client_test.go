@@ -0,0 +1,187 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientDoesNotRetryBulk(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	client, err := newClient(&esConfig{
+		Secret:  Secret{Address: srv.URL},
+		Flavor:  FlavorElasticsearch,
+		Version: "7.17.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &elasticsearchSink{esClient: client, timeout: time.Second}
+	item := &bulkItem{}
+	err = s.bulk(context.Background(), bytes.NewBufferString("{}\n"), []*bulkItem{item})
+	if err == nil {
+		t.Fatal("want error for status 502")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("the bulk request is sent %d times, want 1", n)
+	}
+	// the indexer retries the item instead.
+	if !item.isRetryable() {
+		t.Fatalf("the item with status %d isn't retryable", item.status)
+	}
+}
+
+func TestAddrFromCloudID(t *testing.T) {
+	// base64 of "eu-central-1.aws.cloud.es.io$abcd$efgh".
+	addr, err := addrFromCloudID("my-deployment:ZXUtY2VudHJhbC0xLmF3cy5jbG91ZC5lcy5pbyRhYmNkJGVmZ2g=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "https://abcd.eu-central-1.aws.cloud.es.io" {
+		t.Fatalf("got %s", addr)
+	}
+	invalid := []string{"no-colon", "name:not-base64!", "name:" + base64.StdEncoding.EncodeToString([]byte("host"))}
+	for _, id := range invalid {
+		if _, err = addrFromCloudID(id); err == nil {
+			t.Fatalf("want error for cloud_id %s", id)
+		}
+	}
+
+	// the cloud id is followed by the addresses.
+	urls, err := serverURLs(&Secret{
+		CloudID: "name:" + base64.StdEncoding.EncodeToString([]byte("es.io$abcd$")),
+		Address: "http://a:9200/, http://b:9200",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(urls) != "[https://abcd.es.io http://a:9200 http://b:9200]" {
+		t.Fatalf("got urls %v", urls)
+	}
+}
+
+func TestDetectVersion(t *testing.T) {
+	cases := []struct {
+		info       string
+		flavor     Flavor
+		wantFlavor Flavor
+		wantType   bool
+		wantStream bool
+		wantCompat bool
+		wantErr    bool
+	}{
+		{info: `{"version":{"number":"6.8.23"}}`, wantFlavor: FlavorElasticsearch, wantType: true},
+		{info: `{"version":{"number":"7.10.2"}}`, wantFlavor: FlavorElasticsearch, wantStream: true},
+		{info: `{"version":{"number":"8.11.1","build_flavor":"default"}}`, wantFlavor: FlavorElasticsearch,
+			wantStream: true, wantCompat: true},
+		{info: `{"version":{"number":"2.11.0","distribution":"opensearch"}}`, wantFlavor: FlavorOpenSearch,
+			wantStream: true},
+		// the configured flavor takes precedence.
+		{info: `{"version":{"number":"1.3.0"}}`, flavor: FlavorOpenSearch, wantFlavor: FlavorOpenSearch,
+			wantStream: true},
+		{info: `{"version":{"number":"unknown"}}`, wantErr: true},
+	}
+	for _, c := range cases {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(c.info))
+		}))
+		client, err := newClient(&esConfig{Secret: Secret{Address: srv.URL}, Flavor: c.flavor})
+		srv.Close()
+		if c.wantErr {
+			if err == nil {
+				t.Fatalf("%s: want error", c.info)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", c.info, err)
+		}
+		if client.flavor != c.wantFlavor || client.requiresType() != c.wantType ||
+			client.supportsDataStream() != c.wantStream || client.compatible != c.wantCompat {
+			t.Fatalf("%s: got flavor %s, requires type %v, data stream %v, compatible %v", c.info,
+				client.flavor, client.requiresType(), client.supportsDataStream(), client.compatible)
+		}
+	}
+}
+
+func TestCompatibilityHeadersOfElasticsearch8(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		w.Header().Set("Content-Type", "application/vnd.elasticsearch+json;compatible-with=7")
+		_, _ = w.Write([]byte(`{"errors":false,"items":[{"index":{"status":201}}]}`))
+	}))
+	defer srv.Close()
+
+	for _, version := range []string{"8.6.0", "7.17.0"} {
+		client, err := newClient(&esConfig{
+			Secret:  Secret{Address: srv.URL},
+			Flavor:  FlavorElasticsearch,
+			Version: version,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &elasticsearchSink{esClient: client, timeout: time.Second}
+		item := &bulkItem{}
+		if err = s.bulk(context.Background(), bytes.NewBufferString("{}\n{}\n"), []*bulkItem{item}); err != nil {
+			t.Fatalf("%s: %v", version, err)
+		}
+		if !item.isSuccess() {
+			t.Fatalf("%s: the item has status %d", version, item.status)
+		}
+		h := <-headers
+		compatible := h.Get("Accept") == compatibleWith7 && h.Get("Content-Type") == compatibleWith7
+		if compatible != (version == "8.6.0") {
+			t.Fatalf("%s: got Accept %q and Content-Type %q", version, h.Get("Accept"), h.Get("Content-Type"))
+		}
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"version":{"number":"8.6.0"}}`))
+	}))
+	defer srv.Close()
+	caCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	if _, err := newClient(&esConfig{Secret: Secret{Address: srv.URL}}); err == nil {
+		t.Fatal("the self-signed certificate is trusted without ca_cert")
+	}
+	if _, err := newClient(&esConfig{Secret: Secret{Address: srv.URL, CACert: caCert}}); err != nil {
+		t.Fatalf("with ca_cert: %v", err)
+	}
+	if _, err := newClient(&esConfig{Secret: Secret{Address: srv.URL, InsecureSkipVerify: true}}); err != nil {
+		t.Fatalf("with insecure_skip_verify: %v", err)
+	}
+	if _, err := newClient(&esConfig{Secret: Secret{Address: srv.URL, CACert: "not a pem"}}); err == nil {
+		t.Fatal("want error for an invalid ca_cert")
+	}
+}
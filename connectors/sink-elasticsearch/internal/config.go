@@ -15,7 +15,10 @@
 package internal
 
 import (
+	"github.com/pkg/errors"
+
 	cdkgo "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/connector/internal/placeholder"
 )
 
 type InsertMode string
@@ -31,6 +34,36 @@ type esConfig struct {
 	Timeout     int        `json:"timeout" yaml:"timeout"`
 	BufferBytes int        `json:"buffer_bytes" yaml:"buffer_bytes"`
 	InsertMode  InsertMode `json:"insert_mode" yaml:"insert_mode"`
+	// FlushDocs is the max number of documents in a bulk request.
+	FlushDocs int `json:"flush_docs" yaml:"flush_docs"`
+	// FlushInterval is the interval in millisecond to send the buffered documents.
+	FlushInterval int `json:"flush_interval" yaml:"flush_interval"`
+	// Workers is the number of concurrent bulk requests.
+	Workers int `json:"workers" yaml:"workers"`
+	// MaxRetries is the max retry times of items failed with 429 or 503, 0 means no retry, and
+	// it's 3 if it's not set.
+	MaxRetries *int `json:"max_retries" yaml:"max_retries"`
+	// RetryBackoff is the backoff of the first retry in millisecond, it's doubled for each retry.
+	RetryBackoff int `json:"retry_backoff" yaml:"retry_backoff"`
+	// DeadLetterIndex is the index to write the items failed permanently, such as mapping errors.
+	DeadLetterIndex string `json:"dead_letter_index" yaml:"dead_letter_index"`
+	// PrimaryKey is how to get the document id when the event has no xvid attribute.
+	PrimaryKey PrimaryKeyConfig `json:"primary_key" yaml:"primary_key"`
+	// DataStream writes documents with op_type create, the index name is the data stream name.
+	DataStream bool `json:"data_stream" yaml:"data_stream"`
+	// Pipeline is the default ingest pipeline of documents.
+	Pipeline string `json:"pipeline" yaml:"pipeline"`
+	// Routing is the default routing of documents, it may contain placeholders.
+	Routing string `json:"routing" yaml:"routing"`
+	// TimeZone is used to format the time placeholders of index name and routing.
+	TimeZone string `json:"time_zone" yaml:"time_zone"`
+	// DocumentVersion enables external versioning of documents, so out of order events are ignored.
+	DocumentVersion VersionConfig `json:"document_version" yaml:"document_version"`
+	// Script updates documents with a painless script instead of the partial document.
+	Script ScriptConfig `json:"script" yaml:"script"`
+	// Flavor and Version of the server are detected by the info api if any of them is empty.
+	Flavor  Flavor `json:"flavor" yaml:"flavor"`
+	Version string `json:"version" yaml:"version"`
 
 	Secret Secret `json:"es" yaml:"es"`
 }
@@ -39,13 +72,61 @@ func Config() cdkgo.SinkConfigAccessor {
 	return &esConfig{}
 }
 
+func (cfg *esConfig) Validate() error {
+	if err := cfg.PrimaryKey.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.DocumentVersion.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.Script.Validate(); err != nil {
+		return err
+	}
+	if cfg.DocumentVersion.enabled() && cfg.Script.enabled() {
+		return errors.New("document_version and script can't be both set")
+	}
+	// the update api doesn't support external versions.
+	if cfg.DocumentVersion.enabled() && cfg.InsertMode == Upsert {
+		return errors.New("document_version doesn't support insert_mode upsert")
+	}
+	if _, err := placeholder.LoadLocation(cfg.TimeZone); err != nil {
+		return err
+	}
+	if cfg.MaxRetries != nil && *cfg.MaxRetries < 0 {
+		return errors.New("max_retries can't be negative")
+	}
+	if cfg.Secret.Address == "" && cfg.Secret.CloudID == "" {
+		return errors.New("es.address or es.cloud_id is required")
+	}
+	switch cfg.Flavor {
+	case "", FlavorElasticsearch, FlavorOpenSearch:
+	default:
+		return errors.Errorf("invalid flavor %s", cfg.Flavor)
+	}
+	if cfg.DataStream && cfg.InsertMode == Upsert {
+		return errors.New("data stream doesn't support insert_mode upsert")
+	}
+	return cfg.SinkConfig.Validate()
+}
+
 func (cfg *esConfig) GetSecret() cdkgo.SecretAccessor {
 	return &cfg.Secret
 }
 
 type Secret struct {
-	Address   string `json:"address" yaml:"address" validate:"required"`
+	Address   string `json:"address" yaml:"address"`
+	CloudID   string `json:"cloud_id" yaml:"cloud_id"`
 	IndexName string `json:"index_name" yaml:"index_name" validate:"required"`
 	Username  string `json:"username" yaml:"username"`
 	Password  string `json:"password" yaml:"password"`
+	// APIKey is the base64 encoded id:api_key, it overrides username and password.
+	APIKey string `json:"api_key" yaml:"api_key"`
+
+	// CACert is the PEM encoded certificate authorities to verify the server.
+	CACert string `json:"ca_cert" yaml:"ca_cert"`
+	// CertificateFingerprint is the SHA256 hex fingerprint of the server certificate.
+	CertificateFingerprint string `json:"certificate_fingerprint" yaml:"certificate_fingerprint"`
+	ClientCert             string `json:"client_cert" yaml:"client_cert"`
+	ClientKey              string `json:"client_key" yaml:"client_key"`
+	InsecureSkipVerify     bool   `json:"insecure_skip_verify" yaml:"insecure_skip_verify"`
 }
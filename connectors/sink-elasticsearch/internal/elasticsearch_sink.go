@@ -15,37 +15,33 @@
 package internal
 
 import (
-	"bytes"
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"net/http"
-	"strconv"
-	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/elastic/go-elasticsearch/v7/esutil"
-
 	ce "github.com/cloudevents/sdk-go/v2"
-	es "github.com/elastic/go-elasticsearch/v7"
-	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/pkg/errors"
 
 	cdkgo "github.com/vanus-labs/cdk-go"
 	"github.com/vanus-labs/cdk-go/log"
+	"github.com/vanus-labs/connector/internal/placeholder"
 )
 
+const defaultMaxRetries = 3
+
 type elasticsearchSink struct {
 	count    int64
 	config   *esConfig
-	esClient *es.Client
-
-	timeout time.Duration
-	buf     *bytes.Buffer
-	action  action
-	lock    sync.Mutex
+	esClient *esClient
+
+	timeout    time.Duration
+	maxRetries int
+	// location formats the time placeholders.
+	location   *time.Location
+	action     action
+	primaryKey PrimaryKey
+	indexer    *bulkIndexer
 }
 
 func Sink() cdkgo.Sink {
@@ -62,28 +58,43 @@ func (s *elasticsearchSink) Initialize(_ context.Context, config cdkgo.ConfigAcc
 		// default 5MB
 		cfg.BufferBytes = 5 * 1024 * 1024
 	}
-	if cfg.InsertMode == Upsert {
+	s.maxRetries = defaultMaxRetries
+	if cfg.MaxRetries != nil {
+		s.maxRetries = *cfg.MaxRetries
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = 100
+	}
+	if cfg.FlushDocs == 0 {
+		cfg.FlushDocs = 1000
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = 1000
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = 2
+	}
+	if cfg.DataStream {
+		s.action = actionCreate
+	} else if cfg.InsertMode == Upsert {
 		s.action = actionUpdate
 	} else {
 		s.action = actionIndex
 	}
+	// the time zone is validated by the config.
+	s.location, _ = placeholder.LoadLocation(cfg.TimeZone)
+	s.primaryKey = GetPrimaryKey(cfg.PrimaryKey)
 	s.timeout = time.Duration(cfg.Timeout) * time.Millisecond
-	s.buf = bytes.NewBuffer(make([]byte, 0, cfg.BufferBytes))
 	// init es client
-	esClient, err := es.NewClient(generateEsConfig(cfg))
-	if err != nil {
-		return errors.Wrap(err, "new es client error")
-	}
-	resp, err := esClient.Info()
+	client, err := newClient(cfg)
 	if err != nil {
-		return errors.Wrap(err, "es info api error")
+		return err
 	}
-	if !resp.IsError() {
-		log.Info("es connect success", map[string]interface{}{
-			"esInfo": resp,
-		})
+	if cfg.DataStream && !client.supportsDataStream() {
+		return errors.Errorf("%s %d.%d doesn't support data stream", client.flavor, client.major, client.minor)
 	}
-	s.esClient = esClient
+	s.esClient = client
+	s.indexer = newBulkIndexer(s)
 	return nil
 }
 
@@ -91,188 +102,19 @@ func (s *elasticsearchSink) Arrived(ctx context.Context, events ...*ce.Event) cd
 	if len(events) == 0 {
 		return cdkgo.SuccessResult
 	}
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	atomic.AddInt64(&s.count, int64(len(events)))
+	total := atomic.AddInt64(&s.count, int64(len(events)))
 	log.Info("receive event count", map[string]interface{}{
-		"total": s.count,
+		"total": total,
 	})
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	items := make([]*bulkItem, 0, len(events))
 	for _, event := range events {
-		err := s.appendEvent(event)
+		item, err := s.newBulkItem(event)
 		if err != nil {
-			s.cleanBuffer()
 			return cdkgo.NewResult(http.StatusBadRequest, err.Error())
 		}
+		items = append(items, item)
 	}
-	defer s.cleanBuffer()
-	timeoutCtx, cancel := context.WithTimeout(ctx, s.timeout)
-	defer cancel()
-	req := esapi.BulkRequest{
-		Body: s.buf,
-	}
-	res, err := req.Do(timeoutCtx, s.esClient)
-	if err != nil {
-		log.Warning("es bulk do error", map[string]interface{}{
-			log.KeyError: err,
-			"total":      len(events),
-		})
-		return cdkgo.NewResult(http.StatusInternalServerError, "write to es error")
-	}
-	if res.Body != nil {
-		defer res.Body.Close()
-	}
-	if res.IsError() {
-		log.Warning("es bulk response error", map[string]interface{}{
-			"total":    len(events),
-			"response": res.String(),
-		})
-		return cdkgo.NewResult(http.StatusInternalServerError, "es response error")
-	}
-	var blk esutil.BulkIndexerResponse
-	if err = json.NewDecoder(res.Body).Decode(&blk); err != nil {
-		log.Warning("parse response error", map[string]interface{}{
-			log.KeyError: err,
-		})
-		return cdkgo.NewResult(http.StatusInternalServerError, "parse response error")
-	}
-	if !blk.HasErrors {
-		for i, blkItem := range blk.Items {
-			for k, v := range blkItem {
-				if v.Error.Type != "" || v.Status > 201 {
-					log.Warning("event write to es failed", map[string]interface{}{
-						"index":       i + 1,
-						"id":          events[i].ID(),
-						"action":      k,
-						"errorType":   v.Error.Type,
-						"errorReason": v.Error.Reason,
-					})
-				}
-			}
-		}
-	}
-	return cdkgo.SuccessResult
-}
-
-func (s *elasticsearchSink) cleanBuffer() {
-	if s.buf.Cap() > s.config.BufferBytes {
-		s.buf = bytes.NewBuffer(make([]byte, 0, s.config.BufferBytes))
-	} else {
-		s.buf.Reset()
-	}
-}
-
-func (s *elasticsearchSink) appendEvent(event *ce.Event) error {
-	extensions := event.Extensions()
-	index, err := s.getIndexName(extensions)
-	if err != nil {
-		return err
-	}
-	actionName, err := s.getAction(extensions)
-	if err != nil {
-		return err
-	}
-	documentId, err := s.getDocumentId(extensions)
-	if err != nil {
-		return err
-	}
-	if documentId == "" {
-		if actionName == actionUpdate || actionName == actionDelete {
-			return errors.Errorf("action is %s but documentId is empty", actionName)
-		}
-	}
-	// https://www.elastic.co/guide/en/elasticsearch/reference/master/docs-bulk.html
-	buf := s.buf
-	buf.WriteRune('{')
-	buf.WriteString(strconv.Quote(string(actionName)))
-	buf.WriteRune(':')
-	buf.WriteRune('{')
-	buf.WriteString(`"_index":`)
-	buf.WriteString(strconv.Quote(index))
-	if documentId != "" {
-		buf.WriteRune(',')
-		buf.WriteString(`"_id":`)
-		buf.WriteString(strconv.Quote(documentId))
-	}
-	buf.WriteRune('}')
-	buf.WriteRune('}')
-	buf.WriteRune('\n')
-	if actionName == actionIndex {
-		json.Compact(buf, event.Data())
-	} else if actionName == actionUpdate {
-		buf.WriteRune('{')
-		buf.WriteString(`"doc":`)
-		json.Compact(buf, event.Data())
-		buf.WriteRune(',')
-		buf.WriteString(`"doc_as_upsert":true`)
-		buf.WriteRune('}')
-	}
-	buf.WriteRune('\n')
-	return nil
-}
-
-func (s *elasticsearchSink) writeEvent(ctx context.Context, event *ce.Event) cdkgo.Result {
-	timeoutCtx, cancel := context.WithTimeout(ctx, s.timeout)
-	defer cancel()
-	var (
-		req          esapi.Request
-		documentID   string
-		documentType string
-	)
-	if s.config.InsertMode == Upsert {
-		var body bytes.Buffer
-		body.WriteByte('{')
-		body.WriteString(`"doc":`)
-		body.Write(event.Data())
-		body.WriteByte(',')
-		body.WriteString(`"doc_as_upsert": true`)
-		body.WriteByte('}')
-		// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/docs-update.html
-		req = esapi.UpdateRequest{
-			Index:        s.config.Secret.IndexName,
-			Body:         bytes.NewReader(body.Bytes()),
-			DocumentID:   documentID,
-			DocumentType: documentType,
-		}
-	} else {
-		// https://www.elastic.co/guide/en/elasticsearch/reference/7.17/docs-index_.html
-		req = esapi.IndexRequest{
-			Index:        s.config.Secret.IndexName,
-			Body:         bytes.NewReader(event.Data()),
-			DocumentID:   documentID,
-			DocumentType: documentType,
-		}
-	}
-	resp, err := req.Do(timeoutCtx, s.esClient)
-	if err != nil {
-		log.Warning("es api do error", map[string]interface{}{
-			log.KeyError: err,
-			"event":      event,
-		})
-		return cdkgo.NewResult(http.StatusInternalServerError, "write to es error")
-	}
-	defer resp.Body.Close()
-	if resp.IsError() {
-		log.Warning("es api response error", map[string]interface{}{
-			"resp": resp.String(),
-			"id":   event.ID(),
-		})
-		return cdkgo.NewResult(http.StatusInternalServerError, "es api response error ")
-	}
-	var res map[string]interface{}
-	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		log.Warning("parse response error", map[string]interface{}{
-			log.KeyError: err,
-			"id":         event.ID(),
-		})
-		return cdkgo.NewResult(http.StatusInternalServerError, "parse response error")
-	}
-	log.Debug("index api result ", map[string]interface{}{
-		"result": res["result"],
-		"id":     event.ID(),
-	})
-	return cdkgo.SuccessResult
+	return s.writeItems(ctx, items)
 }
 
 func (s *elasticsearchSink) Name() string {
@@ -280,20 +122,8 @@ func (s *elasticsearchSink) Name() string {
 }
 
 func (s *elasticsearchSink) Destroy() error {
-	return nil
-}
-
-func generateEsConfig(conf *esConfig) es.Config {
-	config := es.Config{
-		Addresses:     strings.Split(conf.Secret.Address, ","),
-		Username:      conf.Secret.Username,
-		Password:      conf.Secret.Password,
-		RetryOnStatus: []int{429, 502, 503, 504},
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+	if s.indexer != nil {
+		s.indexer.close()
 	}
-	return config
+	return nil
 }
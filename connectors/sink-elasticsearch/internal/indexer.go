@@ -0,0 +1,267 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/vanus-labs/cdk-go/log"
+)
+
+var errIndexerClosed = errors.New("es bulk indexer is closed")
+
+// bulkIndexer collects items from concurrent Arrived calls and sends them in bulk requests
+// by several workers, a worker flushes when it has FlushDocs items, BufferBytes bytes or
+// when FlushInterval is elapsed. Items with a document id always go to the same worker, and
+// the worker retries the rejected items before it sends the next ones, so the operations on
+// a document are sent in order.
+type bulkIndexer struct {
+	sink    *elasticsearchSink
+	workers []*bulkWorker
+	next    uint32
+
+	lock   sync.RWMutex
+	closed bool
+	// closing is closed when the indexer starts closing, it interrupts the retry backoff.
+	closing chan struct{}
+	// inflight counts the items which are not done, including the ones waiting for retry.
+	inflight sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+type bulkWorker struct {
+	indexer *bulkIndexer
+	queue   chan *bulkItem
+	buf     *bytes.Buffer
+	items   []*bulkItem
+}
+
+func newBulkIndexer(s *elasticsearchSink) *bulkIndexer {
+	bi := &bulkIndexer{
+		sink:    s,
+		workers: make([]*bulkWorker, s.config.Workers),
+		closing: make(chan struct{}),
+	}
+	bi.ctx, bi.cancel = context.WithCancel(context.Background())
+	for i := range bi.workers {
+		w := &bulkWorker{
+			indexer: bi,
+			queue:   make(chan *bulkItem, s.config.FlushDocs),
+			buf:     bytes.NewBuffer(make([]byte, 0, s.config.BufferBytes)),
+		}
+		bi.workers[i] = w
+		bi.wg.Add(1)
+		go func() {
+			defer bi.wg.Done()
+			w.run()
+		}()
+	}
+	return bi
+}
+
+// add queues the item, it fails if the indexer is closed or ctx is done before the queue
+// of the worker has room.
+func (bi *bulkIndexer) add(ctx context.Context, item *bulkItem) error {
+	bi.lock.RLock()
+	defer bi.lock.RUnlock()
+	if bi.closed {
+		return errIndexerClosed
+	}
+	bi.inflight.Add(1)
+	var idx uint32
+	if item.documentId != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(item.index))
+		_, _ = h.Write([]byte(item.documentId))
+		idx = h.Sum32()
+	} else {
+		idx = atomic.AddUint32(&bi.next, 1)
+	}
+	select {
+	case bi.workers[idx%uint32(len(bi.workers))].queue <- item:
+		return nil
+	case <-ctx.Done():
+		bi.inflight.Done()
+		return ctx.Err()
+	}
+}
+
+func (bi *bulkIndexer) finish(item *bulkItem) {
+	item.done()
+	bi.inflight.Done()
+}
+
+// close rejects new items and stops the retry backoff, waits for the items in flight, then
+// stops the workers.
+func (bi *bulkIndexer) close() {
+	bi.lock.Lock()
+	if !bi.closed {
+		bi.closed = true
+		close(bi.closing)
+	}
+	bi.lock.Unlock()
+	bi.inflight.Wait()
+	bi.cancel()
+	bi.wg.Wait()
+}
+
+func (w *bulkWorker) run() {
+	cfg := w.indexer.sink.config
+	ticker := time.NewTicker(time.Duration(cfg.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case item := <-w.queue:
+			if item.isCanceled() {
+				w.drop(item)
+				continue
+			}
+			if len(w.items) > 0 && w.buf.Len()+len(item.payload) > cfg.BufferBytes {
+				w.flush()
+			}
+			w.buf.Write(item.payload)
+			w.items = append(w.items, item)
+			if len(w.items) >= cfg.FlushDocs || w.buf.Len() >= cfg.BufferBytes {
+				w.flush()
+			}
+		case <-ticker.C:
+			w.flush()
+		case <-w.indexer.ctx.Done():
+			w.flush()
+			return
+		}
+	}
+}
+
+// flush sends the buffered items, the items rejected with a retryable status are sent again
+// with backoff before the worker takes the next items.
+func (w *bulkWorker) flush() {
+	if len(w.items) == 0 {
+		return
+	}
+	items := w.items
+	w.items = nil
+	if n := w.dropCanceled(items); n < len(items) {
+		// the buffer has the canceled items, so it's rebuilt from the others.
+		items = items[:n]
+		w.resetBuffer()
+		for _, item := range items {
+			w.buf.Write(item.payload)
+		}
+	}
+	if len(items) > 0 {
+		w.send(items)
+	}
+	w.resetBuffer()
+
+	var retries []*bulkItem
+	for {
+		retries = retries[:0]
+		for _, item := range items {
+			if !item.isSuccess() && item.isRetryable() && item.attempts <= w.indexer.sink.maxRetries &&
+				!item.isCanceled() {
+				retries = append(retries, item)
+			} else {
+				w.indexer.finish(item)
+			}
+		}
+		if len(retries) == 0 {
+			return
+		}
+		if !w.backoff(w.indexer.sink.retryBackoff(retries[0].attempts - 1)) {
+			// the items keep their retryable status, so their events are redelivered.
+			for _, item := range retries {
+				w.indexer.finish(item)
+			}
+			return
+		}
+		items = append([]*bulkItem(nil), retries...)
+		for _, item := range items {
+			w.buf.Write(item.payload)
+		}
+		w.send(items)
+		w.resetBuffer()
+	}
+}
+
+// backoff waits for d before a retry, it returns false if the indexer is closing.
+func (w *bulkWorker) backoff(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-w.indexer.closing:
+		return false
+	}
+}
+
+// drop finishes the item of an event which has been given up, so it's never written later.
+func (w *bulkWorker) drop(item *bulkItem) {
+	item.setResult(http.StatusRequestTimeout, "canceled", "the event is canceled", false)
+	w.indexer.finish(item)
+}
+
+// dropCanceled drops the canceled items and moves the others to the front, it returns the
+// number of the others.
+func (w *bulkWorker) dropCanceled(items []*bulkItem) int {
+	n := 0
+	for _, item := range items {
+		if item.isCanceled() {
+			w.drop(item)
+			continue
+		}
+		items[n] = item
+		n++
+	}
+	return n
+}
+
+func (w *bulkWorker) send(items []*bulkItem) {
+	for _, item := range items {
+		item.attempts++
+	}
+	size := w.buf.Len()
+	err := w.indexer.sink.bulk(context.Background(), w.buf, items)
+	if err != nil {
+		log.Warning("es bulk error", map[string]interface{}{
+			log.KeyError: err,
+			"total":      len(items),
+		})
+	} else {
+		log.Debug("es bulk flushed", map[string]interface{}{
+			"total": len(items),
+			"bytes": size,
+		})
+	}
+}
+
+func (w *bulkWorker) resetBuffer() {
+	if w.buf.Cap() > w.indexer.sink.config.BufferBytes*2 {
+		w.buf = bytes.NewBuffer(make([]byte, 0, w.indexer.sink.config.BufferBytes))
+	} else {
+		w.buf.Reset()
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+)
+
+// bulkDocs reads the documents of a bulk request, each action line is followed by a document.
+func bulkDocs(r *http.Request) []string {
+	var docs []string
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		if !scanner.Scan() {
+			break
+		}
+		docs = append(docs, scanner.Text())
+	}
+	return docs
+}
+
+func writeBulkResponse(w http.ResponseWriter, statuses []int) {
+	items := make([]map[string]map[string]interface{}, len(statuses))
+	for i, status := range statuses {
+		items[i] = map[string]map[string]interface{}{"index": {"status": status}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"errors": false, "items": items})
+}
+
+func created(docs []string) []int {
+	statuses := make([]int, len(docs))
+	for i := range statuses {
+		statuses[i] = http.StatusCreated
+	}
+	return statuses
+}
+
+// hasCode reports whether the result has the code, it's checked by the message since GetCode
+// of the cdk doesn't return.
+func hasCode(result cdkgo.Result, code int) bool {
+	return strings.Contains(result.Error().Error(), fmt.Sprintf(`"code": %d}`, code))
+}
+
+// indexerConfig flushes every document at once, and retries after 20ms.
+func indexerConfig(addr string, workers int) *esConfig {
+	return &esConfig{
+		FlushDocs:     1,
+		FlushInterval: 10,
+		Workers:       workers,
+		RetryBackoff:  20,
+		Flavor:        FlavorElasticsearch,
+		Version:       "8.6.0",
+		Secret:        Secret{Address: addr, IndexName: "events"},
+	}
+}
+
+func newTestEvent(id, docID, data string) *ce.Event {
+	e := ce.NewEvent()
+	e.SetID(id)
+	e.SetSource("test")
+	e.SetType("test")
+	if docID != "" {
+		e.SetExtension(attributeId, docID)
+	}
+	_ = e.SetData(ce.ApplicationJSON, json.RawMessage(data))
+	return &e
+}
+
+func TestBulkIndexerRetryKeepsOrder(t *testing.T) {
+	var lock sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		docs := bulkDocs(r)
+		statuses := created(docs)
+		lock.Lock()
+		for i, doc := range docs {
+			// the first version is rejected once.
+			if doc == `{"v":1}` && !contains(got, doc) {
+				statuses[i] = http.StatusTooManyRequests
+			}
+			got = append(got, doc)
+		}
+		lock.Unlock()
+		writeBulkResponse(w, statuses)
+	}))
+	defer srv.Close()
+	s := &elasticsearchSink{}
+	if err := s.Initialize(context.Background(), indexerConfig(srv.URL, 2)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Destroy() }()
+
+	var wg sync.WaitGroup
+	results := make([]cdkgo.Result, 2)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0] = s.Arrived(context.Background(), newTestEvent("1", "doc", `{"v":1}`))
+	}()
+	// the second version arrives while the first one waits for retry.
+	time.Sleep(10 * time.Millisecond)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[1] = s.Arrived(context.Background(), newTestEvent("2", "doc", `{"v":2}`))
+	}()
+	wg.Wait()
+	for i, result := range results {
+		if result != cdkgo.SuccessResult {
+			t.Fatalf("event %d: %s", i+1, result.Error().Error())
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{`{"v":1}`, `{"v":1}`, `{"v":2}`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got documents %v, want %v", got, want)
+	}
+}
+
+func contains(docs []string, doc string) bool {
+	for _, d := range docs {
+		if d == doc {
+			return true
+		}
+	}
+	return false
+}
+
+func TestBulkIndexerMaxRetries(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		writeBulkResponse(w, []int{http.StatusTooManyRequests})
+	}))
+	defer srv.Close()
+	s := &elasticsearchSink{}
+	if err := s.Initialize(context.Background(), indexerConfig(srv.URL, 1)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Destroy() }()
+	s.maxRetries = 0
+
+	result := s.Arrived(context.Background(), newTestEvent("1", "doc", `{"v":1}`))
+	if !hasCode(result, http.StatusServiceUnavailable) {
+		t.Fatalf("got %s, want 503", result.Error())
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("got %d attempts, want 1 when max_retries is 0", n)
+	}
+}
+
+func TestBulkIndexerCanceledEventIsNotWrittenLater(t *testing.T) {
+	received := make(chan []string, 2)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		docs := bulkDocs(r)
+		received <- docs
+		<-release
+		writeBulkResponse(w, created(docs))
+	}))
+	defer srv.Close()
+	s := &elasticsearchSink{}
+	if err := s.Initialize(context.Background(), indexerConfig(srv.URL, 1)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Destroy() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan cdkgo.Result, 1)
+	go func() {
+		done <- s.Arrived(ctx, newTestEvent("1", "a", `{"v":1}`), newTestEvent("2", "b", `{"v":2}`))
+	}()
+	first := <-received
+	cancel()
+	select {
+	case result := <-done:
+		t.Fatalf("the result %s is returned while the request is in flight", result.Error().Error())
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	result := <-done
+	if result == cdkgo.SuccessResult || !strings.Contains(result.Error().Error(), "canceled, events: 2") {
+		t.Fatalf("got %s, want the queued event 2 canceled", result.Error().Error())
+	}
+	if len(first) != 1 || first[0] != `{"v":1}` {
+		t.Fatalf("got documents %v, want only the first one", first)
+	}
+	select {
+	case docs := <-received:
+		t.Fatalf("the canceled documents %v are written", docs)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestBulkIndexerArrivedRacesDestroy(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeBulkResponse(w, created(bulkDocs(r)))
+	}))
+	defer srv.Close()
+	s := &elasticsearchSink{}
+	if err := s.Initialize(context.Background(), indexerConfig(srv.URL, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			result := s.Arrived(context.Background(), newTestEvent(fmt.Sprint(i), fmt.Sprint(i), `{"v":1}`))
+			if result != cdkgo.SuccessResult && !strings.Contains(result.Error().Error(), errIndexerClosed.Error()) {
+				t.Errorf("unexpected result %s", result.Error().Error())
+			}
+		}(i)
+	}
+	_ = s.Destroy()
+	wg.Wait()
+	result := s.Arrived(context.Background(), newTestEvent("x", "x", `{"v":1}`))
+	if !hasCode(result, http.StatusServiceUnavailable) {
+		t.Fatalf("got %s, want 503 after destroy", result.Error())
+	}
+}
+
+func TestBulkIndexerAddGivesUpWhenQueueIsFull(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		writeBulkResponse(w, created(bulkDocs(r)))
+	}))
+	defer srv.Close()
+	s := &elasticsearchSink{}
+	if err := s.Initialize(context.Background(), indexerConfig(srv.URL, 1)); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = s.Destroy() }()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// the worker sends the first item and the queue holds the second one.
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		var item *bulkItem
+		item, err = s.newBulkItem(newTestEvent(fmt.Sprint(i), "doc", `{"v":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.done = func() {}
+		err = s.indexer.add(ctx, item)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want the deadline exceeded while the queue is full", err)
+	}
+}
+
+func TestBulkIndexerCloseInterruptsBackoff(t *testing.T) {
+	received := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+		writeBulkResponse(w, []int{http.StatusTooManyRequests})
+	}))
+	defer srv.Close()
+	cfg := indexerConfig(srv.URL, 1)
+	cfg.RetryBackoff = 60 * 1000
+	s := &elasticsearchSink{}
+	if err := s.Initialize(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan cdkgo.Result, 1)
+	go func() {
+		done <- s.Arrived(context.Background(), newTestEvent("1", "doc", `{"v":1}`))
+	}()
+	<-received
+	time.Sleep(10 * time.Millisecond)
+	start := time.Now()
+	_ = s.Destroy()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("destroy takes %v during the retry backoff", d)
+	}
+	if result := <-done; !hasCode(result, http.StatusServiceUnavailable) {
+		t.Fatalf("got %s, want 503", result.Error())
+	}
+}
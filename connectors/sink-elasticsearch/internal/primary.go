@@ -15,10 +15,15 @@
 package internal
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"strings"
 
 	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/pkg/errors"
 	"github.com/tidwall/gjson"
 )
 
@@ -28,8 +33,51 @@ const (
 	None PrimaryKeyType = iota
 	EventAttribute
 	EventData
+	EventDataHash
 )
 
+type PrimaryKeyStrategy string
+
+const defaultSeparator = "_"
+
+const (
+	StrategyNone      PrimaryKeyStrategy = ""
+	StrategyAttribute PrimaryKeyStrategy = "attribute"
+	StrategyData      PrimaryKeyStrategy = "data"
+	StrategyHash      PrimaryKeyStrategy = "hash"
+)
+
+type PrimaryKeyConfig struct {
+	Strategy PrimaryKeyStrategy `json:"strategy" yaml:"strategy"`
+	// Attribute is the event attribute used as the document id, for the attribute strategy.
+	Attribute string `json:"attribute" yaml:"attribute"`
+	// Paths are the json paths of event data joined as the document id, for the data strategy.
+	Paths []string `json:"paths" yaml:"paths"`
+	// Separator joins the values of paths, it's "_" if it's empty, so the ids of different values
+	// don't collide, e.g. ("ab","c") and ("a","bc").
+	Separator string `json:"separator" yaml:"separator"`
+}
+
+func (c *PrimaryKeyConfig) Validate() error {
+	switch c.Strategy {
+	case StrategyNone, StrategyHash:
+	case StrategyAttribute:
+		if c.Attribute == "" {
+			return errors.New("primary_key.attribute can't be empty")
+		}
+	case StrategyData:
+		if len(c.Paths) == 0 {
+			return errors.New("primary_key.paths can't be empty")
+		}
+		if c.Separator == "" {
+			c.Separator = defaultSeparator
+		}
+	default:
+		return errors.Errorf("invalid primary_key.strategy %s", c.Strategy)
+	}
+	return nil
+}
+
 type PrimaryKey interface {
 	Name() string
 	Type() PrimaryKeyType
@@ -67,6 +115,12 @@ func (p eventAttribute) Value(event *ce.Event) string {
 	switch p.attr {
 	case "id":
 		return event.ID()
+	case "source":
+		return event.Source()
+	case "type":
+		return event.Type()
+	case "subject":
+		return event.Subject()
 	default:
 		extensions := event.Context.AsV1().Extensions
 		if len(extensions) == 0 {
@@ -85,7 +139,8 @@ func (p eventAttribute) Value(event *ce.Event) string {
 }
 
 type eventData struct {
-	path string
+	paths     []string
+	separator string
 }
 
 func (p eventData) Type() PrimaryKeyType {
@@ -93,27 +148,63 @@ func (p eventData) Type() PrimaryKeyType {
 }
 
 func (p eventData) Name() string {
-	return p.path
+	return strings.Join(p.paths, ",")
 }
 
+// Value joins the values of the paths, it's empty if any of the paths is not found.
 func (p eventData) Value(event *ce.Event) string {
-	result := gjson.GetBytes(event.Data(), p.path)
-	return result.String()
+	results := gjson.GetManyBytes(event.Data(), p.paths...)
+	values := make([]string, len(results))
+	for i, result := range results {
+		if !result.Exists() || result.Type == gjson.Null {
+			return ""
+		}
+		values[i] = result.String()
+	}
+	return strings.Join(values, p.separator)
 }
 
-func GetPrimaryKey(primaryKey string) PrimaryKey {
-	primaryKey = strings.TrimSpace(primaryKey)
-	if primaryKey == "" {
-		return none{}
+type eventDataHash struct {
+}
+
+func (p eventDataHash) Type() PrimaryKeyType {
+	return EventDataHash
+}
+
+func (p eventDataHash) Name() string {
+	return "hash"
+}
+
+// Value is the sha256 of the compacted event data, so the same content always has the same id.
+func (p eventDataHash) Value(event *ce.Event) string {
+	var buf bytes.Buffer
+	data := event.Data()
+	if err := json.Compact(&buf, data); err == nil {
+		data = buf.Bytes()
 	}
-	index := strings.Index(primaryKey, ".")
-	if index == -1 {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func GetPrimaryKey(cfg PrimaryKeyConfig) PrimaryKey {
+	switch cfg.Strategy {
+	case StrategyAttribute:
 		return eventAttribute{
-			attr: strings.ToLower(primaryKey),
+			attr: strings.ToLower(strings.TrimSpace(cfg.Attribute)),
 		}
-	}
-	// format is data.key remove data. only has key
-	return eventData{
-		path: primaryKey[5:],
+	case StrategyData:
+		paths := make([]string, len(cfg.Paths))
+		for i, path := range cfg.Paths {
+			// the path can be written as data.key, remove data. only has key
+			paths[i] = strings.TrimPrefix(strings.TrimSpace(path), "data.")
+		}
+		return eventData{
+			paths:     paths,
+			separator: cfg.Separator,
+		}
+	case StrategyHash:
+		return eventDataHash{}
+	default:
+		return none{}
 	}
 }
@@ -0,0 +1,50 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+)
+
+func TestPrimaryKeyData(t *testing.T) {
+	cases := []struct {
+		name      string
+		separator string
+		data      string
+		want      string
+	}{
+		{name: "default separator", data: `{"tenant":"ab","order":{"id":"c"}}`, want: "ab_c"},
+		{name: "no collision", data: `{"tenant":"a","order":{"id":"bc"}}`, want: "a_bc"},
+		{name: "custom separator", separator: ":", data: `{"tenant":"a","order":{"id":1}}`, want: "a:1"},
+		{name: "missing path", data: `{"tenant":"a"}`, want: ""},
+		{name: "null value", data: `{"tenant":"a","order":{"id":null}}`, want: ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := PrimaryKeyConfig{
+				Strategy:  StrategyData,
+				Paths:     []string{"data.tenant", "order.id"},
+				Separator: c.separator,
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			got := GetPrimaryKey(cfg).Value(newTestEvent("1", "", c.data))
+			if got != c.want {
+				t.Fatalf("got %q, want %q", got, c.want)
+			}
+		})
+	}
+}
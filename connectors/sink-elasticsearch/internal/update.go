@@ -0,0 +1,178 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/pkg/errors"
+	"github.com/tidwall/gjson"
+)
+
+type VersionType string
+
+const (
+	VersionExternal    VersionType = "external"
+	VersionExternalGTE VersionType = "external_gte"
+)
+
+// VersionConfig enables external versioning, the version is a non-negative integer taken from
+// an event attribute or a json path of the data, such as a binlog position or ts_ms.
+type VersionConfig struct {
+	Attribute string      `json:"attribute" yaml:"attribute"`
+	Path      string      `json:"path" yaml:"path"`
+	Type      VersionType `json:"type" yaml:"type"`
+}
+
+func (c *VersionConfig) enabled() bool {
+	return c.Attribute != "" || c.Path != ""
+}
+
+func (c *VersionConfig) Validate() error {
+	if c.Attribute != "" && c.Path != "" {
+		return errors.New("document_version.attribute and document_version.path can't be both set")
+	}
+	switch c.Type {
+	case "", VersionExternal, VersionExternalGTE:
+	default:
+		return errors.Errorf("invalid document_version.type %s", c.Type)
+	}
+	return nil
+}
+
+func (c *VersionConfig) versionType() VersionType {
+	if c.Type == "" {
+		return VersionExternal
+	}
+	return c.Type
+}
+
+// ScriptConfig is the painless script to update documents instead of the partial document.
+type ScriptConfig struct {
+	Source string `json:"source" yaml:"source"`
+	// ID is the id of a stored script, it can't be set with source.
+	ID   string `json:"id" yaml:"id"`
+	Lang string `json:"lang" yaml:"lang"`
+	// Params maps the script params to the event, a value starting with "data." is the json
+	// path of the data, otherwise it's an event attribute.
+	Params map[string]string `json:"params" yaml:"params"`
+	// Upsert indexes the event data as the document if it doesn't exist.
+	Upsert bool `json:"upsert" yaml:"upsert"`
+	// ScriptedUpsert runs the script even if the document doesn't exist.
+	ScriptedUpsert bool `json:"scripted_upsert" yaml:"scripted_upsert"`
+}
+
+func (c *ScriptConfig) enabled() bool {
+	return c.Source != "" || c.ID != ""
+}
+
+func (c *ScriptConfig) Validate() error {
+	if c.Source != "" && c.ID != "" {
+		return errors.New("script.source and script.id can't be both set")
+	}
+	return nil
+}
+
+func (s *elasticsearchSink) getVersion(event *ce.Event) (int64, error) {
+	cfg := s.config.DocumentVersion
+	var (
+		value string
+		name  string
+	)
+	if cfg.Attribute != "" {
+		name = cfg.Attribute
+		value = eventAttribute{attr: cfg.Attribute}.Value(event)
+	} else {
+		name = cfg.Path
+		result := gjson.GetBytes(event.Data(), strings.TrimPrefix(cfg.Path, "data."))
+		if result.Exists() {
+			value = result.String()
+		}
+	}
+	if value == "" {
+		return 0, errors.Errorf("version %s of event %s is empty", name, event.ID())
+	}
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 0 {
+		return 0, errors.Errorf("version %s=%s of event %s is not a non-negative integer", name, value, event.ID())
+	}
+	return version, nil
+}
+
+// scriptBody builds the body of the update action with the configured script.
+func (s *elasticsearchSink) scriptBody(event *ce.Event) ([]byte, error) {
+	cfg := s.config.Script
+	script := map[string]interface{}{}
+	if cfg.Source != "" {
+		script["source"] = cfg.Source
+	} else {
+		script["id"] = cfg.ID
+	}
+	if cfg.Lang != "" {
+		script["lang"] = cfg.Lang
+	}
+	if len(cfg.Params) > 0 {
+		params := make(map[string]interface{}, len(cfg.Params))
+		for name, source := range cfg.Params {
+			v, err := scriptParam(event, source)
+			if err != nil {
+				return nil, errors.Wrapf(err, "script param %s", name)
+			}
+			params[name] = v
+		}
+		script["params"] = params
+	}
+	body := map[string]interface{}{
+		"script": script,
+	}
+	if cfg.Upsert {
+		body["upsert"] = json.RawMessage(compactData(event))
+	}
+	if cfg.ScriptedUpsert {
+		body["scripted_upsert"] = true
+		if !cfg.Upsert {
+			body["upsert"] = map[string]interface{}{}
+		}
+	}
+	return json.Marshal(body)
+}
+
+func scriptParam(event *ce.Event, source string) (interface{}, error) {
+	if strings.HasPrefix(source, "data.") {
+		result := gjson.GetBytes(event.Data(), source[len("data."):])
+		if !result.Exists() {
+			return nil, errors.Errorf("%s not found", source)
+		}
+		// keep the raw json, so large numbers don't lose precision.
+		return json.RawMessage(result.Raw), nil
+	}
+	value := eventAttribute{attr: source}.Value(event)
+	if value == "" {
+		return nil, errors.Errorf("attribute %s not found", source)
+	}
+	return value, nil
+}
+
+func compactData(event *ce.Event) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, event.Data()); err != nil {
+		return event.Data()
+	}
+	return buf.Bytes()
+}
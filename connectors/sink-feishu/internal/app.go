@@ -0,0 +1,439 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	v2 "github.com/cloudevents/sdk-go/v2"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog"
+
+	cdk "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/cdk-go/connector"
+)
+
+const (
+	xReceiveIDType = "xvfeishureceiveidtype"
+	xReceiveID     = "xvfeishureceiveid"
+	xReplyTo       = "xvfeishureplyto"
+	xReplyInThread = "xvfeishureplyinthread"
+
+	defaultEndpoint      = "https://open.feishu.cn"
+	defaultReceiveIDType = "chat_id"
+
+	// refresh the token before it expires, so it won't expire during a request.
+	tokenRefreshAhead = 5 * time.Minute
+
+	// the codes of invalid tenant_access_token.
+	codeInvalidToken = 99991663
+	codeMissingToken = 99991661
+	// the codes of throttled requests.
+	codeAppFrequencyLimited = 99991400
+	codeIMFrequencyLimited  = 230020
+
+	// maxImageSize is the max size of images uploaded to Feishu.
+	maxImageSize         = 10 << 20
+	imageDownloadTimeout = 30 * time.Second
+)
+
+var (
+	receiveIDTypes = map[string]bool{
+		"open_id":  true,
+		"user_id":  true,
+		"union_id": true,
+		"email":    true,
+		"chat_id":  true,
+	}
+
+	errNoReceiver = cdk.NewResult(http.StatusBadRequest, "feishu: no receiver found, please check xvfeishureceiveid "+
+		"in attributes or app.receive_id in config")
+	errInvalidReceiveIDType = cdk.NewResult(http.StatusBadRequest, "feishu: xvfeishureceiveidtype is invalid, only"+
+		" [open_id, user_id, union_id, email, chat_id] are supported")
+	errImageTooLarge = cdk.NewResult(http.StatusBadRequest, "feishu: the image is larger than 10MB")
+)
+
+type AppConfig struct {
+	AppID     string `json:"app_id" yaml:"app_id" validate:"required"`
+	AppSecret string `json:"app_secret" yaml:"app_secret" validate:"required"`
+	// Endpoint is the address of Feishu Open Platform, it's https://open.larksuite.com for Lark.
+	Endpoint      string `json:"endpoint" yaml:"endpoint"`
+	ReceiveIDType string `json:"receive_id_type" yaml:"receive_id_type"`
+	ReceiveID     string `json:"receive_id" yaml:"receive_id"`
+	// MaxRetries is the max retry times of a throttled or failed call, 0 means no retry, and it's
+	// 3 if it's not set.
+	MaxRetries *int `json:"max_retries" yaml:"max_retries"`
+	// RetryBackoff is the backoff in millisecond of the first retry, it's doubled for each retry.
+	RetryBackoff int `json:"retry_backoff" yaml:"retry_backoff"`
+}
+
+func (c *AppConfig) Validate() error {
+	if c.AppID == "" || c.AppSecret == "" {
+		return errors.New("the app.app_id and app.app_secret can't be empty")
+	}
+	if (c.MaxRetries != nil && *c.MaxRetries < 0) || c.RetryBackoff < 0 {
+		return errors.New("the app.max_retries and app.retry_backoff can't be negative")
+	}
+	if c.Endpoint == "" {
+		c.Endpoint = defaultEndpoint
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	if c.ReceiveIDType == "" {
+		c.ReceiveIDType = defaultReceiveIDType
+	}
+	if !receiveIDTypes[c.ReceiveIDType] {
+		return fmt.Errorf("the app.receive_id_type %s is invalid", c.ReceiveIDType)
+	}
+	if c.MaxRetries == nil {
+		maxRetries := defaultMaxRetries
+		c.MaxRetries = &maxRetries
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultRetryBackoff
+	}
+	return nil
+}
+
+// app sends messages with the Open Platform APIs as a Feishu app, so it can reach users as well
+// as chats, reply to messages and upload images.
+type app struct {
+	cfg        AppConfig
+	httpClient *resty.Client
+	// imageClient downloads the images of image messages.
+	imageClient *http.Client
+	logger      zerolog.Logger
+
+	tokenLock sync.Mutex
+	token     string
+	expireAt  time.Time
+}
+
+func (a *app) init(cfg AppConfig, logger zerolog.Logger) {
+	a.cfg = cfg
+	a.logger = logger
+	a.imageClient = &http.Client{Timeout: imageDownloadTimeout}
+}
+
+type appResponse struct {
+	Code int             `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+type tokenResponse struct {
+	Code              int    `json:"code"`
+	Msg               string `json:"msg"`
+	TenantAccessToken string `json:"tenant_access_token"`
+	// Expire is the remaining seconds of the token.
+	Expire int `json:"expire"`
+}
+
+// getToken returns the cached tenant_access_token, it gets a new one if the cached is expiring.
+func (a *app) getToken(ctx context.Context) (string, error) {
+	a.tokenLock.Lock()
+	defer a.tokenLock.Unlock()
+	if a.token != "" && time.Now().Before(a.expireAt) {
+		return a.token, nil
+	}
+	var resp tokenResponse
+	res, err := a.httpClient.R().SetContext(ctx).
+		SetBody(map[string]string{
+			"app_id":     a.cfg.AppID,
+			"app_secret": a.cfg.AppSecret,
+		}).
+		Post(a.cfg.Endpoint + "/open-apis/auth/v3/tenant_access_token/internal")
+	if err != nil {
+		return "", err
+	}
+	if err = json.Unmarshal(res.Body(), &resp); err != nil || resp.Code != 0 || resp.TenantAccessToken == "" {
+		return "", fmt.Errorf("failed to get tenant_access_token: %s %s", res.Status(), string(res.Body()))
+	}
+	a.token = resp.TenantAccessToken
+	a.expireAt = time.Now().Add(time.Duration(resp.Expire)*time.Second - tokenRefreshAhead)
+	return a.token, nil
+}
+
+// invalidateToken drops the cached token if it's the token rejected by feishu.
+func (a *app) invalidateToken(token string) {
+	a.tokenLock.Lock()
+	defer a.tokenLock.Unlock()
+	if a.token == token {
+		a.token = ""
+	}
+}
+
+// do calls an Open Platform API with the tenant_access_token, the data of the response is
+// unmarshalled to result if it isn't nil.
+func (a *app) do(ctx context.Context, req func(r *resty.Request) (*resty.Response, error), result interface{}) error {
+	backoff := time.Duration(a.cfg.RetryBackoff) * time.Millisecond
+	code, err := retry(ctx, a.logger, *a.cfg.MaxRetries, backoff, func() (int, bool, error) {
+		token, err := a.getToken(ctx)
+		if err != nil {
+			return http.StatusInternalServerError, ctx.Err() == nil, err
+		}
+		res, err := req(a.httpClient.R().SetContext(ctx).SetAuthToken(token))
+		if err != nil {
+			return http.StatusInternalServerError, ctx.Err() == nil, err
+		}
+		if res.StatusCode() >= http.StatusInternalServerError {
+			return res.StatusCode(), true, fmt.Errorf("failed to call feishu: %s %s", res.Status(), string(res.Body()))
+		}
+		var resp appResponse
+		if err = json.Unmarshal(res.Body(), &resp); err != nil {
+			return http.StatusBadRequest, false, fmt.Errorf("unmarshal feishu response error: %w, body: %s",
+				err, string(res.Body()))
+		}
+		switch resp.Code {
+		case 0:
+		case codeInvalidToken, codeMissingToken:
+			a.invalidateToken(token)
+			return http.StatusUnauthorized, true, fmt.Errorf("failed to call feishu: %s", string(res.Body()))
+		case codeAppFrequencyLimited, codeIMFrequencyLimited:
+			return http.StatusTooManyRequests, true, fmt.Errorf("failed to call feishu: %s", string(res.Body()))
+		default:
+			return http.StatusBadRequest, false, fmt.Errorf("failed to call feishu: %s", string(res.Body()))
+		}
+		if result != nil && len(resp.Data) > 0 {
+			if err = json.Unmarshal(resp.Data, result); err != nil {
+				return http.StatusBadRequest, false, fmt.Errorf("unmarshal feishu response data error: %w", err)
+			}
+		}
+		return http.StatusOK, false, nil
+	})
+	if err != nil {
+		return &callError{code: code, err: err}
+	}
+	return nil
+}
+
+// callError is a failed call to feishu with the status code of the result.
+type callError struct {
+	code int
+	err  error
+}
+
+func (e *callError) Error() string {
+	return e.err.Error()
+}
+
+func errorResult(err error) cdk.Result {
+	var ce *callError
+	if errors.As(err, &ce) {
+		return cdk.NewResult(connector.Code(ce.code), "call feishu response error:"+ce.err.Error())
+	}
+	return cdk.NewResult(http.StatusInternalServerError, "call feishu error:"+err.Error())
+}
+
+type appMessage struct {
+	ReceiveID     string `json:"receive_id,omitempty"`
+	MsgType       string `json:"msg_type"`
+	Content       string `json:"content"`
+	ReplyInThread bool   `json:"reply_in_thread,omitempty"`
+	UUID          string `json:"uuid,omitempty"`
+}
+
+// sendMessages sends the messages of the events one by one in order.
+func (a *app) sendMessages(ctx context.Context, events []*v2.Event) cdk.Result {
+	for _, e := range events {
+		if result := a.sendMessage(ctx, e); result != cdk.SuccessResult {
+			return result
+		}
+	}
+	return cdk.SuccessResult
+}
+
+func (a *app) sendMessage(ctx context.Context, e *v2.Event) cdk.Result {
+	t, ok := e.Extensions()[xMessageType].(string)
+	if !ok {
+		t = string(textMessage)
+	}
+	botMsg, err := event2BotMessage(e, messageType(t))
+	if err != nil {
+		return cdk.NewResult(http.StatusBadRequest, "event parse error:"+err.Error())
+	}
+	content, result := a.content(ctx, botMsg)
+	if result != cdk.SuccessResult {
+		return result
+	}
+	msg := &appMessage{
+		MsgType: string(botMsg.MsgType),
+		Content: content,
+	}
+	// the uuid makes feishu drop the duplicated message of a redelivered event in an hour.
+	if len(e.ID()) <= 50 {
+		msg.UUID = e.ID()
+	}
+
+	if replyTo, ok := e.Extensions()[xReplyTo].(string); ok && replyTo != "" {
+		msg.ReplyInThread = true
+		if v, ok := e.Extensions()[xReplyInThread].(string); ok {
+			msg.ReplyInThread, err = strconv.ParseBool(v)
+			if err != nil {
+				return cdk.NewResult(http.StatusBadRequest, "feishu: xvfeishureplyinthread is invalid: "+err.Error())
+			}
+		}
+		err = a.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+			return r.SetBody(msg).
+				SetPathParam("message_id", replyTo).
+				Post(a.cfg.Endpoint + "/open-apis/im/v1/messages/{message_id}/reply")
+		}, nil)
+	} else {
+		idType, ok := e.Extensions()[xReceiveIDType].(string)
+		if !ok {
+			idType = a.cfg.ReceiveIDType
+		}
+		if !receiveIDTypes[idType] {
+			return errInvalidReceiveIDType
+		}
+		msg.ReceiveID, ok = e.Extensions()[xReceiveID].(string)
+		if !ok {
+			msg.ReceiveID = a.cfg.ReceiveID
+		}
+		if msg.ReceiveID == "" {
+			return errNoReceiver
+		}
+		err = a.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+			return r.SetBody(msg).
+				SetQueryParam("receive_id_type", idType).
+				Post(a.cfg.Endpoint + "/open-apis/im/v1/messages")
+		}, nil)
+	}
+	if err != nil {
+		return errorResult(err)
+	}
+	a.logger.Info().Str("event_id", e.ID()).Msg("success send message to feishu app")
+	return cdk.SuccessResult
+}
+
+// content converts the message to the content of Open Platform message, which is a json string.
+func (a *app) content(ctx context.Context, msg *botMessage) (string, cdk.Result) {
+	var v interface{}
+	switch msg.MsgType {
+	case textMessage:
+		v = map[string]string{"text": msg.Content.Text}
+	case postMessage:
+		v = msg.Content.Post
+	case shareChatMessage:
+		v = map[string]string{"chat_id": msg.Content.ShareChatID}
+	case imageMessage:
+		key, result := a.imageKey(ctx, msg.Content.ImageKey)
+		if result != cdk.SuccessResult {
+			return "", result
+		}
+		v = map[string]string{"image_key": key}
+	case interactiveMessage:
+		v = msg.Card
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", cdk.NewResult(http.StatusBadRequest, "event parse error:"+err.Error())
+	}
+	return string(data), cdk.SuccessResult
+}
+
+// imageKey returns the image_key of the image, the image is an image_key, a URL or base64 data,
+// the image is uploaded unless it's an image_key.
+func (a *app) imageKey(ctx context.Context, image string) (string, cdk.Result) {
+	image = strings.TrimSpace(image)
+	var (
+		data []byte
+		err  error
+	)
+	switch {
+	case strings.HasPrefix(image, "img_"):
+		return image, cdk.SuccessResult
+	case strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "https://"):
+		var result cdk.Result
+		if data, result = a.downloadImage(ctx, image); result != cdk.SuccessResult {
+			return "", result
+		}
+	default:
+		// strip the prefix of data URL, e.g. data:image/png;base64,
+		if idx := strings.Index(image, ";base64,"); idx >= 0 && strings.HasPrefix(image, "data:") {
+			image = image[idx+len(";base64,"):]
+		}
+		data, err = base64.StdEncoding.DecodeString(image)
+		if err != nil {
+			return "", cdk.NewResult(http.StatusBadRequest, "feishu: the image must be an image_key, url or base64 data")
+		}
+		if len(data) > maxImageSize {
+			return "", errImageTooLarge
+		}
+	}
+
+	var resp struct {
+		ImageKey string `json:"image_key"`
+	}
+	err = a.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetFormData(map[string]string{"image_type": "message"}).
+			SetFileReader("image", "image", bytes.NewReader(data)).
+			Post(a.cfg.Endpoint + "/open-apis/im/v1/images")
+	}, &resp)
+	if err != nil {
+		return "", errorResult(err)
+	}
+	return resp.ImageKey, cdk.SuccessResult
+}
+
+// downloadImage downloads the image of the url, it must be an image no larger than the limit
+// of Feishu, so a wrong url doesn't read a large body into memory.
+func (a *app) downloadImage(ctx context.Context, url string) ([]byte, cdk.Result) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, cdk.NewResult(http.StatusBadRequest, "feishu: invalid image url: "+err.Error())
+	}
+	res, err := a.imageClient.Do(req)
+	if err != nil {
+		return nil, cdk.NewResult(http.StatusInternalServerError, "feishu: download image error: "+err.Error())
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode >= http.StatusInternalServerError:
+		return nil, cdk.NewResult(http.StatusInternalServerError, "feishu: download image error: "+res.Status)
+	case res.StatusCode != http.StatusOK:
+		return nil, cdk.NewResult(http.StatusBadRequest, "feishu: download image error: "+res.Status)
+	}
+	if res.ContentLength > maxImageSize {
+		return nil, errImageTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxImageSize+1))
+	if err != nil {
+		return nil, cdk.NewResult(http.StatusInternalServerError, "feishu: download image error: "+err.Error())
+	}
+	if len(data) > maxImageSize {
+		return nil, errImageTooLarge
+	}
+	// some servers don't set the content type of images, so the data is sniffed.
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, cdk.NewResult(http.StatusBadRequest, "feishu: the url isn't an image, content type: "+contentType)
+	}
+	return data, cdk.SuccessResult
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog"
+
+	cdk "github.com/vanus-labs/cdk-go"
+)
+
+func TestDownloadImage(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n0000")
+	cases := []struct {
+		name        string
+		status      int
+		contentType string
+		body        []byte
+		// wantCode is 0 if the image is downloaded.
+		wantCode int
+	}{
+		{name: "image", status: http.StatusOK, contentType: "image/png", body: png},
+		{name: "sniffed image", status: http.StatusOK, contentType: "application/octet-stream", body: png},
+		{name: "not an image", status: http.StatusOK, contentType: "text/html", body: []byte("<html></html>"), wantCode: http.StatusBadRequest},
+		{name: "too large", status: http.StatusOK, contentType: "image/png", body: bytes.Repeat([]byte{0}, maxImageSize+1), wantCode: http.StatusBadRequest},
+		{name: "not found", status: http.StatusNotFound, contentType: "text/plain", wantCode: http.StatusBadRequest},
+		{name: "server error", status: http.StatusBadGateway, contentType: "text/plain", wantCode: http.StatusInternalServerError},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", c.contentType)
+				w.WriteHeader(c.status)
+				_, _ = w.Write(c.body)
+			}))
+			defer srv.Close()
+			a := &app{}
+			a.init(AppConfig{}, zerolog.Nop())
+			data, result := a.downloadImage(context.Background(), srv.URL)
+			if int(result.GetCode()) != c.wantCode {
+				t.Fatalf("got %d %s, want %d", result.GetCode(), result.GetMsg(), c.wantCode)
+			}
+			if result == cdk.SuccessResult && !bytes.Equal(data, c.body) {
+				t.Errorf("got %q, want %q", data, c.body)
+			}
+		})
+	}
+}
+
+func TestAppMaxRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/open-apis/auth/v3/tenant_access_token/internal" {
+			_, _ = w.Write([]byte(`{"code":0,"tenant_access_token":"t","expire":7200}`))
+			return
+		}
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	zero, one := 0, 1
+	cases := []struct {
+		maxRetries *int
+		wantCalls  int32
+	}{
+		{maxRetries: &zero, wantCalls: 1},
+		{maxRetries: &one, wantCalls: 2},
+		{wantCalls: 1 + defaultMaxRetries},
+	}
+	for _, c := range cases {
+		cfg := AppConfig{AppID: "id", AppSecret: "secret", Endpoint: srv.URL, MaxRetries: c.maxRetries, RetryBackoff: 1}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		a := &app{httpClient: resty.New()}
+		a.init(cfg, zerolog.Nop())
+		atomic.StoreInt32(&calls, 0)
+		err := a.do(context.Background(), func(r *resty.Request) (*resty.Response, error) {
+			return r.Post(srv.URL + "/open-apis/im/v1/messages")
+		}, nil)
+		if err == nil {
+			t.Fatal("want error for status 502")
+		}
+		if n := atomic.LoadInt32(&calls); n != c.wantCalls {
+			t.Errorf("max_retries %d: got %d calls, want %d", *cfg.MaxRetries, n, c.wantCalls)
+		}
+	}
+
+	negative := -1
+	cfg := AppConfig{AppID: "id", AppSecret: "secret", MaxRetries: &negative}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("want error for negative max_retries")
+	}
+}
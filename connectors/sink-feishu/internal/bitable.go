@@ -0,0 +1,180 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	v2 "github.com/cloudevents/sdk-go/v2"
+	"github.com/go-resty/resty/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	cdk "github.com/vanus-labs/cdk-go"
+)
+
+const (
+	xBitableTable = "xvfeishubitabletable"
+)
+
+var (
+	errNoBitableTable = cdk.NewResult(http.StatusBadRequest, "feishu: no bitable table found, please check "+
+		"xvfeishubitabletable in attributes or bitable.table_id in config")
+	errInvalidRecord = cdk.NewResult(http.StatusBadRequest, "feishu: the data of bitable record must be a json object")
+)
+
+type BitableConfig struct {
+	AppToken string `json:"app_token" yaml:"app_token" validate:"required"`
+	TableID  string `json:"table_id" yaml:"table_id"`
+	// KeyField is the field to find the record to update, the records are always created if it's empty.
+	KeyField string `json:"key_field" yaml:"key_field"`
+}
+
+func (c *BitableConfig) Validate() error {
+	if c.AppToken == "" {
+		return errors.New("the bitable.app_token can't be empty")
+	}
+	return nil
+}
+
+// bitable writes the records of Bitable with the tenant_access_token of the app.
+type bitable struct {
+	cfg    BitableConfig
+	app    *app
+	logger zerolog.Logger
+}
+
+func (b *bitable) init(cfg BitableConfig, app *app, logger zerolog.Logger) {
+	b.cfg = cfg
+	b.app = app
+	b.logger = logger
+}
+
+type bitableRecord struct {
+	RecordID string                 `json:"record_id,omitempty"`
+	Fields   map[string]interface{} `json:"fields"`
+}
+
+// writeRecords writes the records of the events one by one in order, so the updates of a record
+// are applied in order.
+func (b *bitable) writeRecords(ctx context.Context, events []*v2.Event) cdk.Result {
+	for _, e := range events {
+		if result := b.writeRecord(ctx, e); result != cdk.SuccessResult {
+			return result
+		}
+	}
+	return cdk.SuccessResult
+}
+
+func (b *bitable) writeRecord(ctx context.Context, e *v2.Event) cdk.Result {
+	tableID, ok := e.Extensions()[xBitableTable].(string)
+	if !ok {
+		tableID = b.cfg.TableID
+	}
+	if tableID == "" {
+		return errNoBitableTable
+	}
+	var fields map[string]interface{}
+	// keep the numbers as they are, so a numeric key is searched as it's written.
+	decoder := json.NewDecoder(bytes.NewReader(e.Data()))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil || fields == nil {
+		return errInvalidRecord
+	}
+
+	var recordID string
+	if b.cfg.KeyField != "" {
+		key, ok := fields[b.cfg.KeyField]
+		if !ok || key == nil {
+			return cdk.NewResult(http.StatusBadRequest,
+				fmt.Sprintf("feishu: the key field %s of bitable record is missing", b.cfg.KeyField))
+		}
+		var err error
+		recordID, err = b.searchRecord(ctx, tableID, fmt.Sprint(key))
+		if err != nil {
+			return errorResult(err)
+		}
+	}
+
+	path := b.app.cfg.Endpoint + "/open-apis/bitable/v1/apps/{app_token}/tables/{table_id}/records"
+	err := b.app.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		r.SetPathParams(map[string]string{
+			"app_token": b.cfg.AppToken,
+			"table_id":  tableID,
+		}).SetBody(&bitableRecord{Fields: fields})
+		if recordID == "" {
+			// the client_token makes feishu create the record of a retried or redelivered
+			// event only once.
+			return r.SetQueryParam("client_token", clientToken(e, tableID)).Post(path)
+		}
+		return r.SetPathParam("record_id", recordID).Put(path + "/{record_id}")
+	}, nil)
+	if err != nil {
+		return errorResult(err)
+	}
+	b.logger.Info().Str("event_id", e.ID()).Str("table_id", tableID).
+		Str("record_id", recordID).Msg("success write record to feishu bitable")
+	return cdk.SuccessResult
+}
+
+// clientToken returns the uuid v4 derived from the event and the table, feishu requires the
+// client_token to be a uuid v4.
+func clientToken(e *v2.Event, tableID string) string {
+	sum := sha256.Sum256([]byte(e.Source() + "\x00" + e.ID() + "\x00" + tableID))
+	var token uuid.UUID
+	copy(token[:], sum[:])
+	token[6] = token[6]&0x0f | 0x40
+	token[8] = token[8]&0x3f | 0x80
+	return token.String()
+}
+
+// searchRecord returns the ID of the record whose key field is the key, it returns empty if no
+// record is found.
+func (b *bitable) searchRecord(ctx context.Context, tableID, key string) (string, error) {
+	var resp struct {
+		Items []bitableRecord `json:"items"`
+	}
+	err := b.app.do(ctx, func(r *resty.Request) (*resty.Response, error) {
+		return r.SetPathParams(map[string]string{
+			"app_token": b.cfg.AppToken,
+			"table_id":  tableID,
+		}).SetQueryParam("page_size", "1").
+			SetBody(map[string]interface{}{
+				"field_names": []string{b.cfg.KeyField},
+				"filter": map[string]interface{}{
+					"conjunction": "and",
+					"conditions": []map[string]interface{}{{
+						"field_name": b.cfg.KeyField,
+						"operator":   "is",
+						"value":      []string{key},
+					}},
+				},
+			}).
+			Post(b.app.cfg.Endpoint + "/open-apis/bitable/v1/apps/{app_token}/tables/{table_id}/records/search")
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Items) == 0 {
+		return "", nil
+	}
+	return resp.Items[0].RecordID, nil
+}
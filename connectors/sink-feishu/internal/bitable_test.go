@@ -0,0 +1,168 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	v2 "github.com/cloudevents/sdk-go/v2"
+	"github.com/go-resty/resty/v2"
+	"github.com/rs/zerolog"
+
+	cdk "github.com/vanus-labs/cdk-go"
+)
+
+const recordsPath = "/open-apis/bitable/v1/apps/app/tables/tbl/records"
+
+var uuidV4 = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// bitableRequest is a request received by the bitable API.
+type bitableRequest struct {
+	method      string
+	path        string
+	clientToken string
+	body        map[string]interface{}
+}
+
+// bitableAPI starts the Open Platform which calls handle with the requests except the token ones.
+func bitableAPI(t *testing.T, handle func(req bitableRequest) string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/open-apis/auth/v3/tenant_access_token/internal" {
+			_, _ = w.Write([]byte(`{"code":0,"tenant_access_token":"t","expire":7200}`))
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		req := bitableRequest{method: r.Method, path: r.URL.Path, clientToken: r.URL.Query().Get("client_token")}
+		if err := json.Unmarshal(data, &req.body); err != nil {
+			t.Errorf("invalid body %s", data)
+		}
+		_, _ = w.Write([]byte(handle(req)))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func newTestBitable(t *testing.T, endpoint, keyField string) *bitable {
+	appCfg := AppConfig{AppID: "id", AppSecret: "secret", Endpoint: endpoint, RetryBackoff: 1}
+	if err := appCfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	a := &app{httpClient: resty.New()}
+	a.init(appCfg, zerolog.Nop())
+	b := &bitable{}
+	b.init(BitableConfig{AppToken: "app", TableID: "tbl", KeyField: keyField}, a, zerolog.Nop())
+	return b
+}
+
+func recordEvent(id, data string) *v2.Event {
+	e := v2.NewEvent()
+	e.SetID(id)
+	e.SetSource("test")
+	e.SetType("test")
+	_ = e.SetData(v2.ApplicationJSON, []byte(data))
+	return &e
+}
+
+func TestWriteRecordUpdatesFoundRecord(t *testing.T) {
+	var requests []bitableRequest
+	endpoint := bitableAPI(t, func(req bitableRequest) string {
+		requests = append(requests, req)
+		if req.path == recordsPath+"/search" {
+			return `{"code":0,"data":{"items":[{"record_id":"rec1","fields":{}}]}}`
+		}
+		return `{"code":0,"data":{}}`
+	})
+	b := newTestBitable(t, endpoint, "order")
+	if result := b.writeRecord(context.Background(), recordEvent("1", `{"order":10,"state":"paid"}`)); result != cdk.SuccessResult {
+		t.Fatalf("got %s", result.GetMsg())
+	}
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests, want search and update", len(requests))
+	}
+	// the numeric key is searched as it's written.
+	conditions := requests[0].body["filter"].(map[string]interface{})["conditions"].([]interface{})
+	value := conditions[0].(map[string]interface{})["value"].([]interface{})
+	if requests[0].method != http.MethodPost || value[0] != "10" {
+		t.Fatalf("got search %s %v", requests[0].method, requests[0].body)
+	}
+	update := requests[1]
+	if update.method != http.MethodPut || update.path != recordsPath+"/rec1" || update.clientToken != "" {
+		t.Fatalf("got %s %s with client_token %q, want update of rec1", update.method, update.path, update.clientToken)
+	}
+	if fields := update.body["fields"].(map[string]interface{}); fields["state"] != "paid" {
+		t.Fatalf("got fields %v", fields)
+	}
+}
+
+func TestWriteRecordCreatesMissingRecord(t *testing.T) {
+	var creates []bitableRequest
+	failures := 1
+	endpoint := bitableAPI(t, func(req bitableRequest) string {
+		if req.path == recordsPath+"/search" {
+			return `{"code":0,"data":{"items":[]}}`
+		}
+		creates = append(creates, req)
+		if failures > 0 {
+			// the record may be created though the call is failed, the retry must not create it again.
+			failures--
+			return `{"code":99991400,"msg":"request trigger frequency limit"}`
+		}
+		return `{"code":0,"data":{}}`
+	})
+	b := newTestBitable(t, endpoint, "order")
+	e := recordEvent("1", `{"order":10}`)
+	if result := b.writeRecord(context.Background(), e); result != cdk.SuccessResult {
+		t.Fatalf("got %s", result.GetMsg())
+	}
+	if result := b.writeRecord(context.Background(), recordEvent("2", `{"order":11}`)); result != cdk.SuccessResult {
+		t.Fatalf("got %s", result.GetMsg())
+	}
+	if len(creates) != 3 {
+		t.Fatalf("got %d creates, want 3", len(creates))
+	}
+	for _, req := range creates {
+		if req.method != http.MethodPost || req.path != recordsPath || !uuidV4.MatchString(req.clientToken) {
+			t.Fatalf("got %s %s with client_token %q", req.method, req.path, req.clientToken)
+		}
+	}
+	if creates[0].clientToken != creates[1].clientToken {
+		t.Fatalf("the retry has client_token %s, want %s", creates[1].clientToken, creates[0].clientToken)
+	}
+	if creates[1].clientToken == creates[2].clientToken {
+		t.Fatal("the events have the same client_token")
+	}
+	if creates[0].clientToken != clientToken(e, "tbl") {
+		t.Fatal("the client_token of a redelivered event is changed")
+	}
+}
+
+func TestWriteRecordRequiresKeyField(t *testing.T) {
+	endpoint := bitableAPI(t, func(req bitableRequest) string {
+		t.Errorf("unexpected request %s %s", req.method, req.path)
+		return `{"code":0}`
+	})
+	b := newTestBitable(t, endpoint, "order")
+	for _, data := range []string{`{"state":"paid"}`, `{"order":null}`, `[1]`} {
+		if result := b.writeRecord(context.Background(), recordEvent("1", data)); int(result.GetCode()) != http.StatusBadRequest {
+			t.Errorf("%s: got %d %s, want 400", data, result.GetCode(), result.GetMsg())
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package internal
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -28,9 +29,11 @@ import (
 	v2 "github.com/cloudevents/sdk-go/v2"
 	"github.com/go-resty/resty/v2"
 	"github.com/rs/zerolog"
+	"golang.org/x/time/rate"
 
 	cdk "github.com/vanus-labs/cdk-go"
 	"github.com/vanus-labs/cdk-go/connector"
+	"github.com/vanus-labs/connector/internal/keyed"
 )
 
 type messageType string
@@ -41,6 +44,18 @@ const (
 	xBotURL       = "xvfeishuboturls"
 	xBotSignature = "xvfeishubotsigns"
 
+	// the codes of throttled requests.
+	codeTooManyRequests  = 9499
+	codeFrequencyLimited = 11232
+
+	defaultRateLimit    = 100
+	defaultBurst        = 5
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 1000
+	// webhookIdleTimeout releases the rate limiter of a webhook which isn't used, it's far
+	// longer than the limiter takes to recover.
+	webhookIdleTimeout = 10 * time.Minute
+
 	textMessage        = messageType("text")
 	postMessage        = messageType("post")
 	shareChatMessage   = messageType("share_chat")
@@ -64,12 +79,20 @@ type bot struct {
 	cm         map[string]WebHook
 	httpClient *resty.Client
 	logger     zerolog.Logger
+	// images uploads the images of image messages, it's nil if the app isn't configured.
+	images *app
+	// webhooks serializes the messages to each webhook, so they are delivered in order, and
+	// limits the rate of them.
+	webhooks *keyed.Queues[*rate.Limiter]
 }
 
 func (b *bot) init(cfg BotConfig, logger zerolog.Logger) error {
 	b.logger = logger
 	b.cfg = cfg
 	b.cm = make(map[string]WebHook, len(cfg.Webhooks))
+	b.webhooks = keyed.NewQueues(webhookIdleTimeout, func(string) *rate.Limiter {
+		return rate.NewLimiter(rate.Every(time.Minute/time.Duration(cfg.RateLimit)), cfg.Burst)
+	})
 	for _, wh := range cfg.Webhooks {
 		_, exist := b.cm[wh.ChatGroup]
 		if exist {
@@ -90,9 +113,34 @@ type BotConfig struct {
 	Webhooks     []WebHook `json:"webhooks" yaml:"webhooks" validate:"dive"`
 	Default      string    `json:"default" yaml:"default"`
 	DynamicRoute bool      `json:"dynamic_route" yaml:"dynamic_route"`
+	// RateLimit is the max number of messages per minute to a webhook.
+	RateLimit int `json:"rate_limit" yaml:"rate_limit"`
+	// Burst is the max number of messages sent to a webhook at once.
+	Burst int `json:"burst" yaml:"burst"`
+	// MaxRetries is the max retry times of a throttled or failed message, 0 means no retry, and
+	// it's 3 if it's not set.
+	MaxRetries *int `json:"max_retries" yaml:"max_retries"`
+	// RetryBackoff is the backoff in millisecond of the first retry, it's doubled for each retry.
+	RetryBackoff int `json:"retry_backoff" yaml:"retry_backoff"`
 }
 
 func (c *BotConfig) Validate() error {
+	if c.RateLimit < 0 || c.Burst < 0 || (c.MaxRetries != nil && *c.MaxRetries < 0) || c.RetryBackoff < 0 {
+		return errors.New("the bot.rate_limit, bot.burst, bot.max_retries and bot.retry_backoff can't be negative")
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = defaultRateLimit
+	}
+	if c.Burst == 0 {
+		c.Burst = defaultBurst
+	}
+	if c.MaxRetries == nil {
+		maxRetries := defaultMaxRetries
+		c.MaxRetries = &maxRetries
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultRetryBackoff
+	}
 	if !c.DynamicRoute && len(c.Webhooks) == 0 {
 		return errors.New("the bot.webhooks can't be empty when dynamic_route is false")
 	}
@@ -111,7 +159,54 @@ func (c *BotConfig) Validate() error {
 	return nil
 }
 
-func (b *bot) sendMessage(e *v2.Event) cdk.Result {
+// delivery is a message of an event to a webhook.
+type delivery struct {
+	event   *v2.Event
+	webhook WebHook
+	msg     *botMessage
+}
+
+// sendMessages sends the messages of the events, the messages to a webhook are sent in the
+// order of the events, and the messages to different webhooks are sent concurrently.
+func (b *bot) sendMessages(ctx context.Context, events []*v2.Event) cdk.Result {
+	var queues keyed.Group[delivery]
+	for _, e := range events {
+		whs, result := b.getWebhooks(e)
+		if result != cdk.SuccessResult {
+			return result
+		}
+		t, ok := e.Extensions()[xMessageType].(string)
+		if !ok {
+			t = string(textMessage)
+		}
+		botMsg, err := event2BotMessage(e, messageType(t))
+		if err != nil {
+			return cdk.NewResult(http.StatusBadRequest, "event parse error:"+err.Error())
+		}
+		if botMsg.MsgType == imageMessage && b.images != nil {
+			// the bot can't upload images, so the image is uploaded by the app if it's configured.
+			key, result := b.images.imageKey(ctx, botMsg.Content.ImageKey)
+			if result != cdk.SuccessResult {
+				return result
+			}
+			botMsg.Content.ImageKey = key
+		}
+		for _, wh := range whs {
+			queues.Add(wh.URL, delivery{event: e, webhook: wh, msg: botMsg})
+		}
+	}
+	results := keyed.Each(&queues, func(url string, deliveries []delivery) cdk.Result {
+		return b.deliverAll(ctx, url, deliveries)
+	})
+	for _, result := range results {
+		if result != cdk.SuccessResult {
+			return result
+		}
+	}
+	return cdk.SuccessResult
+}
+
+func (b *bot) getWebhooks(e *v2.Event) ([]WebHook, cdk.Result) {
 	var (
 		whs     []WebHook
 		groupID string
@@ -121,7 +216,7 @@ func (b *bot) sendMessage(e *v2.Event) cdk.Result {
 		wh, exist := b.cm[groupID]
 		if !exist {
 			if !b.cfg.DynamicRoute {
-				return errChatGroup
+				return nil, errChatGroup
 			}
 		} else {
 			whs = append(whs, wh)
@@ -135,16 +230,16 @@ func (b *bot) sendMessage(e *v2.Event) cdk.Result {
 	if b.cfg.DynamicRoute {
 		urlAttr, ok := e.Extensions()[xBotURL].(string)
 		if !ok {
-			return errInvalidAttributes
+			return nil, errInvalidAttributes
 		}
 		signatureAttr, ok := e.Extensions()[xBotSignature].(string)
 		if !ok {
-			return errInvalidAttributes
+			return nil, errInvalidAttributes
 		}
 		urls := strings.Split(urlAttr, ",")
 		signatures := strings.Split(signatureAttr, ",")
 		if len(urls) != len(signatures) {
-			return errInvalidAttributeNumber
+			return nil, errInvalidAttributeNumber
 		}
 		for idx := range urls {
 			whs = append(whs, WebHook{
@@ -154,38 +249,64 @@ func (b *bot) sendMessage(e *v2.Event) cdk.Result {
 		}
 	}
 	if len(whs) == 0 {
-		return errNoBotWebhookFound
+		return nil, errNoBotWebhookFound
 	}
+	return whs, cdk.SuccessResult
+}
 
-	t, ok := e.Extensions()[xMessageType].(string)
-	if !ok {
-		t = string(textMessage)
-	}
-	botMsg, err := b.event2BotMessage(e, messageType(t))
-	if err != nil {
-		return cdk.NewResult(http.StatusBadRequest, "event parse error:"+err.Error())
-	}
-	now := time.Now().Unix()
-	for _, wh := range whs {
-		if wh.Signature != "" {
-			botMsg.Timestamp = &now
-			botMsg.Sign = b.genSignature(now, wh.Signature)
-		} else {
-			botMsg.Timestamp = nil
-			botMsg.Sign = ""
-		}
-		res, err := b.httpClient.R().SetBody(botMsg).Post(wh.URL)
-		if err != nil {
-			return cdk.NewResult(http.StatusInternalServerError, "call feishu error: "+err.Error())
+// deliverAll sends the messages to a webhook in order, it stops at the first failure, so a
+// message is never delivered before the ones ahead of it.
+func (b *bot) deliverAll(ctx context.Context, url string, deliveries []delivery) cdk.Result {
+	result := cdk.SuccessResult
+	b.webhooks.Do(url, func(limiter *rate.Limiter) {
+		for _, d := range deliveries {
+			if result = b.deliver(ctx, limiter, d); result != cdk.SuccessResult {
+				return
+			}
 		}
-		if code, err := b.processResponse(e, res); err != nil {
-			return cdk.NewResult(connector.Code(code), "call feishu response error:"+err.Error())
+	})
+	return result
+}
+
+func (b *bot) deliver(ctx context.Context, limiter *rate.Limiter, d delivery) cdk.Result {
+	logger := b.logger.With().Str("event_id", d.event.ID()).Logger()
+	backoff := time.Duration(b.cfg.RetryBackoff) * time.Millisecond
+	code, err := retry(ctx, logger, *b.cfg.MaxRetries, backoff, func() (int, bool, error) {
+		if err := limiter.Wait(ctx); err != nil {
+			return http.StatusInternalServerError, false, fmt.Errorf("wait rate limit error: %w", err)
 		}
+		return b.post(ctx, d)
+	})
+	if err != nil {
+		return cdk.NewResult(connector.Code(code), "call feishu response error:"+err.Error())
 	}
 	return cdk.SuccessResult
 }
 
-func (b *bot) event2BotMessage(e *v2.Event, msgType messageType) (*botMessage, error) {
+// post sends the message, it returns the status code and whether the error is retryable.
+func (b *bot) post(ctx context.Context, d delivery) (int, bool, error) {
+	// the message is shared by webhooks, so the signature is set on a copy.
+	botMsg := *d.msg
+	if d.webhook.Signature != "" {
+		now := time.Now().Unix()
+		botMsg.Timestamp = &now
+		botMsg.Sign = b.genSignature(now, d.webhook.Signature)
+	} else {
+		botMsg.Timestamp = nil
+		botMsg.Sign = ""
+	}
+	res, err := b.httpClient.R().SetContext(ctx).SetBody(&botMsg).Post(d.webhook.URL)
+	if err != nil {
+		return http.StatusInternalServerError, ctx.Err() == nil, err
+	}
+	if res.StatusCode() >= http.StatusInternalServerError {
+		return res.StatusCode(), true, fmt.Errorf("failed to call feishu: %s %s", res.Status(), string(res.Body()))
+	}
+	code, err := b.processResponse(d.event, res)
+	return code, code == http.StatusTooManyRequests, err
+}
+
+func event2BotMessage(e *v2.Event, msgType messageType) (*botMessage, error) {
 	msg := &botMessage{
 		MsgType: msgType,
 	}
@@ -294,7 +415,7 @@ func (b *bot) processResponse(e *v2.Event, res *resty.Response) (int, error) {
 	}
 	var code int
 	switch resp.Code {
-	case 9499:
+	case codeTooManyRequests, codeFrequencyLimited:
 		code = http.StatusTooManyRequests
 	default:
 		code = http.StatusBadRequest
@@ -0,0 +1,48 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// call is a request to feishu, it returns the status code and whether the error is retryable.
+type call func() (int, bool, error)
+
+// retry calls fn until it succeeds, the error isn't retryable or the retries are exhausted. The
+// backoff is doubled for each retry.
+func retry(ctx context.Context, logger zerolog.Logger, maxRetries int, backoff time.Duration, fn call) (int, error) {
+	for attempt := 0; ; attempt++ {
+		code, retryable, err := fn()
+		if err == nil {
+			return code, nil
+		}
+		if !retryable || attempt >= maxRetries {
+			return code, err
+		}
+		logger.Info().Err(err).Int("attempt", attempt+1).
+			Dur("backoff", backoff).Msg("call feishu failed, will retry")
+		select {
+		case <-ctx.Done():
+			return http.StatusInternalServerError, err
+		case <-time.After(backoff):
+		}
+		backoff <<= 1
+	}
+}
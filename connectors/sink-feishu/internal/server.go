@@ -28,15 +28,15 @@ import (
 )
 
 const (
-	botService = "bot"
+	botService     = "bot"
+	appService     = "app"
+	bitableService = "bitable"
 
 	name                      = "Feishu Sink"
 	vanceServiceNameAttribute = "xvfeishuservice"
 )
 
 var (
-	errFeishuSinkWrongEventNumber = cdkgo.NewResult(http.StatusBadRequest,
-		"feishu: the event number must be 1")
 	errFeishuSinkEventMissingServiceName = cdkgo.NewResult(http.StatusBadRequest,
 		"feishu: missing or invalid service name, please check xvfeishuservice in attributes")
 	errFeishuSinkUnsupportedService = cdkgo.NewResult(http.StatusBadRequest, "feishu: unsupported service")
@@ -49,12 +49,32 @@ type Secret struct {
 
 type feishuConfig struct {
 	cdkgo.SinkConfig `json:",inline" yaml:",inline"`
-	Bot              BotConfig `json:"bot" yaml:"bot"`
+	Bot              *BotConfig     `json:"bot" yaml:"bot"`
+	App              *AppConfig     `json:"app" yaml:"app"`
+	Bitable          *BitableConfig `json:"bitable" yaml:"bitable"`
 }
 
 func (fc *feishuConfig) Validate() error {
-	if err := fc.Bot.Validate(); err != nil {
-		return err
+	if fc.Bot == nil && fc.App == nil {
+		return errors.New("feishu: at least one of bot and app must be configured")
+	}
+	if fc.Bot != nil {
+		if err := fc.Bot.Validate(); err != nil {
+			return err
+		}
+	}
+	if fc.App != nil {
+		if err := fc.App.Validate(); err != nil {
+			return err
+		}
+	}
+	if fc.Bitable != nil {
+		if fc.App == nil {
+			return errors.New("feishu: the app must be configured to write bitable")
+		}
+		if err := fc.Bitable.Validate(); err != nil {
+			return err
+		}
 	}
 	return fc.SinkConfig.Validate()
 }
@@ -64,10 +84,15 @@ func NewConfig() cdkgo.SinkConfigAccessor {
 }
 
 func NewFeishuSink() cdkgo.Sink {
+	httpClient := resty.New()
 	return &feishuSink{
 		b: &bot{
-			httpClient: resty.New(),
+			httpClient: httpClient,
+		},
+		a: &app{
+			httpClient: httpClient,
 		},
+		bt: &bitable{},
 	}
 }
 
@@ -77,18 +102,73 @@ type feishuSink struct {
 	cfg   *feishuConfig
 	count int64
 	b     *bot
+	a     *app
+	bt    *bitable
 }
 
-func (f *feishuSink) Arrived(_ context.Context, events ...*v2.Event) cdkgo.Result {
-	// optimize(wenfeng) give an argument to control if this sink support batch?
-	if len(events) != 1 {
-		return errFeishuSinkWrongEventNumber
+func (f *feishuSink) Arrived(ctx context.Context, events ...*v2.Event) cdkgo.Result {
+	if len(events) == 0 {
+		return cdkgo.SuccessResult
 	}
-
 	atomic.AddInt64(&f.count, int64(len(events)))
-	e := events[0]
+	// the consecutive events of a service are sent together, and the services are called in the
+	// order of the events.
+	for len(events) > 0 {
+		service, result := f.service(events[0])
+		if result != cdkgo.SuccessResult {
+			return result
+		}
+		n := 1
+		for ; n < len(events); n++ {
+			s, result := f.service(events[n])
+			if result != cdkgo.SuccessResult {
+				return result
+			}
+			if s != service {
+				break
+			}
+		}
+		switch service {
+		case botService:
+			result = f.b.sendMessages(ctx, events[:n])
+		case appService:
+			result = f.a.sendMessages(ctx, events[:n])
+		case bitableService:
+			result = f.bt.writeRecords(ctx, events[:n])
+		}
+		if result != cdkgo.SuccessResult {
+			return result
+		}
+		events = events[n:]
+	}
+	return cdkgo.SuccessResult
+}
 
-	return f.b.sendMessage(e)
+// service returns the service of the event, the default service is the first configured one of
+// the bot, bitable and app.
+func (f *feishuSink) service(e *v2.Event) (string, cdkgo.Result) {
+	service, ok := e.Extensions()[vanceServiceNameAttribute]
+	if !ok {
+		switch {
+		case f.cfg.Bot != nil:
+			return botService, cdkgo.SuccessResult
+		case f.cfg.Bitable != nil:
+			return bitableService, cdkgo.SuccessResult
+		}
+		return appService, cdkgo.SuccessResult
+	}
+	s, ok := service.(string)
+	if !ok {
+		return "", errFeishuSinkEventMissingServiceName
+	}
+	switch {
+	case s == botService && f.cfg.Bot != nil:
+	case s == appService && f.cfg.App != nil:
+	case s == bitableService && f.cfg.Bitable != nil:
+	default:
+		return "", errFeishuSinkUnsupportedService
+	}
+	return s, cdkgo.SuccessResult
 }
 
 func (f *feishuSink) Initialize(ctx context.Context, cfg cdkgo.ConfigAccessor) error {
@@ -99,7 +179,17 @@ func (f *feishuSink) Initialize(ctx context.Context, cfg cdkgo.ConfigAccessor) e
 	}
 
 	f.cfg = _cfg
-	return f.b.init(_cfg.Bot, logger)
+	if _cfg.App != nil {
+		f.a.init(*_cfg.App, logger)
+		f.b.images = f.a
+	}
+	if _cfg.Bitable != nil {
+		f.bt.init(*_cfg.Bitable, f.a, logger)
+	}
+	if _cfg.Bot != nil {
+		return f.b.init(*_cfg.Bot, logger)
+	}
+	return nil
 }
 
 func (f *feishuSink) Name() string {
@@ -0,0 +1,155 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	cetypes "github.com/cloudevents/sdk-go/v2/types"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	attributePrefix    = "xv"
+	attributeOperation = attributePrefix + "operation"
+	attributePatchType = attributePrefix + "patchtype"
+	attributeDryRun    = attributePrefix + "dryrun"
+	attributeWait      = attributePrefix + "wait"
+	// attributes of the target of a json patch, whose data isn't an object.
+	attributeAPIVersion = attributePrefix + "apiversion"
+	attributeKind       = attributePrefix + "kind"
+	attributeName       = attributePrefix + "name"
+	attributeNamespace  = attributePrefix + "namespace"
+
+	// annotationOperation is the operation in the resource, it's kept for compatibility.
+	annotationOperation = "operation"
+)
+
+type PatchType string
+
+const (
+	PatchMerge     PatchType = "merge"
+	PatchStrategic PatchType = "strategic"
+	PatchJSON      PatchType = "json"
+)
+
+func (t PatchType) contentType() (types.PatchType, error) {
+	switch t {
+	case "", PatchMerge:
+		return types.MergePatchType, nil
+	case PatchStrategic:
+		return types.StrategicMergePatchType, nil
+	case PatchJSON:
+		return types.JSONPatchType, nil
+	}
+	return "", fmt.Errorf("unknown patch type %s", t)
+}
+
+// request is the operation of an event on a resource.
+type request struct {
+	operation KubernetesResourceOperation
+	patchType types.PatchType
+	patch     []byte
+	dryRun    bool
+	wait      bool
+}
+
+func getAttr(event *ce.Event, key string) string {
+	val, ok := event.Extensions()[key]
+	if !ok {
+		return ""
+	}
+	str, _ := cetypes.ToString(val)
+	return str
+}
+
+// newRequest gets the operation and the options from the event attributes, the operation is
+// empty if the event has no extension, it's resolved by resolveOperation.
+func (s *k8sSink) newRequest(event *ce.Event) (*request, error) {
+	req := &request{
+		operation: KubernetesResourceOperation(getAttr(event, attributeOperation)),
+		dryRun:    s.cfg.DryRun,
+		wait:      s.cfg.Wait.Enabled,
+	}
+	for key, value := range map[string]*bool{
+		attributeDryRun: &req.dryRun,
+		attributeWait:   &req.wait,
+	} {
+		v := getAttr(event, key)
+		if v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attribute %s=%s", key, v)
+		}
+		*value = b
+	}
+	return req, nil
+}
+
+// resolveOperation takes the operation from the annotation of the resource, or the default
+// one, if the event has no extension, and then sets the patch type of a patch, so it's set
+// however the operation is picked. The resource is nil if it's the target of a json patch.
+func (s *k8sSink) resolveOperation(req *request, event *ce.Event, obj *unstructured.Unstructured) error {
+	if req.operation == "" {
+		req.operation = s.cfg.DefaultOperation
+		if obj != nil {
+			if op, ok := obj.GetAnnotations()[annotationOperation]; ok {
+				req.operation = KubernetesResourceOperation(op)
+			}
+		}
+	}
+	if req.operation != Patch {
+		return nil
+	}
+	pt, err := PatchType(getAttr(event, attributePatchType)).contentType()
+	if err != nil {
+		return err
+	}
+	if pt == types.JSONPatchType && obj != nil {
+		return fmt.Errorf("json patch requires the attribute %s=%s", attributeOperation, Patch)
+	}
+	req.patchType = pt
+	return nil
+}
+
+// isJSONPatch reports whether the event data is a json patch, whose target is set by the
+// attributes since the data isn't a resource.
+func isJSONPatch(event *ce.Event) bool {
+	return KubernetesResourceOperation(getAttr(event, attributeOperation)) == Patch &&
+		PatchType(getAttr(event, attributePatchType)) == PatchJSON
+}
+
+// jsonPatchTarget returns the target of a json patch from the event attributes.
+func jsonPatchTarget(event *ce.Event) (*unstructured.Unstructured, error) {
+	if !json.Valid(event.Data()) {
+		return nil, fmt.Errorf("json patch is invalid json")
+	}
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(getAttr(event, attributeAPIVersion))
+	obj.SetKind(getAttr(event, attributeKind))
+	obj.SetName(getAttr(event, attributeName))
+	obj.SetNamespace(getAttr(event, attributeNamespace))
+	if obj.GetAPIVersion() == "" || obj.GetKind() == "" || obj.GetName() == "" {
+		return nil, fmt.Errorf("attributes %s, %s and %s are required by json patch",
+			attributeAPIVersion, attributeKind, attributeName)
+	}
+	return obj, nil
+}
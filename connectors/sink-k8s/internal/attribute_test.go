@@ -0,0 +1,131 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestResolveOperation(t *testing.T) {
+	cases := []struct {
+		name             string
+		defaultOperation KubernetesResourceOperation
+		attributes       map[string]string
+		annotation       string
+		jsonPatch        bool
+		wantOperation    KubernetesResourceOperation
+		wantPatchType    types.PatchType
+		wantErr          bool
+	}{
+		{
+			name:          "default",
+			wantOperation: Create,
+		},
+		{
+			name:             "default patch",
+			defaultOperation: Patch,
+			wantOperation:    Patch,
+			wantPatchType:    types.MergePatchType,
+		},
+		{
+			name:          "extension patch",
+			attributes:    map[string]string{attributeOperation: "patch"},
+			wantOperation: Patch,
+			wantPatchType: types.MergePatchType,
+		},
+		{
+			name:          "annotation patch",
+			annotation:    "patch",
+			wantOperation: Patch,
+			wantPatchType: types.MergePatchType,
+		},
+		{
+			name:          "annotation strategic patch",
+			attributes:    map[string]string{attributePatchType: "strategic"},
+			annotation:    "patch",
+			wantOperation: Patch,
+			wantPatchType: types.StrategicMergePatchType,
+		},
+		{
+			name:          "extension overrides annotation",
+			attributes:    map[string]string{attributeOperation: "apply", attributePatchType: "strategic"},
+			annotation:    "patch",
+			wantOperation: Apply,
+		},
+		{
+			name:          "json patch",
+			attributes:    map[string]string{attributeOperation: "patch", attributePatchType: "json"},
+			jsonPatch:     true,
+			wantOperation: Patch,
+			wantPatchType: types.JSONPatchType,
+		},
+		{
+			name:       "annotation json patch",
+			attributes: map[string]string{attributePatchType: "json"},
+			annotation: "patch",
+			wantErr:    true,
+		},
+		{
+			name:       "unknown patch type",
+			attributes: map[string]string{attributePatchType: "xml"},
+			annotation: "patch",
+			wantErr:    true,
+		},
+		{
+			name:       "invalid dry run",
+			attributes: map[string]string{attributeDryRun: "maybe"},
+			wantErr:    true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &k8sSink{cfg: &Config{DefaultOperation: c.defaultOperation}}
+			if s.cfg.DefaultOperation == "" {
+				s.cfg.DefaultOperation = defaultOperation
+			}
+			event := ce.NewEvent()
+			for k, v := range c.attributes {
+				event.SetExtension(k, v)
+			}
+			if got := isJSONPatch(&event); got != c.jsonPatch {
+				t.Fatalf("got json patch %t, want %t", got, c.jsonPatch)
+			}
+			var obj *unstructured.Unstructured
+			if !c.jsonPatch {
+				obj = &unstructured.Unstructured{Object: map[string]interface{}{}}
+				if c.annotation != "" {
+					obj.SetAnnotations(map[string]string{annotationOperation: c.annotation})
+				}
+			}
+			req, err := s.newRequest(&event)
+			if err == nil {
+				err = s.resolveOperation(req, &event, obj)
+			}
+			if (err != nil) != c.wantErr {
+				t.Fatalf("got error %v, want error %t", err, c.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if req.operation != c.wantOperation || req.patchType != c.wantPatchType {
+				t.Errorf("got %s %s, want %s %s", req.operation, req.patchType, c.wantOperation, c.wantPatchType)
+			}
+		})
+	}
+}
@@ -24,6 +24,9 @@ import (
 )
 
 func GetKubeConfigFromEnv() string {
+	if fpath := os.Getenv(clientcmd.RecommendedConfigPathEnvVar); fpath != "" {
+		return fpath
+	}
 	home := os.Getenv("HOME")
 	if home != "" {
 		fpath := filepath.Join(home, ".kube", "config")
@@ -35,7 +38,20 @@ func GetKubeConfigFromEnv() string {
 	return ""
 }
 
+// GetInClusterOrKubeConfig uses the kubeconfig if it's set, otherwise the in-cluster config
+// of the service account if the sink runs in a pod, or the kubeconfig from the environment.
 func GetInClusterOrKubeConfig(kubeconfig string) (config *rest.Config, rerr error) {
+	if kubeconfig == "" {
+		config, rerr = rest.InClusterConfig()
+		if rerr == nil {
+			return config, nil
+		}
+		if rerr != rest.ErrNotInCluster {
+			klog.Errorf("auth from in-cluster config failed:%v", rerr)
+			return nil, rerr
+		}
+		kubeconfig = GetKubeConfigFromEnv()
+	}
 	config, rerr = clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if rerr != nil {
 		klog.Errorf("auth from kubeconfig failed:%v", rerr)
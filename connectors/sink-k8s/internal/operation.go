@@ -0,0 +1,174 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/cdk-go/connector"
+	"github.com/vanus-labs/cdk-go/log"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// resourceClient returns the client of the resource of the object, the namespace of a
+// namespaced object is set to the default one if it's empty.
+func (s *k8sSink) resourceClient(obj *unstructured.Unstructured) (dynamic.ResourceInterface, error) {
+	mapping, err := s.mapper.RESTMapping(obj.GroupVersionKind())
+	if err != nil {
+		return nil, err
+	}
+	if mapping.Scope.Name() != meta.RESTScopeNameNamespace {
+		obj.SetNamespace("")
+		return s.client.Resource(mapping.Resource), nil
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(s.cfg.Namespace)
+	}
+	return s.client.Resource(mapping.Resource).Namespace(obj.GetNamespace()), nil
+}
+
+func (s *k8sSink) execute(ctx context.Context, req *request, obj *unstructured.Unstructured) cdkgo.Result {
+	ri, err := s.resourceClient(obj)
+	if err != nil {
+		log.Info("resolve resource failed", map[string]interface{}{
+			log.KeyError: err,
+			"kind":       obj.GroupVersionKind().String(),
+		})
+		if meta.IsNoMatchError(err) {
+			return cdkgo.NewResult(http.StatusBadRequest, err.Error())
+		}
+		return cdkgo.NewResult(http.StatusInternalServerError, err.Error())
+	}
+	if err = s.checkPolicy(ctx, ri, req, obj); err != nil {
+		log.Info("resource is rejected by policy", map[string]interface{}{
+			log.KeyError: err,
+			"resource":   resourceName(obj),
+		})
+		return errorResult(err)
+	}
+	var dryRun []string
+	if req.dryRun {
+		dryRun = []string{metav1.DryRunAll}
+	}
+	var result *unstructured.Unstructured
+	switch req.operation {
+	case Apply:
+		// the object of server-side apply can't have the managed fields.
+		obj.SetManagedFields(nil)
+		result, err = ri.Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{
+			DryRun:       dryRun,
+			FieldManager: s.cfg.FieldManager,
+			Force:        s.cfg.ForceConflicts,
+		})
+	case Create:
+		result, err = ri.Create(ctx, obj, metav1.CreateOptions{
+			DryRun:       dryRun,
+			FieldManager: s.cfg.FieldManager,
+		})
+	case Update:
+		result, err = ri.Update(ctx, obj, metav1.UpdateOptions{
+			DryRun:       dryRun,
+			FieldManager: s.cfg.FieldManager,
+		})
+	case Patch:
+		result, err = ri.Patch(ctx, obj.GetName(), req.patchType, req.patch, metav1.PatchOptions{
+			DryRun:       dryRun,
+			FieldManager: s.cfg.FieldManager,
+		})
+	case Delete:
+		background := metav1.DeletePropagationBackground
+		err = ri.Delete(ctx, obj.GetName(), metav1.DeleteOptions{
+			DryRun:            dryRun,
+			PropagationPolicy: &background,
+		})
+		if apierrors.IsNotFound(err) {
+			err = nil
+		}
+	default:
+		return cdkgo.NewResult(http.StatusBadRequest, fmt.Sprintf("unknown operation %s", req.operation))
+	}
+	if err != nil {
+		log.Info(fmt.Sprintf("%s resource failed", req.operation), map[string]interface{}{
+			log.KeyError: err,
+			"resource":   resourceName(obj),
+			"dry_run":    req.dryRun,
+		})
+		return errorResult(err)
+	}
+	log.Info(fmt.Sprintf("%s resource success", req.operation), map[string]interface{}{
+		"resource": resourceName(obj),
+		"dry_run":  req.dryRun,
+	})
+	if req.wait && !req.dryRun && result != nil {
+		return s.waitFor(ctx, ri, result)
+	}
+	return cdkgo.SuccessResult
+}
+
+// checkPolicy checks the resource before it's written. The result of a patch is unknown until
+// it's applied, so the patch is sent with dry run first to check the patched resource.
+func (s *k8sSink) checkPolicy(ctx context.Context, ri dynamic.ResourceInterface, req *request, obj *unstructured.Unstructured) error {
+	if err := s.policy.checkTarget(req.operation, obj); err != nil {
+		return apierrors.NewForbidden(schema.GroupResource{Group: obj.GroupVersionKind().Group, Resource: obj.GetKind()},
+			obj.GetName(), err)
+	}
+	if !s.policy.hasObjectRules() {
+		return nil
+	}
+	target := obj
+	switch req.operation {
+	case Apply, Create, Update:
+	case Patch:
+		patched, err := ri.Patch(ctx, obj.GetName(), req.patchType, req.patch, metav1.PatchOptions{
+			DryRun:       []string{metav1.DryRunAll},
+			FieldManager: s.cfg.FieldManager,
+		})
+		if err != nil {
+			return err
+		}
+		target = patched
+	default:
+		return nil
+	}
+	if err := s.policy.checkObject(target); err != nil {
+		return apierrors.NewForbidden(schema.GroupResource{Group: obj.GroupVersionKind().Group, Resource: obj.GetKind()},
+			obj.GetName(), err)
+	}
+	return nil
+}
+
+func resourceName(obj *unstructured.Unstructured) string {
+	if obj.GetNamespace() == "" {
+		return fmt.Sprintf("%s/%s", obj.GetKind(), obj.GetName())
+	}
+	return fmt.Sprintf("%s/%s/%s", obj.GetKind(), obj.GetNamespace(), obj.GetName())
+}
+
+// errorResult returns the status code of the api server, so the errors of invalid resources
+// aren't retried.
+func errorResult(err error) cdkgo.Result {
+	if status, ok := err.(apierrors.APIStatus); ok && status.Status().Code != 0 {
+		return cdkgo.NewResult(connector.Code(status.Status().Code), err.Error())
+	}
+	return cdkgo.NewResult(http.StatusInternalServerError, err.Error())
+}
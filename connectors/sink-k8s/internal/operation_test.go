@@ -0,0 +1,189 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	cdkgo "github.com/vanus-labs/cdk-go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/discovery/cached/memory"
+	discoveryfake "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/dynamic"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/restmapper"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var (
+	coreResources = &metav1.APIResourceList{
+		GroupVersion: "v1",
+		APIResources: []metav1.APIResource{
+			{Name: "namespaces", Kind: "Namespace", Namespaced: false},
+			{Name: "pods", Kind: "Pod", Namespaced: true},
+		},
+	}
+	appsResources = &metav1.APIResourceList{
+		GroupVersion: "apps/v1",
+		APIResources: []metav1.APIResource{{Name: "deployments", Kind: "Deployment", Namespaced: true}},
+	}
+	widgetResources = &metav1.APIResourceList{
+		GroupVersion: "example.com/v1",
+		APIResources: []metav1.APIResource{{Name: "widgets", Kind: "Widget", Namespaced: true}},
+	}
+)
+
+// applied is an apply request received by appliedClient.
+type applied struct {
+	resource  string
+	namespace string
+	name      string
+	options   metav1.ApplyOptions
+}
+
+// appliedClient records the options of apply requests, which the fake dynamic client drops.
+type appliedClient struct {
+	dynamic.Interface
+	applies []applied
+}
+
+func (c *appliedClient) Resource(gvr schema.GroupVersionResource) dynamic.NamespaceableResourceInterface {
+	return &appliedResource{NamespaceableResourceInterface: c.Interface.Resource(gvr), client: c, resource: gvr.Resource}
+}
+
+type appliedResource struct {
+	dynamic.NamespaceableResourceInterface
+	client   *appliedClient
+	resource string
+}
+
+func (r *appliedResource) Namespace(ns string) dynamic.ResourceInterface {
+	return &appliedNamespacedResource{ResourceInterface: r.NamespaceableResourceInterface.Namespace(ns),
+		client: r.client, resource: r.resource, namespace: ns}
+}
+
+func (r *appliedResource) Apply(ctx context.Context, name string, obj *unstructured.Unstructured,
+	options metav1.ApplyOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.applies = append(r.client.applies, applied{resource: r.resource, name: name, options: options})
+	return r.NamespaceableResourceInterface.Apply(ctx, name, obj, options, subresources...)
+}
+
+type appliedNamespacedResource struct {
+	dynamic.ResourceInterface
+	client    *appliedClient
+	resource  string
+	namespace string
+}
+
+func (r *appliedNamespacedResource) Apply(ctx context.Context, name string, obj *unstructured.Unstructured,
+	options metav1.ApplyOptions, subresources ...string) (*unstructured.Unstructured, error) {
+	r.client.applies = append(r.client.applies,
+		applied{resource: r.resource, namespace: r.namespace, name: name, options: options})
+	return r.ResourceInterface.Apply(ctx, name, obj, options, subresources...)
+}
+
+func TestApply(t *testing.T) {
+	fake := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	// the tracker of the fake client doesn't support apply patches, the object is returned.
+	fake.PrependReactor("patch", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		patch := action.(clienttesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		obj := &unstructured.Unstructured{}
+		return true, obj, obj.UnmarshalJSON(patch.GetPatch())
+	})
+	client := &appliedClient{Interface: fake}
+	discovery := &discoveryfake.FakeDiscovery{Fake: &clienttesting.Fake{
+		Resources: []*metav1.APIResourceList{coreResources, appsResources},
+	}}
+	s := &k8sSink{
+		cfg: &Config{
+			FieldManager:     defaultFieldManager,
+			ForceConflicts:   true,
+			DefaultOperation: Apply,
+			Namespace:        defaultNamespace,
+		},
+		client: client,
+		mapper: &restMapper{mapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discovery))},
+	}
+	var err error
+	if s.policy, err = newPolicy(&s.cfg.Policy); err != nil {
+		t.Fatal(err)
+	}
+
+	events := []string{
+		`{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"web"}}`,
+		`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"job","namespace":"batch"}}`,
+		// the namespace of a cluster scoped resource is removed.
+		`{"apiVersion":"v1","kind":"Namespace","metadata":{"name":"team","namespace":"default"}}`,
+	}
+	for _, data := range events {
+		if result := s.Arrived(context.Background(), newResourceEvent(data)); result != cdkgo.SuccessResult {
+			t.Fatalf("%s: %s", data, result.Error())
+		}
+	}
+	want := []applied{
+		{resource: "deployments", namespace: "default", name: "web"},
+		{resource: "pods", namespace: "batch", name: "job"},
+		{resource: "namespaces", name: "team"},
+	}
+	if len(client.applies) != len(want) {
+		t.Fatalf("got %d applies, want %d", len(client.applies), len(want))
+	}
+	for i, got := range client.applies {
+		if got.resource != want[i].resource || got.namespace != want[i].namespace || got.name != want[i].name {
+			t.Errorf("apply %d: got %s %s/%s, want %s %s/%s", i, got.resource, got.namespace, got.name,
+				want[i].resource, want[i].namespace, want[i].name)
+		}
+		if got.options.FieldManager != defaultFieldManager || !got.options.Force {
+			t.Errorf("apply %d: got options %+v", i, got.options)
+		}
+	}
+
+	// a custom resource defined after the discovery is cached is found by refreshing it.
+	widget := newResourceEvent(`{"apiVersion":"example.com/v1","kind":"Widget","metadata":{"name":"w"}}`)
+	result := s.Arrived(context.Background(), widget)
+	// GetCode of the cdk doesn't return, so the code is checked by the message.
+	badRequest := fmt.Sprintf(`"code": %d`, http.StatusBadRequest)
+	if result == cdkgo.SuccessResult || !strings.Contains(result.Error().Error(), badRequest) {
+		t.Fatalf("got %v, want 400 for an unknown kind", result.Error())
+	}
+	discovery.Resources = append(discovery.Resources, widgetResources)
+	if result = s.Arrived(context.Background(), widget); result != cdkgo.SuccessResult {
+		t.Fatalf("got %s after the kind is defined", result.Error())
+	}
+	if last := client.applies[len(client.applies)-1]; last.resource != "widgets" || last.namespace != "default" {
+		t.Fatalf("got apply %+v, want widgets in default", last)
+	}
+}
+
+func newResourceEvent(data string) *ce.Event {
+	e := ce.NewEvent()
+	e.SetID("1")
+	e.SetSource("test")
+	e.SetType("test")
+	_ = e.SetData(ce.ApplicationJSON, []byte(data))
+	return &e
+}
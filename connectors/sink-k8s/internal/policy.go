@@ -0,0 +1,238 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// PolicyConfig restricts the resources which events can write, it's checked before the
+// resources are sent to the API server.
+type PolicyConfig struct {
+	Namespaces Rule `json:"namespaces" yaml:"namespaces"`
+	// Kinds are kinds such as Deployment, or group/kind such as apps/Deployment. The kinds of
+	// the core group have no group, they are Pod or v1/Pod.
+	Kinds      Rule `json:"kinds" yaml:"kinds"`
+	Operations Rule `json:"operations" yaml:"operations"`
+	// RequiredLabels are the labels which resources must have, an empty value means any value.
+	RequiredLabels    map[string]string `json:"required_labels" yaml:"required_labels"`
+	ForbidHostPath    bool              `json:"forbid_host_path" yaml:"forbid_host_path"`
+	ForbidPrivileged  bool              `json:"forbid_privileged" yaml:"forbid_privileged"`
+	ForbidHostNetwork bool              `json:"forbid_host_network" yaml:"forbid_host_network"`
+	MaxReplicas       int64             `json:"max_replicas" yaml:"max_replicas"`
+	// MaxResources caps the requests and limits of each container, such as cpu: "2".
+	MaxResources map[corev1.ResourceName]string `json:"max_resources" yaml:"max_resources"`
+}
+
+// Rule allows the values in Allowed, all values are allowed if it's empty, and denies the
+// values in Denied.
+type Rule struct {
+	Allowed []string `json:"allowed" yaml:"allowed"`
+	Denied  []string `json:"denied" yaml:"denied"`
+}
+
+func (r Rule) allows(values ...string) bool {
+	for _, v := range r.Denied {
+		if contains(values, v) {
+			return false
+		}
+	}
+	if len(r.Allowed) == 0 {
+		return true
+	}
+	for _, v := range r.Allowed {
+		if contains(values, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+type policy struct {
+	cfg          *PolicyConfig
+	maxResources map[corev1.ResourceName]resource.Quantity
+}
+
+func newPolicy(cfg *PolicyConfig) (*policy, error) {
+	p := &policy{
+		cfg:          cfg,
+		maxResources: map[corev1.ResourceName]resource.Quantity{},
+	}
+	for name, v := range cfg.MaxResources {
+		q, err := resource.ParseQuantity(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy.max_resources.%s: %w", name, err)
+		}
+		p.maxResources[name] = q
+	}
+	for _, kind := range append(append([]string{}, cfg.Kinds.Allowed...), cfg.Kinds.Denied...) {
+		if kind == "" || strings.HasPrefix(kind, "/") || strings.HasSuffix(kind, "/") {
+			return nil, fmt.Errorf("invalid policy.kinds %q, it's kind or group/kind such as Pod or apps/Deployment", kind)
+		}
+	}
+	return p, nil
+}
+
+// checkTarget checks the operation, namespace and kind of the resource.
+func (p *policy) checkTarget(operation KubernetesResourceOperation, obj *unstructured.Unstructured) error {
+	if !p.cfg.Operations.allows(string(operation)) {
+		return fmt.Errorf("operation %s isn't allowed", operation)
+	}
+	if ns := obj.GetNamespace(); ns != "" && !p.cfg.Namespaces.allows(ns) {
+		return fmt.Errorf("namespace %s isn't allowed", ns)
+	}
+	gvk := obj.GroupVersionKind()
+	if !p.cfg.Kinds.allows(kindNames(gvk)...) {
+		return fmt.Errorf("kind %s isn't allowed", gvk.GroupKind())
+	}
+	return nil
+}
+
+// kindNames returns the names of the kind in the policy, the kind and group/kind, or
+// v1/kind of the core group, which has no group.
+func kindNames(gvk schema.GroupVersionKind) []string {
+	if gvk.Group == "" {
+		return []string{gvk.Kind, "v1/" + gvk.Kind}
+	}
+	return []string{gvk.Kind, gvk.Group + "/" + gvk.Kind}
+}
+
+// hasObjectRules reports whether the content of resources is checked.
+func (p *policy) hasObjectRules() bool {
+	return len(p.cfg.RequiredLabels) > 0 || p.cfg.ForbidHostPath || p.cfg.ForbidPrivileged ||
+		p.cfg.ForbidHostNetwork || p.cfg.MaxReplicas > 0 || len(p.maxResources) > 0
+}
+
+// checkObject checks the labels, replicas and pod specs of the resource. The pod specs are
+// found anywhere in the resource, so pod templates of workloads and custom resources are
+// checked too.
+func (p *policy) checkObject(obj *unstructured.Unstructured) error {
+	var violations []string
+	labels := obj.GetLabels()
+	for key, value := range p.cfg.RequiredLabels {
+		v, ok := labels[key]
+		if !ok {
+			violations = append(violations, fmt.Sprintf("label %s is required", key))
+		} else if value != "" && v != value {
+			violations = append(violations, fmt.Sprintf("label %s must be %s", key, value))
+		}
+	}
+	if p.cfg.MaxReplicas > 0 {
+		replicas, ok, _ := unstructured.NestedFieldNoCopy(obj.Object, "spec", "replicas")
+		if n, isInt := replicas.(int64); ok && isInt && n > p.cfg.MaxReplicas {
+			violations = append(violations, fmt.Sprintf("replicas %d exceeds %d", n, p.cfg.MaxReplicas))
+		}
+	}
+	walkPodSpecs(obj.Object, "", func(path string, spec map[string]interface{}) {
+		violations = append(violations, p.checkPodSpec(path, spec)...)
+	})
+	if len(violations) > 0 {
+		return fmt.Errorf("%s violates policy: %s", resourceName(obj), strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+func (p *policy) checkPodSpec(path string, spec map[string]interface{}) []string {
+	var violations []string
+	if p.cfg.ForbidHostNetwork {
+		if v, _ := spec["hostNetwork"].(bool); v {
+			violations = append(violations, fmt.Sprintf("%s.hostNetwork is forbidden", path))
+		}
+	}
+	if p.cfg.ForbidHostPath {
+		volumes, _ := spec["volumes"].([]interface{})
+		for _, volume := range volumes {
+			v, _ := volume.(map[string]interface{})
+			if _, ok := v["hostPath"]; ok {
+				violations = append(violations, fmt.Sprintf("%s.volumes[%v].hostPath is forbidden", path, v["name"]))
+			}
+		}
+	}
+	for _, field := range []string{"initContainers", "containers", "ephemeralContainers"} {
+		containers, _ := spec[field].([]interface{})
+		for _, container := range containers {
+			c, _ := container.(map[string]interface{})
+			name := fmt.Sprintf("%s.%s[%v]", path, field, c["name"])
+			if p.cfg.ForbidPrivileged {
+				if v, _, _ := unstructured.NestedBool(c, "securityContext", "privileged"); v {
+					violations = append(violations, fmt.Sprintf("%s is privileged", name))
+				}
+			}
+			violations = append(violations, p.checkResources(name, c)...)
+		}
+	}
+	return violations
+}
+
+func (p *policy) checkResources(name string, container map[string]interface{}) []string {
+	var violations []string
+	for _, kind := range []string{"requests", "limits"} {
+		resources, _, _ := unstructured.NestedMap(container, "resources", kind)
+		for res, max := range p.maxResources {
+			v, ok := resources[string(res)]
+			if !ok {
+				continue
+			}
+			q, err := resource.ParseQuantity(fmt.Sprint(v))
+			if err != nil {
+				violations = append(violations, fmt.Sprintf("%s.resources.%s.%s is invalid", name, kind, res))
+				continue
+			}
+			if q.Cmp(max) > 0 {
+				violations = append(violations, fmt.Sprintf("%s.resources.%s.%s %s exceeds %s",
+					name, kind, res, q.String(), max.String()))
+			}
+		}
+	}
+	return violations
+}
+
+// walkPodSpecs calls fn with every object which has containers, the objects in lists such as
+// the items of v1/List are walked too.
+func walkPodSpecs(value interface{}, path string, fn func(path string, spec map[string]interface{})) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if _, ok := v["containers"].([]interface{}); ok {
+			fn(path, v)
+			return
+		}
+		for key, field := range v {
+			p := key
+			if path != "" {
+				p = path + "." + key
+			}
+			walkPodSpecs(field, p, fn)
+		}
+	case []interface{}:
+		for i, item := range v {
+			walkPodSpecs(item, fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	}
+}
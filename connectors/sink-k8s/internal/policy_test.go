@@ -0,0 +1,102 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestCheckTargetKinds(t *testing.T) {
+	cases := []struct {
+		name       string
+		kinds      Rule
+		apiVersion string
+		kind       string
+		wantErr    bool
+	}{
+		{name: "core kind", kinds: Rule{Allowed: []string{"Pod"}}, apiVersion: "v1", kind: "Pod"},
+		{name: "core group kind", kinds: Rule{Allowed: []string{"v1/Pod"}}, apiVersion: "v1", kind: "Pod"},
+		{name: "core kind denied", kinds: Rule{Denied: []string{"v1/Pod"}}, apiVersion: "v1", kind: "Pod", wantErr: true},
+		{name: "group kind", kinds: Rule{Allowed: []string{"apps/Deployment"}}, apiVersion: "apps/v1", kind: "Deployment"},
+		{name: "kind of any group", kinds: Rule{Denied: []string{"Deployment"}}, apiVersion: "apps/v1", kind: "Deployment", wantErr: true},
+		{name: "other group", kinds: Rule{Allowed: []string{"apps/Deployment"}}, apiVersion: "v1", kind: "Pod", wantErr: true},
+		{name: "core isn't a group", kinds: Rule{Allowed: []string{"v1/Deployment"}}, apiVersion: "apps/v1", kind: "Deployment", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p, err := newPolicy(&PolicyConfig{Kinds: c.kinds})
+			if err != nil {
+				t.Fatal(err)
+			}
+			obj := &unstructured.Unstructured{}
+			obj.SetAPIVersion(c.apiVersion)
+			obj.SetKind(c.kind)
+			if err = p.checkTarget(Create, obj); (err != nil) != c.wantErr {
+				t.Errorf("got error %v, want error %t", err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewPolicyRejectsEmptyGroup(t *testing.T) {
+	for _, kind := range []string{"/Pod", "apps/", ""} {
+		if _, err := newPolicy(&PolicyConfig{Kinds: Rule{Denied: []string{kind}}}); err == nil {
+			t.Errorf("kind %q: want error", kind)
+		}
+	}
+}
+
+func TestCheckObjectFindsPodSpecsInLists(t *testing.T) {
+	p, err := newPolicy(&PolicyConfig{ForbidPrivileged: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			name: "items of list",
+			data: `{"apiVersion":"v1","kind":"List","items":[{"apiVersion":"v1","kind":"Pod",` +
+				`"metadata":{"name":"a"},"spec":{"containers":[{"name":"app"}]}},` +
+				`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"b"},"spec":{"containers":` +
+				`[{"name":"app","securityContext":{"privileged":true}}]}}]}`,
+			want: "items[1].spec.containers[app] is privileged",
+		},
+		{
+			name: "templates of custom resource",
+			data: `{"apiVersion":"example.com/v1","kind":"Cluster","metadata":{"name":"c"},` +
+				`"spec":{"workers":[{"template":{"spec":{"containers":[{"name":"worker",` +
+				`"securityContext":{"privileged":true}}]}}}]}}`,
+			want: "spec.workers[0].template.spec.containers[worker] is privileged",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			obj := &unstructured.Unstructured{}
+			if err := obj.UnmarshalJSON([]byte(c.data)); err != nil {
+				t.Fatal(err)
+			}
+			err := p.checkObject(obj)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("got error %v, want %q", err, c.want)
+			}
+		})
+	}
+}
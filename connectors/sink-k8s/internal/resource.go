@@ -20,11 +20,14 @@ import (
 	"time"
 
 	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/util/wait"
-	"k8s.io/gengo/namer"
-	"k8s.io/gengo/types"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
 )
 
 // Reader enables reading from an external store
@@ -102,20 +105,27 @@ func GetGroupVersionKind(obj *unstructured.Unstructured) schema.GroupVersionKind
 	return obj.GroupVersionKind()
 }
 
-func GetGroupVersionResource(obj *unstructured.Unstructured) schema.GroupVersionResource {
-	gvk := obj.GroupVersionKind()
-	pluralExceptions := map[string]string{
-		"EventBus": "eventbus",
+// restMapper resolves the resource of a kind with the discovery api. The discovery is cached,
+// and it's refreshed if a kind isn't found, so custom resources defined later are found too.
+type restMapper struct {
+	mapper *restmapper.DeferredDiscoveryRESTMapper
+}
+
+func newRESTMapper(config *rest.Config) (*restMapper, error) {
+	dc, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return nil, err
 	}
-	resource := namer.NewAllLowercasePluralNamer(pluralExceptions).Name(&types.Type{
-		Name: types.Name{
-			Name: gvk.Kind,
-		},
-	})
+	return &restMapper{
+		mapper: restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(dc)),
+	}, nil
+}
 
-	return schema.GroupVersionResource{
-		Group:    gvk.Group,
-		Version:  gvk.Version,
-		Resource: resource,
+func (m *restMapper) RESTMapping(gvk schema.GroupVersionKind) (*meta.RESTMapping, error) {
+	mapping, err := m.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+	if meta.IsNoMatchError(err) {
+		m.mapper.Reset()
+		mapping, err = m.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
 	}
+	return mapping, err
 }
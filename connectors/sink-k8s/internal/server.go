@@ -16,21 +16,13 @@ package internal
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 
 	ce "github.com/cloudevents/sdk-go/v2"
 	cdkgo "github.com/vanus-labs/cdk-go"
 	"github.com/vanus-labs/cdk-go/log"
-	"k8s.io/client-go/kubernetes"
-)
-
-// KubernetesResourceKind refers to the type of kind performed on the K8s resource
-type KubernetesResourceKind string
-
-// possible values for KubernetesResourceKind
-const (
-	Pod KubernetesResourceKind = "Pod"
-	Job KubernetesResourceKind = "Job"
+	"k8s.io/client-go/dynamic"
 )
 
 // KubernetesResourceOperation refers to the type of operation performed on the K8s resource
@@ -38,14 +30,37 @@ type KubernetesResourceOperation string
 
 // possible values for KubernetesResourceOperation
 const (
+	Apply  KubernetesResourceOperation = "apply"  // applies the resource with server-side apply
 	Create KubernetesResourceOperation = "create" // create the resource
 	Update KubernetesResourceOperation = "update" // updates the resource
 	Delete KubernetesResourceOperation = "delete" // deletes the resource
+	Patch  KubernetesResourceOperation = "patch"  // patches the resource
+)
+
+const (
+	defaultFieldManager = "vanus-connect-sink-k8s"
+	defaultOperation    = Create
+	defaultNamespace    = "default"
 )
 
 type Config struct {
 	cdkgo.SinkConfig `json:",inline" yaml:",inline"`
-	Secret           *Secret `json:"secret" yaml:"secret"`
+	// Kubeconfig is the path of the kubeconfig, the in-cluster config is used if it's empty.
+	Kubeconfig string `json:"kubeconfig" yaml:"kubeconfig"`
+	// FieldManager is the manager of the fields set by server-side apply.
+	FieldManager string `json:"field_manager" yaml:"field_manager"`
+	// ForceConflicts makes server-side apply take the fields owned by other managers.
+	ForceConflicts bool `json:"force_conflicts" yaml:"force_conflicts"`
+	// DefaultOperation is the operation of events which have neither the extension nor the
+	// annotation, it's create by default, set it to apply to use server-side apply.
+	DefaultOperation KubernetesResourceOperation `json:"default_operation" yaml:"default_operation"`
+	// Namespace is the namespace of namespaced resources which have no namespace.
+	Namespace string `json:"namespace" yaml:"namespace"`
+	// DryRun sends requests with dryRun=All, so resources are validated but not persisted.
+	DryRun bool         `json:"dry_run" yaml:"dry_run"`
+	Policy PolicyConfig `json:"policy" yaml:"policy"`
+	Wait   WaitConfig   `json:"wait" yaml:"wait"`
+	Secret *Secret      `json:"secret" yaml:"secret"`
 }
 
 func NewConfig() cdkgo.SinkConfigAccessor {
@@ -54,6 +69,15 @@ func NewConfig() cdkgo.SinkConfigAccessor {
 	}
 }
 
+func (c *Config) Validate() error {
+	switch c.DefaultOperation {
+	case "", Apply, Create, Update, Patch, Delete:
+	default:
+		return fmt.Errorf("invalid default_operation %s", c.DefaultOperation)
+	}
+	return c.SinkConfig.Validate()
+}
+
 func (c *Config) GetSecret() cdkgo.SecretAccessor {
 	return c.Secret
 }
@@ -66,7 +90,9 @@ type Secret struct {
 
 type k8sSink struct {
 	cfg    *Config
-	client *kubernetes.Clientset
+	client dynamic.Interface
+	mapper *restMapper
+	policy *policy
 }
 
 func NewKubernetesSink() cdkgo.Sink {
@@ -75,27 +101,68 @@ func NewKubernetesSink() cdkgo.Sink {
 
 func (s *k8sSink) Initialize(_ context.Context, cfg cdkgo.ConfigAccessor) error {
 	s.cfg = cfg.(*Config)
-	kubeconfig := GetKubeConfigFromEnv()
-	config, err := GetInClusterOrKubeConfig(kubeconfig)
+	if s.cfg.FieldManager == "" {
+		s.cfg.FieldManager = defaultFieldManager
+	}
+	if s.cfg.DefaultOperation == "" {
+		s.cfg.DefaultOperation = defaultOperation
+	}
+	if s.cfg.Namespace == "" {
+		s.cfg.Namespace = defaultNamespace
+	}
+	if s.cfg.Wait.Timeout == 0 {
+		s.cfg.Wait.Timeout = defaultWaitTimeout
+	}
+	var err error
+	s.policy, err = newPolicy(&s.cfg.Policy)
+	if err != nil {
+		return err
+	}
+	config, err := GetInClusterOrKubeConfig(s.cfg.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	s.client, err = dynamic.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	s.mapper, err = newRESTMapper(config)
 	if err != nil {
 		return err
 	}
-
-	s.client = kubernetes.NewForConfigOrDie(config)
 	return nil
 }
 
 func (s *k8sSink) Arrived(ctx context.Context, events ...*ce.Event) cdkgo.Result {
-	if len(events) != 1 {
-		return cdkgo.NewResult(http.StatusInternalServerError, "the event number must be 1")
+	for _, event := range events {
+		if result := s.handle(ctx, event); result != cdkgo.SuccessResult {
+			return result
+		}
 	}
-	event := events[0]
-	var err error
+	return cdkgo.SuccessResult
+}
+
+func (s *k8sSink) handle(ctx context.Context, event *ce.Event) cdkgo.Result {
 	log.Info("receive an event", map[string]interface{}{
 		"event_id": event.ID(),
 	})
-	data := event.Data()
-	reader, err := NewResourceReader(data)
+	req, err := s.newRequest(event)
+	if err != nil {
+		return cdkgo.NewResult(http.StatusBadRequest, err.Error())
+	}
+	if isJSONPatch(event) {
+		obj, err := jsonPatchTarget(event)
+		if err != nil {
+			return cdkgo.NewResult(http.StatusBadRequest, err.Error())
+		}
+		if err = s.resolveOperation(req, event, nil); err != nil {
+			return cdkgo.NewResult(http.StatusBadRequest, err.Error())
+		}
+		req.patch = event.Data()
+		return s.execute(ctx, req, obj)
+	}
+
+	reader, err := NewResourceReader(event.Data())
 	if err != nil {
 		log.Info("new resource reader failed", map[string]interface{}{
 			log.KeyError: err,
@@ -110,23 +177,19 @@ func (s *k8sSink) Arrived(ctx context.Context, events ...*ce.Event) cdkgo.Result
 		})
 		return cdkgo.NewResult(http.StatusBadRequest, "fetch artifact failed")
 	}
+	if uObj.GetKind() == "" || uObj.GetAPIVersion() == "" || uObj.GetName() == "" {
+		return cdkgo.NewResult(http.StatusBadRequest, "resource apiVersion, kind and metadata.name are required")
+	}
 
-	gvk := GetGroupVersionKind(uObj)
-	switch KubernetesResourceKind(gvk.Kind) {
-	case Pod:
-		err = s.handlePod(ctx, data)
-		if err != nil {
-			return cdkgo.NewResult(http.StatusInternalServerError, "handle resource error")
-		}
-	case Job:
-		err = s.handleJob(ctx, data)
-		if err != nil {
-			return cdkgo.NewResult(http.StatusInternalServerError, "handler resource error")
+	if err = s.resolveOperation(req, event, uObj); err != nil {
+		return cdkgo.NewResult(http.StatusBadRequest, err.Error())
+	}
+	if req.operation == Patch {
+		if req.patch, err = uObj.MarshalJSON(); err != nil {
+			return cdkgo.NewResult(http.StatusBadRequest, err.Error())
 		}
-	default:
-		return cdkgo.NewResult(http.StatusNotAcceptable, "can't handle resource")
 	}
-	return cdkgo.SuccessResult
+	return s.execute(ctx, req, uObj)
 }
 
 func (s *k8sSink) Name() string {
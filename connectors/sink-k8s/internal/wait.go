@@ -0,0 +1,278 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/cdk-go/log"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	defaultWaitTimeout = 300
+	maxPodFailures     = 5
+)
+
+// WaitConfig makes the sink wait until a Job completes or a Deployment rolls out, other
+// resources aren't waited.
+type WaitConfig struct {
+	Enabled bool `json:"enabled" yaml:"enabled"`
+	// Timeout is the max time in second to wait.
+	Timeout int `json:"timeout" yaml:"timeout"`
+}
+
+var podsResource = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+// statusFunc reports whether the resource is done, and the error if it fails.
+type statusFunc func(obj *unstructured.Unstructured) (bool, error)
+
+func (s *k8sSink) waitFor(ctx context.Context, ri dynamic.ResourceInterface, obj *unstructured.Unstructured) cdkgo.Result {
+	var status statusFunc
+	gvk := obj.GroupVersionKind()
+	switch gvk.GroupKind().String() {
+	case "Job.batch":
+		status = jobStatus
+	case "Deployment.apps":
+		status = deploymentStatus
+	default:
+		return cdkgo.SuccessResult
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.Wait.Timeout)*time.Second)
+	defer cancel()
+	start := time.Now()
+	current, err := watchUntil(ctx, ri, obj, status)
+	if err == nil {
+		log.Info("resource is done", map[string]interface{}{
+			"resource": resourceName(obj),
+			"duration": time.Since(start),
+		})
+		return cdkgo.SuccessResult
+	}
+	if reasons := s.podFailures(context.Background(), current); len(reasons) > 0 {
+		err = fmt.Errorf("%w, pods: %s", err, strings.Join(reasons, "; "))
+	}
+	log.Info("wait resource failed", map[string]interface{}{
+		log.KeyError: err,
+		"resource":   resourceName(obj),
+	})
+	if ctx.Err() == context.DeadlineExceeded {
+		return cdkgo.NewResult(http.StatusGatewayTimeout,
+			fmt.Sprintf("%s isn't done in %ds: %s", resourceName(obj), s.cfg.Wait.Timeout, err))
+	}
+	return cdkgo.NewResult(http.StatusInternalServerError, fmt.Sprintf("%s failed: %s", resourceName(obj), err))
+}
+
+// watchUntil watches the resource until it's done or failed, it returns the last seen resource.
+func watchUntil(ctx context.Context, ri dynamic.ResourceInterface, obj *unstructured.Unstructured,
+	status statusFunc) (*unstructured.Unstructured, error) {
+	current := obj
+	for {
+		if done, err := status(current); done || err != nil {
+			return current, err
+		}
+		w, err := ri.Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", obj.GetName()).String(),
+			ResourceVersion: current.GetResourceVersion(),
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return current, ctx.Err()
+			}
+			return current, err
+		}
+		var done bool
+		current, done, err = consume(ctx, w, current, status)
+		w.Stop()
+		if done || err != nil {
+			return current, err
+		}
+		if ctx.Err() != nil {
+			return current, ctx.Err()
+		}
+		// the watch is closed or expired, get the resource and watch again.
+		select {
+		case <-ctx.Done():
+			return current, ctx.Err()
+		case <-time.After(time.Second):
+		}
+		latest, err := ri.Get(ctx, obj.GetName(), metav1.GetOptions{})
+		if err != nil {
+			if ctx.Err() != nil {
+				return current, ctx.Err()
+			}
+			return current, err
+		}
+		current = latest
+	}
+}
+
+// consume handles the watch events until the resource is done, or the watch is closed.
+func consume(ctx context.Context, w watch.Interface, current *unstructured.Unstructured,
+	status statusFunc) (*unstructured.Unstructured, bool, error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return current, false, nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				return current, false, nil
+			}
+			switch event.Type {
+			case watch.Error:
+				return current, false, nil
+			case watch.Deleted:
+				return current, false, fmt.Errorf("%s is deleted", resourceName(current))
+			}
+			obj, ok := event.Object.(*unstructured.Unstructured)
+			if !ok {
+				continue
+			}
+			current = obj
+			if done, err := status(current); done || err != nil {
+				return current, done, err
+			}
+		}
+	}
+}
+
+func findCondition(obj *unstructured.Unstructured, conditionType string) map[string]interface{} {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		if condition["type"] == conditionType {
+			return condition
+		}
+	}
+	return nil
+}
+
+func jobStatus(obj *unstructured.Unstructured) (bool, error) {
+	if c := findCondition(obj, "Complete"); c != nil && c["status"] == "True" {
+		return true, nil
+	}
+	if c := findCondition(obj, "Failed"); c != nil && c["status"] == "True" {
+		return true, fmt.Errorf("job failed, reason: %v, message: %v", c["reason"], c["message"])
+	}
+	return false, nil
+}
+
+func deploymentStatus(obj *unstructured.Unstructured) (bool, error) {
+	observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration")
+	if obj.GetGeneration() > observed {
+		return false, nil
+	}
+	if c := findCondition(obj, "Progressing"); c != nil && c["reason"] == "ProgressDeadlineExceeded" {
+		return true, fmt.Errorf("rollout failed, reason: %v, message: %v", c["reason"], c["message"])
+	}
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+	updated, _, _ := unstructured.NestedInt64(obj.Object, "status", "updatedReplicas")
+	total, _, _ := unstructured.NestedInt64(obj.Object, "status", "replicas")
+	available, _, _ := unstructured.NestedInt64(obj.Object, "status", "availableReplicas")
+	return updated == replicas && total == replicas && available == replicas, nil
+}
+
+// podFailures returns the reasons of the failed or unready pods of the resource.
+func (s *k8sSink) podFailures(ctx context.Context, obj *unstructured.Unstructured) []string {
+	m, found, _ := unstructured.NestedMap(obj.Object, "spec", "selector")
+	if !found {
+		return nil
+	}
+	ls := &metav1.LabelSelector{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(m, ls); err != nil {
+		return nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(ls)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	pods, err := s.client.Resource(podsResource).Namespace(obj.GetNamespace()).List(ctx, metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		log.Info("list pods failed", map[string]interface{}{
+			log.KeyError: err,
+			"resource":   resourceName(obj),
+		})
+		return nil
+	}
+	var reasons []string
+	for i := range pods.Items {
+		reasons = append(reasons, podReasons(&pods.Items[i])...)
+		if len(reasons) >= maxPodFailures {
+			return reasons[:maxPodFailures]
+		}
+	}
+	return reasons
+}
+
+func podReasons(pod *unstructured.Unstructured) []string {
+	var reasons []string
+	if reason, _, _ := unstructured.NestedString(pod.Object, "status", "reason"); reason != "" {
+		message, _, _ := unstructured.NestedString(pod.Object, "status", "message")
+		reasons = append(reasons, strings.TrimSpace(fmt.Sprintf("%s: %s %s", pod.GetName(), reason, message)))
+	}
+	for _, field := range []string{"initContainerStatuses", "containerStatuses"} {
+		statuses, _, _ := unstructured.NestedSlice(pod.Object, "status", field)
+		for _, st := range statuses {
+			status, _ := st.(map[string]interface{})
+			if reason := containerReason(status); reason != "" {
+				reasons = append(reasons, fmt.Sprintf("%s/%v: %s", pod.GetName(), status["name"], reason))
+			}
+		}
+	}
+	return reasons
+}
+
+// containerReason returns the reason of a container which is terminated abnormally, or is
+// waiting for an error, such as CrashLoopBackOff.
+func containerReason(status map[string]interface{}) string {
+	for _, state := range []string{"state", "lastState"} {
+		terminated, found, _ := unstructured.NestedMap(status, state, "terminated")
+		if !found {
+			continue
+		}
+		exitCode, _, _ := unstructured.NestedInt64(terminated, "exitCode")
+		if exitCode == 0 {
+			continue
+		}
+		reason, _, _ := unstructured.NestedString(terminated, "reason")
+		message, _, _ := unstructured.NestedString(terminated, "message")
+		return strings.TrimSpace(fmt.Sprintf("terminated with %s (exit code %d) %s", reason, exitCode, message))
+	}
+	reason, _, _ := unstructured.NestedString(status, "state", "waiting", "reason")
+	switch reason {
+	case "", "ContainerCreating", "PodInitializing":
+		return ""
+	}
+	message, _, _ := unstructured.NestedString(status, "state", "waiting", "message")
+	return strings.TrimSpace(fmt.Sprintf("waiting for %s %s", reason, message))
+}
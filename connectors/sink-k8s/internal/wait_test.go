@@ -0,0 +1,190 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+var jobsResource = schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+
+func TestJobStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		status   string
+		wantDone bool
+		wantErr  bool
+	}{
+		{name: "running", status: `{"active":1}`},
+		{name: "complete", status: `{"conditions":[{"type":"Complete","status":"True"}]}`, wantDone: true},
+		{name: "not complete", status: `{"conditions":[{"type":"Complete","status":"False"}]}`},
+		{name: "failed", status: `{"conditions":[{"type":"Failed","status":"True","reason":"BackoffLimitExceeded"}]}`,
+			wantDone: true, wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			done, err := jobStatus(newObject(t, `{"apiVersion":"batch/v1","kind":"Job","status":`+c.status+`}`))
+			if done != c.wantDone || (err != nil) != c.wantErr {
+				t.Fatalf("got done %v, error %v", done, err)
+			}
+		})
+	}
+}
+
+func TestDeploymentStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     string
+		wantDone bool
+		wantErr  bool
+	}{
+		{
+			name: "rolled out",
+			data: `{"metadata":{"generation":2},"spec":{"replicas":3},` +
+				`"status":{"observedGeneration":2,"replicas":3,"updatedReplicas":3,"availableReplicas":3}}`,
+			wantDone: true,
+		},
+		{
+			name: "one replica by default",
+			data: `{"metadata":{"generation":1},` +
+				`"status":{"observedGeneration":1,"replicas":1,"updatedReplicas":1,"availableReplicas":1}}`,
+			wantDone: true,
+		},
+		{
+			name: "generation isn't observed",
+			data: `{"metadata":{"generation":3},"spec":{"replicas":3},` +
+				`"status":{"observedGeneration":2,"replicas":3,"updatedReplicas":3,"availableReplicas":3}}`,
+		},
+		{
+			name: "old replicas are running",
+			data: `{"metadata":{"generation":2},"spec":{"replicas":3},` +
+				`"status":{"observedGeneration":2,"replicas":4,"updatedReplicas":3,"availableReplicas":3}}`,
+		},
+		{
+			name: "replicas aren't available",
+			data: `{"metadata":{"generation":2},"spec":{"replicas":3},` +
+				`"status":{"observedGeneration":2,"replicas":3,"updatedReplicas":3,"availableReplicas":2}}`,
+		},
+		{
+			name: "progress deadline exceeded",
+			data: `{"metadata":{"generation":2},"spec":{"replicas":3},"status":{"observedGeneration":2,` +
+				`"conditions":[{"type":"Progressing","status":"False","reason":"ProgressDeadlineExceeded"}]}}`,
+			wantDone: true,
+			wantErr:  true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			done, err := deploymentStatus(newObject(t, `{"apiVersion":"apps/v1","kind":"Deployment",`+c.data[1:]))
+			if done != c.wantDone || (err != nil) != c.wantErr {
+				t.Fatalf("got done %v, error %v", done, err)
+			}
+		})
+	}
+}
+
+func TestWaitForJob(t *testing.T) {
+	job := `{"apiVersion":"batch/v1","kind":"Job","metadata":{"name":"migrate","namespace":"default",` +
+		`"resourceVersion":"1"},"spec":{"selector":{"matchLabels":{"job-name":"migrate"}}},"status":%s}`
+	pod := newObject(t, `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"migrate-x","namespace":"default",`+
+		`"labels":{"job-name":"migrate"}},"status":{"containerStatuses":[{"name":"main",`+
+		`"state":{"terminated":{"exitCode":1,"reason":"Error"}}}]}}`)
+	cases := []struct {
+		name     string
+		events   []watch.Event
+		wantCode int
+		wantMsg  string
+	}{
+		{
+			name: "complete",
+			events: []watch.Event{
+				{Type: watch.Modified, Object: newObject(t, fmt.Sprintf(job, `{"active":1}`))},
+				{Type: watch.Modified, Object: newObject(t,
+					fmt.Sprintf(job, `{"conditions":[{"type":"Complete","status":"True"}]}`))},
+			},
+		},
+		{
+			name: "failed",
+			events: []watch.Event{{Type: watch.Modified, Object: newObject(t, fmt.Sprintf(job,
+				`{"conditions":[{"type":"Failed","status":"True","reason":"BackoffLimitExceeded"}]}`))}},
+			wantCode: http.StatusInternalServerError,
+			wantMsg:  "migrate-x/main: terminated with Error (exit code 1)",
+		},
+		{
+			name:     "deleted",
+			events:   []watch.Event{{Type: watch.Deleted, Object: newObject(t, fmt.Sprintf(job, `{}`))}},
+			wantCode: http.StatusInternalServerError,
+			wantMsg:  "is deleted",
+		},
+		{
+			name:     "timeout",
+			wantCode: http.StatusGatewayTimeout,
+			wantMsg:  "isn't done in 1s",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{podsResource: "PodList"}, pod)
+			w := watch.NewFake()
+			client.PrependWatchReactor("jobs", func(action clienttesting.Action) (bool, watch.Interface, error) {
+				return true, w, nil
+			})
+			go func() {
+				// the events are sent one by one, since the fake watcher isn't buffered.
+				for _, e := range c.events {
+					w.Action(e.Type, e.Object)
+				}
+			}()
+			s := &k8sSink{cfg: &Config{Wait: WaitConfig{Enabled: true, Timeout: 1}}, client: client}
+			result := s.waitFor(context.Background(), client.Resource(jobsResource).Namespace("default"),
+				newObject(t, fmt.Sprintf(job, `{}`)))
+			if c.wantCode == 0 {
+				if result != cdkgo.SuccessResult {
+					t.Fatalf("got %s", result.Error())
+				}
+				return
+			}
+			if result == cdkgo.SuccessResult {
+				t.Fatal("want error")
+			}
+			// GetCode of the cdk doesn't return, so the code is checked by the message.
+			msg := result.Error().Error()
+			if !strings.Contains(msg, fmt.Sprintf(`"code": %d`, c.wantCode)) || !strings.Contains(msg, c.wantMsg) {
+				t.Fatalf("got %s, want %d with %q", msg, c.wantCode, c.wantMsg)
+			}
+		})
+	}
+}
+
+func newObject(t *testing.T, data string) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{}
+	if err := obj.UnmarshalJSON([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
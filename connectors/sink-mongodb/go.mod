@@ -6,9 +6,12 @@ require (
 	github.com/cloudevents/sdk-go/v2 v2.14.0
 	github.com/rs/zerolog v1.31.0
 	github.com/vanus-labs/cdk-go v0.7.7
+	github.com/vanus-labs/connector/internal v0.0.0
 	go.mongodb.org/mongo-driver v1.11.1
 )
 
+replace github.com/vanus-labs/connector/internal v0.0.0 => ../internal
+
 require (
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd/v22 v22.5.0 // indirect
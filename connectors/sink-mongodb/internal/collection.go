@@ -0,0 +1,137 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// errCodeNamespaceExists is returned by the server when the collection already exists.
+const errCodeNamespaceExists = 48
+
+type IndexConfig struct {
+	Name string `json:"name" yaml:"name"`
+	// Keys are the indexed fields in order, a field prefixed with "-" is descending.
+	Keys               []string `json:"keys" yaml:"keys"`
+	Unique             bool     `json:"unique" yaml:"unique"`
+	Sparse             bool     `json:"sparse" yaml:"sparse"`
+	ExpireAfterSeconds *int32   `json:"expire_after_seconds" yaml:"expire_after_seconds"`
+}
+
+func (c *IndexConfig) Validate() error {
+	if len(c.Keys) == 0 {
+		return errors.New("index keys can't be empty")
+	}
+	for _, key := range c.Keys {
+		if strings.TrimPrefix(key, "-") == "" {
+			return fmt.Errorf("invalid index key %q", key)
+		}
+	}
+	if c.ExpireAfterSeconds != nil && len(c.Keys) != 1 {
+		return errors.New("ttl index must have exactly one key")
+	}
+	return nil
+}
+
+func (c *IndexConfig) indexModel() mongo.IndexModel {
+	keys := bson.D{}
+	for _, key := range c.Keys {
+		if strings.HasPrefix(key, "-") {
+			keys = append(keys, bson.E{Key: key[1:], Value: -1})
+		} else {
+			keys = append(keys, bson.E{Key: key, Value: 1})
+		}
+	}
+	opts := options.Index()
+	if c.Name != "" {
+		opts.SetName(c.Name)
+	}
+	if c.Unique {
+		opts.SetUnique(true)
+	}
+	if c.Sparse {
+		opts.SetSparse(true)
+	}
+	if c.ExpireAfterSeconds != nil {
+		opts.SetExpireAfterSeconds(*c.ExpireAfterSeconds)
+	}
+	return mongo.IndexModel{Keys: keys, Options: opts}
+}
+
+type TimeSeriesConfig struct {
+	TimeField          string `json:"time_field" yaml:"time_field"`
+	MetaField          string `json:"meta_field" yaml:"meta_field"`
+	Granularity        string `json:"granularity" yaml:"granularity"`
+	ExpireAfterSeconds int64  `json:"expire_after_seconds" yaml:"expire_after_seconds"`
+}
+
+func (c *TimeSeriesConfig) Validate() error {
+	if c.TimeField == "" {
+		return errors.New("time_series.time_field can't be empty")
+	}
+	switch c.Granularity {
+	case "", "seconds", "minutes", "hours":
+	default:
+		return fmt.Errorf("invalid time_series.granularity %s", c.Granularity)
+	}
+	return nil
+}
+
+func (c *TimeSeriesConfig) createOptions() *options.CreateCollectionOptions {
+	tso := options.TimeSeries().SetTimeField(c.TimeField)
+	if c.MetaField != "" {
+		tso.SetMetaField(c.MetaField)
+	}
+	if c.Granularity != "" {
+		tso.SetGranularity(c.Granularity)
+	}
+	opts := options.CreateCollection().SetTimeSeriesOptions(tso)
+	if c.ExpireAfterSeconds > 0 {
+		opts.SetExpireAfterSeconds(c.ExpireAfterSeconds)
+	}
+	return opts
+}
+
+// prepareCollection creates the time series collection and the indexes declared in config,
+// it's called before the first write of a target, and again after the writer of it is released.
+func (s *mongoSink) prepareCollection(ctx context.Context, t target) error {
+	db := s.dbClient.Database(t.database)
+	if s.cfg.TimeSeries != nil {
+		err := db.CreateCollection(ctx, t.collection, s.cfg.TimeSeries.createOptions())
+		var cmdErr mongo.CommandError
+		if err != nil && !(errors.As(err, &cmdErr) && cmdErr.HasErrorCode(errCodeNamespaceExists)) {
+			return fmt.Errorf("create collection %s error: %s", t, err.Error())
+		}
+	}
+	if len(s.cfg.Indexes) == 0 {
+		return nil
+	}
+	models := make([]mongo.IndexModel, len(s.cfg.Indexes))
+	for i := range s.cfg.Indexes {
+		models[i] = s.cfg.Indexes[i].indexModel()
+	}
+	if _, err := db.Collection(t.collection).Indexes().CreateMany(ctx, models); err != nil {
+		return fmt.Errorf("create indexes on %s error: %s", t, err.Error())
+	}
+	s.logger.Info().Str("target", t.String()).Int("indexes", len(models)).Msg("collection prepared")
+	return nil
+}
@@ -0,0 +1,345 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type FieldType string
+
+const (
+	FieldTypeDate    FieldType = "date"
+	FieldTypeDecimal FieldType = "decimal"
+	FieldTypeLong    FieldType = "long"
+)
+
+func (t FieldType) Validate() error {
+	switch t {
+	case FieldTypeDate, FieldTypeDecimal, FieldTypeLong:
+		return nil
+	default:
+		return fmt.Errorf("invalid field type %s", t)
+	}
+}
+
+// documentConverter converts the event data to a BSON document. The data is parsed as
+// MongoDB Extended JSON in relaxed mode, so $date, $oid, $numberDecimal and $numberLong
+// are kept as their BSON types and integers are not turned into doubles.
+type documentConverter struct {
+	typeHints     map[string]FieldType
+	decimals      map[string]struct{}
+	metadataField string
+}
+
+func newDocumentConverter(cfg *Config) *documentConverter {
+	hints := make(map[string]FieldType, len(cfg.TypeHints)+1)
+	// the time field of a time series collection must be a date.
+	if cfg.TimeSeries != nil {
+		hints[cfg.TimeSeries.TimeField] = FieldTypeDate
+	}
+	decimals := make(map[string]struct{})
+	for path, t := range cfg.TypeHints {
+		hints[path] = t
+		if t == FieldTypeDecimal {
+			decimals[path] = struct{}{}
+		}
+	}
+	return &documentConverter{
+		typeHints:     hints,
+		decimals:      decimals,
+		metadataField: cfg.MetadataField,
+	}
+}
+
+func (c *documentConverter) convert(e *ce.Event) (bson.D, error) {
+	data := e.Data()
+	if len(c.decimals) > 0 {
+		// decimal fields are parsed from the numbers as they are written, since a double
+		// can't hold them exactly.
+		var err error
+		if data, err = quoteDecimals(data, c.decimals); err != nil {
+			return nil, fmt.Errorf("event data is not a valid json object: %s", err.Error())
+		}
+	}
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON(data, false, &doc); err != nil {
+		return nil, fmt.Errorf("event data is not a valid json object: %s", err.Error())
+	}
+	for path, t := range c.typeHints {
+		if err := applyTypeHint(doc, strings.Split(path, "."), t); err != nil {
+			return nil, fmt.Errorf("field %s: %s", path, err.Error())
+		}
+	}
+	if c.metadataField != "" {
+		doc = setField(doc, c.metadataField, eventMetadata(e))
+	}
+	return doc, nil
+}
+
+func applyTypeHint(doc bson.D, path []string, t FieldType) error {
+	for i := range doc {
+		if doc[i].Key != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			v, err := convertValue(doc[i].Value, t)
+			if err != nil {
+				return err
+			}
+			doc[i].Value = v
+			return nil
+		}
+		return applyNestedTypeHint(doc[i].Value, path[1:], t)
+	}
+	return nil
+}
+
+func applyNestedTypeHint(val interface{}, path []string, t FieldType) error {
+	switch v := val.(type) {
+	case bson.D:
+		return applyTypeHint(v, path, t)
+	case bson.A:
+		for _, elem := range v {
+			if err := applyNestedTypeHint(elem, path, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func convertValue(val interface{}, t FieldType) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	switch t {
+	case FieldTypeDate:
+		return toDateTime(val)
+	case FieldTypeDecimal:
+		return toDecimal(val)
+	case FieldTypeLong:
+		return toLong(val)
+	}
+	return val, nil
+}
+
+func toDateTime(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case primitive.DateTime:
+		return v, nil
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return primitive.NewDateTimeFromTime(t), nil
+			}
+		}
+		return nil, fmt.Errorf("can't parse %q as date", v)
+	case int32:
+		return primitive.DateTime(v), nil
+	case int64:
+		return primitive.DateTime(v), nil
+	case float64:
+		// numeric dates are unix milliseconds.
+		return primitive.DateTime(int64(v)), nil
+	}
+	return nil, fmt.Errorf("can't convert %T to date", val)
+}
+
+func toDecimal(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case primitive.Decimal128:
+		return v, nil
+	case string:
+		d, err := primitive.ParseDecimal128(v)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse %q as decimal", v)
+		}
+		return d, nil
+	case int32:
+		return primitive.ParseDecimal128(strconv.FormatInt(int64(v), 10))
+	case int64:
+		return primitive.ParseDecimal128(strconv.FormatInt(v, 10))
+	case float64:
+		// json numbers are parsed as decimals by quoteDecimals, only explicit doubles such
+		// as {"$numberDouble": "0.1"} are left.
+		return primitive.ParseDecimal128(strconv.FormatFloat(v, 'f', -1, 64))
+	}
+	return nil, fmt.Errorf("can't convert %T to decimal", val)
+}
+
+func toLong(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case int64:
+		return v, nil
+	case int32:
+		return int64(v), nil
+	case string:
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse %q as long", v)
+		}
+		return i, nil
+	case float64:
+		if v != math.Trunc(v) || v >= math.MaxInt64 || v < math.MinInt64 {
+			return nil, fmt.Errorf("%v is out of the range of long", v)
+		}
+		return int64(v), nil
+	}
+	return nil, fmt.Errorf("can't convert %T to long", val)
+}
+
+// quoteDecimals rewrites the json numbers at the given paths to {"$numberDecimal": "<number>"},
+// elements of arrays have the path of the array, like applyTypeHint.
+func quoteDecimals(data []byte, paths map[string]struct{}) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var buf bytes.Buffer
+	if err := copyJSONValue(dec, &buf, "", paths); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after the top-level value")
+	}
+	return buf.Bytes(), nil
+}
+
+func copyJSONValue(dec *json.Decoder, buf *bytes.Buffer, path string, paths map[string]struct{}) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		if v == '[' {
+			buf.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err = copyJSONValue(dec, buf, path, paths); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+		} else {
+			buf.WriteByte('{')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				tok, err = dec.Token()
+				if err != nil {
+					return err
+				}
+				key := tok.(string)
+				writeJSONString(buf, key)
+				buf.WriteByte(':')
+				child := key
+				if path != "" {
+					child = path + "." + key
+				}
+				if err = copyJSONValue(dec, buf, child, paths); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte('}')
+		}
+		// the closing delimiter.
+		_, err = dec.Token()
+		return err
+	case json.Number:
+		if _, ok := paths[path]; ok {
+			buf.WriteString(`{"$numberDecimal":`)
+			writeJSONString(buf, v.String())
+			buf.WriteByte('}')
+		} else {
+			buf.WriteString(v.String())
+		}
+	case string:
+		writeJSONString(buf, v)
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case nil:
+		buf.WriteString("null")
+	}
+	return nil
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	buf.Write(b)
+}
+
+func setField(doc bson.D, key string, val interface{}) bson.D {
+	for i := range doc {
+		if doc[i].Key == key {
+			doc[i].Value = val
+			return doc
+		}
+	}
+	return append(doc, bson.E{Key: key, Value: val})
+}
+
+func eventMetadata(e *ce.Event) bson.D {
+	md := bson.D{
+		{Key: "id", Value: e.ID()},
+		{Key: "source", Value: e.Source()},
+		{Key: "type", Value: e.Type()},
+	}
+	if e.Subject() != "" {
+		md = append(md, bson.E{Key: "subject", Value: e.Subject()})
+	}
+	if t := e.Time(); !t.IsZero() {
+		md = append(md, bson.E{Key: "time", Value: primitive.NewDateTimeFromTime(t)})
+	}
+	exts := e.Extensions()
+	if len(exts) == 0 {
+		return md
+	}
+	keys := make([]string, 0, len(exts))
+	for k := range exts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	extDoc := make(bson.D, 0, len(keys))
+	for _, k := range keys {
+		var v interface{}
+		switch ext := exts[k].(type) {
+		case string, bool, int32:
+			v = ext
+		case types.Timestamp:
+			v = primitive.NewDateTimeFromTime(ext.Time)
+		default:
+			v, _ = types.Format(ext)
+		}
+		extDoc = append(extDoc, bson.E{Key: k, Value: v})
+	}
+	return append(md, bson.E{Key: "extensions", Value: extDoc})
+}
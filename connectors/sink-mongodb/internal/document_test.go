@@ -0,0 +1,88 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"math"
+	"testing"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestConvertTypeHints(t *testing.T) {
+	c := newDocumentConverter(&Config{
+		TypeHints: map[string]FieldType{
+			"price":        FieldTypeDecimal,
+			"items.amount": FieldTypeDecimal,
+			"count":        FieldTypeLong,
+			"created":      FieldTypeDate,
+		},
+	})
+	e := ce.NewEvent()
+	e.SetID("1")
+	e.SetSource("test")
+	e.SetType("test")
+	_ = e.SetData(ce.ApplicationJSON, []byte(`{"name":"a<b","price":12345678901234567890.123456789,`+
+		`"items":[{"amount":0.1},{"amount":1e3}],"count":3,"created":"2023-01-02","ratio":0.5}`))
+
+	doc, err := c.convert(&e)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := doc.Map()
+	if m["name"] != "a<b" {
+		t.Fatalf("name is %v", m["name"])
+	}
+	if d, ok := m["price"].(primitive.Decimal128); !ok || d.String() != "12345678901234567890.123456789" {
+		t.Fatalf("price is %v", m["price"])
+	}
+	items := m["items"].(bson.A)
+	if d := items[0].(bson.D).Map()["amount"].(primitive.Decimal128); d.String() != "0.1" {
+		t.Fatalf("the amount of the first item is %v", d)
+	}
+	if d := items[1].(bson.D).Map()["amount"].(primitive.Decimal128); d.String() != "1E+3" {
+		t.Fatalf("the amount of the second item is %v", d)
+	}
+	if m["count"] != int64(3) {
+		t.Fatalf("count is %#v", m["count"])
+	}
+	if _, ok := m["created"].(primitive.DateTime); !ok {
+		t.Fatalf("created is %#v", m["created"])
+	}
+	if m["ratio"] != 0.5 {
+		t.Fatalf("ratio is %#v", m["ratio"])
+	}
+	// the order of the fields is kept.
+	if doc[0].Key != "name" || doc[len(doc)-1].Key != "ratio" {
+		t.Fatalf("the fields are reordered: %v", doc)
+	}
+}
+
+func TestToLong(t *testing.T) {
+	if _, err := toLong(math.Pow(2, 63)); err == nil {
+		t.Fatal("2^63 is converted to long")
+	}
+	if v, err := toLong(math.Pow(-2, 63)); err != nil || v != int64(math.MinInt64) {
+		t.Fatalf("-2^63 is converted to %v, %v", v, err)
+	}
+	if _, err := toLong(1.5); err == nil {
+		t.Fatal("1.5 is converted to long")
+	}
+	if v, err := toLong("42"); err != nil || v != int64(42) {
+		t.Fatalf("\"42\" is converted to %v, %v", v, err)
+	}
+}
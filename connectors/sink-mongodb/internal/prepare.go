@@ -0,0 +1,71 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"sync"
+)
+
+// preparation is the preparation of a target, the events to the target wait for it.
+type preparation struct {
+	done chan struct{}
+	err  error
+}
+
+// preparations runs the preparation of each target once, the preparations of different targets
+// don't block each other, and a failed preparation is run again by the next event.
+type preparations struct {
+	lock  sync.Mutex
+	items map[string]*preparation
+}
+
+func newPreparations() *preparations {
+	return &preparations{items: map[string]*preparation{}}
+}
+
+// do runs fn if the target isn't prepared, or waits for the running preparation of the target.
+func (p *preparations) do(ctx context.Context, key string, fn func(ctx context.Context) error) error {
+	p.lock.Lock()
+	item, ok := p.items[key]
+	if !ok {
+		item = &preparation{done: make(chan struct{})}
+		p.items[key] = item
+	}
+	p.lock.Unlock()
+	if ok {
+		select {
+		case <-item.done:
+			return item.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	item.err = fn(ctx)
+	if item.err != nil {
+		p.forget(key)
+	}
+	close(item.done)
+	return item.err
+}
+
+// forget removes the target, it's prepared again by the next event, so the targets no longer
+// written don't stay in memory.
+func (p *preparations) forget(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.items, key)
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreparationsRunOnce(t *testing.T) {
+	p := newPreparations()
+	var calls int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.do(context.Background(), "db.coll", func(ctx context.Context) error {
+				atomic.AddInt32(&calls, 1)
+				time.Sleep(10 * time.Millisecond)
+				return nil
+			})
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("the preparation runs %d times, want 1", calls)
+	}
+}
+
+func TestPreparationsSlowTargetDoesNotBlockOthers(t *testing.T) {
+	p := newPreparations()
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go func() {
+		_ = p.do(context.Background(), "slow.coll", func(ctx context.Context) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+	defer close(release)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- p.do(context.Background(), "fast.coll", func(ctx context.Context) error { return nil })
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the preparation of fast.coll is blocked by slow.coll")
+	}
+
+	// the events to the slow target give up when their context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := p.do(ctx, "slow.coll", func(ctx context.Context) error { return nil })
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPreparationsRetryAndForget(t *testing.T) {
+	p := newPreparations()
+	var calls int
+	fn := func(ctx context.Context) error {
+		calls++
+		if calls == 1 {
+			return errors.New("unreachable")
+		}
+		return nil
+	}
+	if err := p.do(context.Background(), "db.coll", fn); err == nil {
+		t.Fatal("want the error of the first preparation")
+	}
+	if err := p.do(context.Background(), "db.coll", fn); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.do(context.Background(), "db.coll", fn); err != nil || calls != 2 {
+		t.Fatalf("got error %v and %d calls, want the prepared target to be skipped", err, calls)
+	}
+	p.forget("db.coll")
+	if len(p.items) != 0 {
+		t.Fatalf("got %d targets, want 0 after forget", len(p.items))
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"fmt"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+
+	"github.com/vanus-labs/connector/internal/placeholder"
+)
+
+// nameTemplate expands placeholders in a database or collection name, see placeholder.Expand.
+type nameTemplate struct {
+	raw string
+}
+
+func newNameTemplate(raw string) nameTemplate {
+	return nameTemplate{raw: raw}
+}
+
+func (t nameTemplate) execute(e *ce.Event, loc *time.Location) (string, error) {
+	name, err := placeholder.Expand(t.raw, e, loc)
+	if err != nil {
+		return "", fmt.Errorf("mongodb: %s", err.Error())
+	}
+	return name, nil
+}
+
+// target is the database and collection which an event is written to.
+type target struct {
+	database   string
+	collection string
+}
+
+func (t target) String() string {
+	return t.database + "." + t.collection
+}
+
+type router struct {
+	database   nameTemplate
+	collection nameTemplate
+	location   *time.Location
+}
+
+func newRouter(cfg *Config) (*router, error) {
+	loc, err := placeholder.LoadLocation(cfg.TimeZone)
+	if err != nil {
+		return nil, err
+	}
+	return &router{
+		database:   newNameTemplate(cfg.Database),
+		collection: newNameTemplate(cfg.Collection),
+		location:   loc,
+	}, nil
+}
+
+// route resolves the target of an event, the extension attributes take precedence
+// over the configured names and both of them may contain placeholders.
+func (r *router) route(e *ce.Event) (target, error) {
+	db, err := r.resolve(e, mongoDatabase, r.database)
+	if err != nil {
+		return target{}, err
+	}
+	coll, err := r.resolve(e, mongoCollection, r.collection)
+	if err != nil {
+		return target{}, err
+	}
+	return target{database: db, collection: coll}, nil
+}
+
+func (r *router) resolve(e *ce.Event, attr string, defaultTemplate nameTemplate) (string, error) {
+	tpl := defaultTemplate
+	val, exist := e.Extensions()[attr]
+	if exist && val != nil {
+		str, ok := val.(string)
+		if !ok {
+			return "", fmt.Errorf("mongodb: invalid attribute %s=%v", attr, val)
+		}
+		tpl = newNameTemplate(str)
+	}
+	name, err := tpl.execute(e, r.location)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", fmt.Errorf("mongodb: empty name resolved from attribute %s", attr)
+	}
+	return name, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"testing"
+	"time"
+
+	ce "github.com/cloudevents/sdk-go/v2"
+)
+
+func TestRoute(t *testing.T) {
+	cases := []struct {
+		name       string
+		database   string
+		collection string
+		timeZone   string
+		extensions map[string]interface{}
+		want       string
+		wantErr    bool
+	}{
+		{name: "static", database: "db", collection: "events", want: "db.events"},
+		{name: "time", database: "db", collection: "events_{yyyy_MM_dd}", want: "db.events_2023_03_31"},
+		{name: "time zone", database: "db", collection: "events_{yyyy_MM_dd}", timeZone: "Asia/Shanghai",
+			want: "db.events_2023_04_01"},
+		{name: "attribute", database: "db", collection: "{type}_{xvtenant}",
+			extensions: map[string]interface{}{"xvtenant": "t1"}, want: "db.order_t1"},
+		{name: "extension", database: "db", collection: "events",
+			extensions: map[string]interface{}{mongoDatabase: "db_{xvtenant}", "xvtenant": "t2"}, want: "db_t2.events"},
+		{name: "missing attribute", database: "db", collection: "{xvtenant}", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := newRouter(&Config{Database: c.database, Collection: c.collection, TimeZone: c.timeZone})
+			if err != nil {
+				t.Fatal(err)
+			}
+			e := ce.NewEvent()
+			e.SetID("1")
+			e.SetType("order")
+			e.SetTime(time.Date(2023, 3, 31, 20, 0, 0, 0, time.UTC))
+			for k, v := range c.extensions {
+				e.SetExtension(k, v)
+			}
+			got, err := r.route(&e)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != c.want {
+				t.Fatalf("got %s, want %s", got, c.want)
+			}
+		})
+	}
+}
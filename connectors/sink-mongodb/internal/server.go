@@ -16,7 +16,6 @@ package internal
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"sync"
@@ -35,9 +34,13 @@ import (
 )
 
 const (
+	mongoDatabase   = "xvdb"
 	mongoCollection = "xvcoll"
 
 	name = "Sink MongoDB"
+
+	// writerIdleIntervals is the number of flush intervals without writes after which a writer is released.
+	writerIdleIntervals = 30
 )
 
 var _ cdkgo.SinkConfigAccessor = &Config{}
@@ -50,6 +53,14 @@ type Config struct {
 	Credential       Credential `json:"credential" yaml:"credential"`
 	BulkSize         int        `json:"bulk_size" yaml:"bulk_size"`
 	FlushInterval    int        `json:"flush_interval" yaml:"flush_interval"`
+	// TimeZone is used to format the time placeholders of database and collection names.
+	TimeZone   string            `json:"time_zone" yaml:"time_zone"`
+	Indexes    []IndexConfig     `json:"indexes" yaml:"indexes"`
+	TimeSeries *TimeSeriesConfig `json:"time_series" yaml:"time_series"`
+	// TypeHints converts the fields of event data to BSON types, nested fields are separated by dot.
+	TypeHints map[string]FieldType `json:"type_hints" yaml:"type_hints"`
+	// MetadataField is the field to embed CloudEvent attributes in, empty means not embedded.
+	MetadataField string `json:"metadata_field" yaml:"metadata_field"`
 }
 
 type Credential struct {
@@ -71,6 +82,21 @@ func (c *Config) Validate() error {
 	if c.FlushInterval == 0 {
 		c.FlushInterval = 2000
 	}
+	for i := range c.Indexes {
+		if err := c.Indexes[i].Validate(); err != nil {
+			return err
+		}
+	}
+	if c.TimeSeries != nil {
+		if err := c.TimeSeries.Validate(); err != nil {
+			return err
+		}
+	}
+	for path, t := range c.TypeHints {
+		if err := t.Validate(); err != nil {
+			return fmt.Errorf("type_hints.%s: %s", path, err.Error())
+		}
+	}
 	return c.SinkConfig.Validate()
 }
 
@@ -98,7 +124,10 @@ var _ cdkgo.Sink = &mongoSink{}
 
 type mongoSink struct {
 	cfg      *Config
+	router   *router
+	conv     *documentConverter
 	writer   map[string]*InsertWriter
+	prepared *preparations
 	dbClient *mongo.Client
 	logger   zerolog.Logger
 	lock     sync.Mutex
@@ -107,8 +136,9 @@ type mongoSink struct {
 
 func NewMongoSink() cdkgo.Sink {
 	return &mongoSink{
-		writer: map[string]*InsertWriter{},
-		stop:   make(chan bool),
+		writer:   map[string]*InsertWriter{},
+		prepared: newPreparations(),
+		stop:     make(chan bool),
 	}
 }
 
@@ -116,6 +146,12 @@ func (s *mongoSink) Initialize(ctx context.Context, cfg config.ConfigAccessor) e
 	c, _ := cfg.(*Config)
 	s.logger = log.FromContext(ctx)
 	s.cfg = c
+	r, err := newRouter(c)
+	if err != nil {
+		return err
+	}
+	s.router = r
+	s.conv = newDocumentConverter(c)
 	clientOptions := options.Client().ApplyURI(s.cfg.ConnectionURI)
 	if s.cfg.Credential.IsSet() {
 		clientOptions.Auth = s.cfg.Credential.GetMongoDBCredential()
@@ -153,10 +189,17 @@ func (s *mongoSink) start() {
 func (s *mongoSink) flush() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	for collName, writer := range s.writer {
+	idleTimeout := writerIdleIntervals * time.Duration(s.cfg.FlushInterval) * time.Millisecond
+	for key, writer := range s.writer {
 		err := writer.Flush()
 		if err != nil {
-			s.logger.Warn().Str("collection", collName).Msg("flush error")
+			s.logger.Warn().Err(err).Str("target", key).Msg("flush error")
+			continue
+		}
+		// time bucketed collections stop receiving events, release their writers.
+		if writer.Idle(idleTimeout) {
+			delete(s.writer, key)
+			s.prepared.forget(key)
 		}
 	}
 }
@@ -176,41 +219,51 @@ func (s *mongoSink) Name() string {
 func (s *mongoSink) Arrived(ctx context.Context, events ...*ce.Event) connector.Result {
 	for idx := range events {
 		e := events[idx]
-		coll, err := getAttr(e, mongoCollection, s.cfg.Collection)
+		t, err := s.router.route(e)
 		if err != nil {
 			return cdkgo.NewResult(http.StatusBadRequest, err.Error())
 		}
-		collName := coll
-		var data interface{}
-		if err := json.Unmarshal(e.Data(), &data); err != nil {
+		data, err := s.conv.convert(e)
+		if err != nil {
 			return cdkgo.NewResult(http.StatusBadRequest, err.Error())
 		}
-		writer := s.getWriter(collName)
+		writer, err := s.getWriter(ctx, t)
+		if err != nil {
+			return cdkgo.NewResult(http.StatusInternalServerError, err.Error())
+		}
 		writer.Write(data)
 	}
 	return cdkgo.SuccessResult
 }
 
-func (s *mongoSink) getWriter(collName string) *InsertWriter {
+func (s *mongoSink) getWriter(ctx context.Context, t target) (*InsertWriter, error) {
+	key := t.String()
 	s.lock.Lock()
-	defer s.lock.Unlock()
-	writer, ok := s.writer[collName]
-	if !ok {
-		writer = NewInsertWriter(s.dbClient, s.logger, s.cfg.Database, collName, s.cfg.BulkSize)
-		s.writer[collName] = writer
+	writer, ok := s.writer[key]
+	if ok {
+		// keep the writer from being released before the event is written.
+		writer.Touch()
 	}
-	return writer
-}
-
-func getAttr(e *ce.Event, key, defaultValue string) (string, error) {
-	val, exist := e.Extensions()[key]
-	if val == nil && !exist {
-		return defaultValue, nil
+	s.lock.Unlock()
+	if ok {
+		return writer, nil
 	}
-
-	str, ok := val.(string)
-	if !ok {
-		return "", fmt.Errorf("mongodb: invalid attribute %s=%v", key, val)
+	// the collection is prepared without the lock, so a slow database doesn't block the events to
+	// other collections.
+	err := s.prepared.do(ctx, key, func(ctx context.Context) error {
+		return s.prepareCollection(ctx, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	writer, ok = s.writer[key]
+	if ok {
+		writer.Touch()
+		return writer, nil
 	}
-	return str, nil
+	writer = NewInsertWriter(s.dbClient, s.logger, t.database, t.collection, s.cfg.BulkSize)
+	s.writer[key] = writer
+	return writer, nil
 }
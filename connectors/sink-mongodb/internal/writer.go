@@ -17,6 +17,7 @@ package internal
 import (
 	"context"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -27,6 +28,7 @@ type InsertWriter struct {
 	data      []interface{}
 	size      int
 	flushSize int
+	lastWrite time.Time
 	coll      *mongo.Collection
 	logger    zerolog.Logger
 }
@@ -37,6 +39,7 @@ func NewInsertWriter(dbClient *mongo.Client, logger zerolog.Logger, dbName, coll
 		coll:      dbClient.Database(dbName).Collection(collName),
 		logger:    logger,
 		flushSize: flushSize,
+		lastWrite: time.Now(),
 	}
 }
 
@@ -51,12 +54,27 @@ func (w *InsertWriter) Write(data interface{}) {
 	defer w.lock.Unlock()
 	w.data = append(w.data, data)
 	w.size++
+	w.lastWrite = time.Now()
 	if w.size >= w.flushSize {
-		err := w.flush()
-		w.logger.Warn().Err(err).Str("collection", w.coll.Name()).Msg("insert failed")
+		if err := w.flush(); err != nil {
+			w.logger.Warn().Err(err).Str("collection", w.coll.Name()).Msg("insert failed")
+		}
 	}
 }
 
+func (w *InsertWriter) Touch() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.lastWrite = time.Now()
+}
+
+// Idle reports whether the writer is empty and has not been written for the duration.
+func (w *InsertWriter) Idle(d time.Duration) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.size == 0 && time.Since(w.lastWrite) > d
+}
+
 func (w *InsertWriter) Flush() error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
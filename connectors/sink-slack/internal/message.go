@@ -0,0 +1,235 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	v2 "github.com/cloudevents/sdk-go/v2"
+	"github.com/slack-go/slack"
+)
+
+type action string
+
+const (
+	actionPost      = action("post")
+	actionUpdate    = action("update")
+	actionDelete    = action("delete")
+	actionEphemeral = action("ephemeral")
+	actionUpload    = action("upload")
+
+	// maxFileSize is the max size of files to upload, the file is held in memory while it's uploaded.
+	maxFileSize         = 100 << 20
+	fileDownloadTimeout = time.Minute
+)
+
+// downloadClient downloads the files of upload messages.
+var downloadClient = &http.Client{Timeout: fileDownloadTimeout}
+
+// downloadError is the error of downloading a file, it's retryable if the server fails.
+type downloadError struct {
+	error
+	retryable bool
+}
+
+type Message struct {
+	// Text is the text of message, it's the fallback text shown in notifications if there are
+	// blocks.
+	Text string `json:"text"`
+	// Mrkdwn is whether the text is formatted by mrkdwn, it's true by default.
+	Mrkdwn *bool         `json:"mrkdwn"`
+	Blocks *slack.Blocks `json:"blocks"`
+	// ThreadTS is the ts of the parent message, the message is a reply in the thread.
+	ThreadTS string `json:"thread_ts"`
+	// ReplyBroadcast is whether the reply is also sent to the channel.
+	ReplyBroadcast bool `json:"reply_broadcast"`
+	// TS is the ts of the message to update or delete.
+	TS string `json:"ts"`
+	// User is the user the ephemeral message is visible to.
+	User string `json:"user"`
+	File *File  `json:"file"`
+
+	action action
+}
+
+type File struct {
+	// Content is the base64 encoded content of file.
+	Content        string `json:"content"`
+	URL            string `json:"url"`
+	Filename       string `json:"filename"`
+	Title          string `json:"title"`
+	InitialComment string `json:"initial_comment"`
+
+	// data is the decoded content of file, or the downloaded content while it's uploaded.
+	data []byte
+}
+
+// newMessage converts the event to a message, the data which isn't a json object is sent as plain
+// text. The file url of an upload message is downloaded when the message is delivered.
+func newMessage(event *v2.Event) (*Message, error) {
+	m := &Message{}
+	data := bytes.TrimSpace(event.Data())
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+	} else {
+		m.Text = string(data)
+		if len(data) > 0 && data[0] == '"' {
+			if err := json.Unmarshal(data, &m.Text); err != nil {
+				return nil, err
+			}
+		}
+		mrkdwn := false
+		m.Mrkdwn = &mrkdwn
+	}
+	m.action = actionPost
+	if a, ok := event.Extensions()[xvAction].(string); ok && a != "" {
+		m.action = action(a)
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Message) hasContent() bool {
+	return m.Text != "" || (m.Blocks != nil && len(m.Blocks.BlockSet) > 0)
+}
+
+func (m *Message) validate() error {
+	switch m.action {
+	case actionPost:
+		if !m.hasContent() {
+			return fmt.Errorf("the message must have text or blocks")
+		}
+	case actionUpdate:
+		if m.TS == "" || !m.hasContent() {
+			return fmt.Errorf("the message to update must have ts, and text or blocks")
+		}
+	case actionDelete:
+		if m.TS == "" {
+			return fmt.Errorf("the message to delete must have ts")
+		}
+	case actionEphemeral:
+		if m.User == "" || !m.hasContent() {
+			return fmt.Errorf("the ephemeral message must have user, and text or blocks")
+		}
+	case actionUpload:
+		if m.File == nil || (m.File.Content == "" && m.File.URL == "") {
+			return fmt.Errorf("the file to upload must have content or url")
+		}
+		if m.File.Content == "" {
+			// only the files on the web are downloaded, not the files of the sink itself.
+			u, err := url.Parse(m.File.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("the url of file must be an http or https url")
+			}
+		} else {
+			data, err := base64.StdEncoding.DecodeString(m.File.Content)
+			if err != nil {
+				return fmt.Errorf("the content of file must be base64 encoded: %w", err)
+			}
+			if len(data) > maxFileSize {
+				return fmt.Errorf("the file is larger than %d bytes", maxFileSize)
+			}
+			m.File.data = data
+		}
+	default:
+		return fmt.Errorf("unsupported action %s, only post, update, delete, ephemeral and upload are supported",
+			m.action)
+	}
+	return nil
+}
+
+// options returns the options of text, blocks and thread of the message.
+func (m *Message) options() []slack.MsgOption {
+	var opts []slack.MsgOption
+	if m.Text != "" {
+		opts = append(opts, slack.MsgOptionText(m.Text, false))
+	}
+	if m.Mrkdwn != nil && !*m.Mrkdwn {
+		opts = append(opts, slack.MsgOptionDisableMarkdown())
+	}
+	if m.Blocks != nil && len(m.Blocks.BlockSet) > 0 {
+		opts = append(opts, slack.MsgOptionBlocks(m.Blocks.BlockSet...))
+	}
+	if m.ThreadTS != "" {
+		opts = append(opts, slack.MsgOptionTS(m.ThreadTS))
+		if m.ReplyBroadcast {
+			opts = append(opts, slack.MsgOptionBroadcast())
+		}
+	}
+	return opts
+}
+
+// filename returns the name of file, it's the last part of url if it's not set.
+func (f *File) filename() string {
+	if f.Filename != "" {
+		return f.Filename
+	}
+	if f.URL != "" {
+		name := f.URL
+		if idx := strings.IndexAny(name, "?#"); idx >= 0 {
+			name = name[:idx]
+		}
+		if idx := strings.LastIndex(name, "/"); idx >= 0 && idx < len(name)-1 {
+			return name[idx+1:]
+		}
+	}
+	return "file"
+}
+
+// download downloads the file from the url, a file larger than the limit is rejected rather than
+// read into memory. The file is downloaded when it's delivered, so only the files being uploaded
+// are held in memory.
+func (f *File) download(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.URL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid file url: %w", err)
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return &downloadError{error: fmt.Errorf("download file failed: %w", err), retryable: true}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &downloadError{
+			error:     fmt.Errorf("download file failed: %s", resp.Status),
+			retryable: resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusTooManyRequests,
+		}
+	}
+	if resp.ContentLength > maxFileSize {
+		return &downloadError{error: fmt.Errorf("the file is larger than %d bytes", maxFileSize)}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFileSize+1))
+	if err != nil {
+		return &downloadError{error: fmt.Errorf("download file failed: %w", err), retryable: true}
+	}
+	if len(data) > maxFileSize {
+		return &downloadError{error: fmt.Errorf("the file is larger than %d bytes", maxFileSize)}
+	}
+	f.data = data
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	v2 "github.com/cloudevents/sdk-go/v2"
+)
+
+func newUploadEvent(t *testing.T, file map[string]string) *v2.Event {
+	e := v2.NewEvent()
+	e.SetID("1")
+	e.SetExtension(xvAction, string(actionUpload))
+	data, err := json.Marshal(map[string]interface{}{"file": file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = e.SetData(v2.ApplicationJSON, data)
+	return &e
+}
+
+func TestNewMessageFileContent(t *testing.T) {
+	m, err := newMessage(newUploadEvent(t, map[string]string{"content": "aGVsbG8="}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.File.data) != "hello" {
+		t.Errorf("got %q, want the decoded content", m.File.data)
+	}
+	if _, err = newMessage(newUploadEvent(t, map[string]string{"content": "!"})); err == nil {
+		t.Error("want error of invalid base64")
+	}
+}
+
+func TestNewMessageFileURL(t *testing.T) {
+	var downloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		switch r.URL.Path {
+		case "/file.txt":
+			_, _ = w.Write([]byte("hello"))
+		case "/large":
+			w.Header().Set("Content-Length", strconv.Itoa(maxFileSize+1))
+		case "/unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	m, err := newMessage(newUploadEvent(t, map[string]string{"url": srv.URL + "/file.txt"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file is downloaded when it's delivered.
+	if n := atomic.LoadInt32(&downloads); n != 0 || m.File.data != nil {
+		t.Fatalf("got %d downloads when the message is built, want 0", n)
+	}
+	if err = m.File.download(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if string(m.File.data) != "hello" || m.File.filename() != "file.txt" {
+		t.Errorf("got %s %q, want the downloaded file", m.File.filename(), m.File.data)
+	}
+
+	cases := []struct {
+		path          string
+		wantRetryable bool
+	}{
+		{path: "/large"},
+		{path: "/missing"},
+		{path: "/unavailable", wantRetryable: true},
+	}
+	for _, c := range cases {
+		f := &File{URL: srv.URL + c.path}
+		err = f.download(context.Background())
+		var downloadErr *downloadError
+		if !errors.As(err, &downloadErr) {
+			t.Fatalf("%s: got %v, want a download error", c.path, err)
+		}
+		if downloadErr.retryable != c.wantRetryable {
+			t.Errorf("%s: got retryable %t, want %t", c.path, downloadErr.retryable, c.wantRetryable)
+		}
+	}
+}
+
+func TestNewMessageRejectsNonHTTPFileURL(t *testing.T) {
+	for _, u := range []string{"file:///etc/passwd", "ftp://example.com/a.txt", "/tmp/a.txt", "http://", "gopher://a"} {
+		if _, err := newMessage(newUploadEvent(t, map[string]string{"url": u})); err == nil {
+			t.Errorf("%s: want error", u)
+		}
+	}
+}
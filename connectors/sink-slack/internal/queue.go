@@ -0,0 +1,199 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	v2 "github.com/cloudevents/sdk-go/v2"
+	"github.com/slack-go/slack"
+	"golang.org/x/time/rate"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+	"github.com/vanus-labs/connector/internal/keyed"
+)
+
+const (
+	defaultRateLimit    = 1
+	defaultBurst        = 1
+	defaultMaxRetries   = 5
+	defaultRetryBackoff = 1000
+	// channelIdleTimeout releases the state of a channel which has no messages, it's far longer
+	// than the limiter takes to recover.
+	channelIdleTimeout = 10 * time.Minute
+	// deliveredTTL is how long the delivered events of a channel are remembered, so a redelivered
+	// batch isn't posted again to the channels which have got it.
+	deliveredTTL = channelIdleTimeout
+)
+
+// channelState is the state of the messages to a channel.
+type channelState struct {
+	limiter *rate.Limiter
+	// delivered is the time the events are delivered to the channel.
+	delivered map[string]time.Time
+}
+
+// prune drops the delivered events older than deliveredTTL.
+func (c *channelState) prune(now time.Time) {
+	for key, t := range c.delivered {
+		if now.Sub(t) > deliveredTTL {
+			delete(c.delivered, key)
+		}
+	}
+}
+
+// eventKey identifies the event, the id is unique within its source.
+func eventKey(e *v2.Event) string {
+	return e.Source() + "\x00" + e.ID()
+}
+
+// delivery is a message of an event to a channel of a workspace.
+type delivery struct {
+	event   *v2.Event
+	ws      *workspace
+	channel string
+	msg     *Message
+}
+
+// newChannelQueues returns the queues of channels, the messages to a channel are sent one by
+// one within the rate limit of Slack, which is about a message per second per channel.
+func newChannelQueues(cfg *slackConfig) *keyed.Queues[*channelState] {
+	return keyed.NewQueues(channelIdleTimeout, func(string) *channelState {
+		return &channelState{
+			limiter:   rate.NewLimiter(rate.Limit(cfg.RateLimit), cfg.Burst),
+			delivered: map[string]time.Time{},
+		}
+	})
+}
+
+// deliverAll sends the messages to a channel in order. The events are redelivered together, so
+// the messages after a failed one aren't sent, or they would be posted ahead of it. The messages
+// delivered to the channel before are skipped when the events are redelivered, and a message
+// whose file can't be downloaded is skipped like an invalid event.
+func (e *slackSink) deliverAll(ctx context.Context, key string, deliveries []delivery) cdkgo.Result {
+	result := cdkgo.SuccessResult
+	e.channels.Do(key, func(state *channelState) {
+		state.prune(time.Now())
+		for _, d := range deliveries {
+			if _, ok := state.delivered[eventKey(d.event)]; ok {
+				e.logger.Info().Str("workspace", d.ws.name).Str("channel", d.channel).
+					Str("event_id", d.event.ID()).Msg("the event is delivered, skip it")
+				continue
+			}
+			err := e.deliverOne(ctx, state.limiter, d)
+			var downloadErr *downloadError
+			if errors.As(err, &downloadErr) && !downloadErr.retryable {
+				continue
+			}
+			if err != nil {
+				result = errorResult(err)
+				return
+			}
+			state.delivered[eventKey(d.event)] = time.Now()
+		}
+	})
+	return result
+}
+
+func (e *slackSink) deliverOne(ctx context.Context, limiter *rate.Limiter, d delivery) error {
+	start := time.Now()
+	if d.msg.action == actionUpload && d.msg.File.data == nil {
+		// the file is downloaded once for the retries of the upload, and released after it.
+		if err := d.msg.File.download(ctx); err != nil {
+			e.logger.Error().Err(err).Str("workspace", d.ws.name).Str("channel", d.channel).
+				Str("event_id", d.event.ID()).Msg("failed to download file")
+			return err
+		}
+		defer func() { d.msg.File.data = nil }()
+	}
+	ts, err := e.deliver(ctx, limiter, d)
+	if err != nil {
+		e.logger.Error().Err(err).Str("workspace", d.ws.name).Str("channel", d.channel).
+			Str("event_id", d.event.ID()).Str("action", string(d.msg.action)).Msg("failed to send slack")
+		return err
+	} else if time.Now().Sub(start) > time.Second {
+		e.logger.Info().Str("workspace", d.ws.name).Str("channel", d.channel).Str("event_id", d.event.ID()).
+			Str("ts", ts).Interface("used_time", time.Now().Sub(start)).
+			Msg("success to send slack, but takes too long")
+	} else {
+		e.logger.Info().Str("workspace", d.ws.name).Str("channel", d.channel).Str("event_id", d.event.ID()).
+			Str("ts", ts).Msg("success to send slack")
+	}
+	return nil
+}
+
+// deliver sends the message, it waits for the retry-after hint if slack rate limits it, and
+// retries with backoff if slack fails.
+func (e *slackSink) deliver(ctx context.Context, limiter *rate.Limiter, d delivery) (string, error) {
+	backoff := time.Duration(e.cfg.RetryBackoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if err := limiter.Wait(ctx); err != nil {
+			return "", err
+		}
+		ts, err := e.send(ctx, d.ws, d.channel, d.msg)
+		if err == nil {
+			return ts, nil
+		}
+		var (
+			wait         time.Duration
+			rateLimitErr *slack.RateLimitedError
+			statusErr    slack.StatusCodeError
+		)
+		switch {
+		case errors.As(err, &rateLimitErr):
+			wait = rateLimitErr.RetryAfter
+		case errors.As(err, &statusErr) && statusErr.Retryable():
+			wait = backoff << attempt
+		default:
+			return "", err
+		}
+		if attempt >= *e.cfg.MaxRetries {
+			return "", err
+		}
+		e.logger.Info().Err(err).Str("workspace", d.ws.name).Str("channel", d.channel).Str("event_id", d.event.ID()).
+			Int("attempt", attempt+1).Dur("wait", wait).Msg("failed to send slack, will retry")
+		select {
+		case <-ctx.Done():
+			return "", err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func errorResult(err error) cdkgo.Result {
+	var (
+		rateLimitErr *slack.RateLimitedError
+		statusErr    slack.StatusCodeError
+		slackErr     slack.SlackErrorResponse
+		downloadErr  *downloadError
+	)
+	switch {
+	case errors.As(err, &downloadErr) && downloadErr.retryable:
+		return cdkgo.NewResult(http.StatusInternalServerError, "slack: "+err.Error())
+	case errors.As(err, &downloadErr):
+		return cdkgo.NewResult(http.StatusBadRequest, errInvalidMessage.GetMsg()+": "+err.Error())
+	case errors.As(err, &rateLimitErr):
+		return cdkgo.NewResult(http.StatusTooManyRequests, "slack: "+err.Error())
+	case errors.As(err, &statusErr) && !statusErr.Retryable():
+		return cdkgo.NewResult(http.StatusBadRequest, "slack: "+err.Error())
+	case errors.As(err, &slackErr):
+		// the request is rejected by slack, e.g. channel_not_found, not_in_channel.
+		return cdkgo.NewResult(http.StatusBadRequest, "slack: "+err.Error())
+	}
+	return cdkgo.NewResult(http.StatusInternalServerError, "slack: failed to send message: "+err.Error())
+}
@@ -0,0 +1,231 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v2 "github.com/cloudevents/sdk-go/v2"
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+)
+
+// fakeSlack records the texts posted to each channel by chat.postMessage.
+type fakeSlack struct {
+	*httptest.Server
+	lock  sync.Mutex
+	texts map[string][]string
+	// block is waited for before a message to the channel slow is handled.
+	block chan struct{}
+}
+
+func newFakeSlack(t *testing.T) *fakeSlack {
+	f := &fakeSlack{texts: map[string][]string{}, block: make(chan struct{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		channel, text := r.FormValue("channel"), r.FormValue("text")
+		if channel == "slow" {
+			<-f.block
+		}
+		f.lock.Lock()
+		f.texts[channel] = append(f.texts[channel], text)
+		f.lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasPrefix(text, "fail") {
+			_, _ = w.Write([]byte(`{"ok":false,"error":"not_in_channel"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"channel":"` + channel + `","ts":"1.0"}`))
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSlack) received(channel string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string(nil), f.texts[channel]...)
+}
+
+func newTestSink(t *testing.T, f *fakeSlack) *slackSink {
+	cfg := &slackConfig{Token: "xoxb-test", DefaultChannel: "general", RateLimit: 1000, Burst: 1000}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &slackSink{
+		cfg:       cfg,
+		defaultWS: newWorkspace("", cfg.defaultWorkspace(), slack.OptionAPIURL(f.URL+"/")),
+		logger:    zerolog.Nop(),
+		channels:  newChannelQueues(cfg),
+	}
+}
+
+func newTestEvent(channel, text string) *v2.Event {
+	e := v2.NewEvent()
+	e.SetID(text)
+	e.SetExtension(xvChannel, channel)
+	_ = e.SetData(v2.TextPlain, text)
+	return &e
+}
+
+func TestArrivedInOrderPerChannel(t *testing.T) {
+	f := newFakeSlack(t)
+	s := newTestSink(t, f)
+	result := s.Arrived(context.Background(),
+		newTestEvent("a", "a1"),
+		newTestEvent("b", "b1"),
+		newTestEvent("a", "fail a2"),
+		newTestEvent("b", "b2"),
+		newTestEvent("a", "a3"),
+	)
+	if result.GetCode() != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want the failure of a2", result.GetCode(), result.GetMsg())
+	}
+	if got, want := f.received("a"), []string{"a1", "fail a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v, a3 mustn't be sent after a2 fails", got, want)
+	}
+	if got, want := f.received("b"), []string{"b1", "b2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSlowChannelDoesNotBlockOthers(t *testing.T) {
+	f := newFakeSlack(t)
+	s := newTestSink(t, f)
+	done := make(chan cdkgo.Result, 1)
+	go func() {
+		done <- s.Arrived(context.Background(), newTestEvent("slow", "s1"))
+	}()
+	if result := s.Arrived(context.Background(), newTestEvent("b", "b1")); result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+	close(f.block)
+	if result := <-done; result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+	if n := s.channels.Len(); n != 2 {
+		t.Errorf("got %d channel queues, want 2", n)
+	}
+}
+
+func TestArrivedSkipsInvalidEvents(t *testing.T) {
+	f := newFakeSlack(t)
+	s := newTestSink(t, f)
+	unsupported := newTestEvent("a", "a2")
+	unsupported.SetExtension(xvAction, "bogus")
+	noWorkspace := newTestEvent("a", "a3")
+	noWorkspace.SetExtension(xvWorkspace, "missing")
+	result := s.Arrived(context.Background(), newTestEvent("a", "a1"), unsupported, noWorkspace,
+		newTestEvent("a", "a4"))
+	if result != cdkgo.SuccessResult {
+		t.Fatalf("got %s, want the invalid events skipped", result.GetMsg())
+	}
+	if got, want := f.received("a"), []string{"a1", "a4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRedeliveryIsNotPostedAgain(t *testing.T) {
+	var (
+		lock     sync.Mutex
+		texts    = map[string][]string{}
+		failures = map[string]int{"b2": 1}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		channel, text := r.FormValue("channel"), r.FormValue("text")
+		lock.Lock()
+		defer lock.Unlock()
+		texts[channel] = append(texts[channel], text)
+		w.Header().Set("Content-Type", "application/json")
+		if failures[text] > 0 {
+			failures[text]--
+			_, _ = w.Write([]byte(`{"ok":false,"error":"not_in_channel"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"ok":true,"channel":"` + channel + `","ts":"1.0"}`))
+	}))
+	defer srv.Close()
+	s := newTestSink(t, &fakeSlack{Server: srv})
+
+	events := []*v2.Event{newTestEvent("a", "a1"), newTestEvent("b", "b1"), newTestEvent("b", "b2"),
+		newTestEvent("b", "b3")}
+	if result := s.Arrived(context.Background(), events...); result.GetCode() != http.StatusBadRequest {
+		t.Fatalf("got %d %s, want the failure of b2", result.GetCode(), result.GetMsg())
+	}
+	// the redelivered batch is posted from the failed message.
+	if result := s.Arrived(context.Background(), events...); result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if got, want := texts["a"], []string{"a1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := texts["b"], []string{"b1", "b2", "b2", "b3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestChannelStatePrune(t *testing.T) {
+	now := time.Now()
+	state := &channelState{delivered: map[string]time.Time{
+		"old": now.Add(-deliveredTTL - time.Second),
+		"new": now.Add(-time.Second),
+	}}
+	state.prune(now)
+	if _, ok := state.delivered["old"]; ok || len(state.delivered) != 1 {
+		t.Fatalf("got %v, want the old event dropped", state.delivered)
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	zero := 0
+	for _, maxRetries := range []*int{&zero, nil} {
+		cfg := &slackConfig{Token: "xoxb-test", DefaultChannel: "general", MaxRetries: maxRetries, RetryBackoff: 1}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		s := newTestSink(t, &fakeSlack{Server: srv})
+		s.cfg = cfg
+		atomic.StoreInt32(&calls, 0)
+		if result := s.Arrived(context.Background(), newTestEvent("a", "a1")); result == cdkgo.SuccessResult {
+			t.Fatal("want error for status 503")
+		}
+		if got, want := atomic.LoadInt32(&calls), int32(*cfg.MaxRetries+1); got != want {
+			t.Errorf("max_retries %d: got %d calls, want %d", *cfg.MaxRetries, got, want)
+		}
+	}
+	negative := -1
+	cfg := &slackConfig{Token: "xoxb-test", DefaultChannel: "general", MaxRetries: &negative}
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("want error for negative max_retries")
+	}
+}
@@ -15,11 +15,11 @@
 package internal
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"time"
 
 	v2 "github.com/cloudevents/sdk-go/v2"
 	"github.com/rs/zerolog"
@@ -27,12 +27,16 @@ import (
 
 	cdkgo "github.com/vanus-labs/cdk-go"
 	"github.com/vanus-labs/cdk-go/log"
+	"github.com/vanus-labs/connector/internal/keyed"
 )
 
 const (
 	name      = "Slack Sink"
 	xvChannel = "xvchannel"
 	xvMsgType = "xvmsgtype"
+	xvAction  = "xvaction"
+	// xvWorkspace is the name of workspace in config the message is sent to.
+	xvWorkspace = "xvworkspace"
 )
 
 var (
@@ -42,16 +46,81 @@ var (
 		"slack: invalid or empty channels")
 	errInvalidAppName = cdkgo.NewResult(http.StatusBadRequest,
 		"slack: invalid or empty AppName")
-	errFailedToSend = cdkgo.NewResult(http.StatusInternalServerError,
-		"slack: failed to sent message, please view logs")
+	errNoWorkspace = cdkgo.NewResult(http.StatusBadRequest,
+		"slack: no workspace found, please check xvworkspace in attributes or default_workspace in config")
 )
 
 var _ cdkgo.SinkConfigAccessor = &slackConfig{}
 
 type slackConfig struct {
 	cdkgo.SinkConfig `json:",inline" yaml:",inline"`
-	DefaultChannel   string `json:"default_channel" yaml:"default_channel" validate:"required"`
-	Token            string `yaml:"token" json:"token" validate:"required"`
+	DefaultChannel   string `json:"default_channel" yaml:"default_channel"`
+	Token            string `yaml:"token" json:"token"`
+	WebhookURL       string `json:"webhook_url" yaml:"webhook_url"`
+	// Workspaces are the named workspaces selected by xvworkspace, the workspace of token or
+	// webhook_url is used if there is no xvworkspace.
+	Workspaces map[string]WorkspaceConfig `json:"workspaces" yaml:"workspaces"`
+	// DefaultWorkspace is the workspace used if there is no xvworkspace and no token or webhook_url.
+	DefaultWorkspace string `json:"default_workspace" yaml:"default_workspace"`
+	// RateLimit is the max number of messages per second to a channel.
+	RateLimit float64 `json:"rate_limit" yaml:"rate_limit"`
+	// Burst is the max number of messages sent to a channel at once.
+	Burst int `json:"burst" yaml:"burst"`
+	// MaxRetries is the max retry times of a rate limited or failed message, 0 means no retry, and
+	// it's 5 if it's not set.
+	MaxRetries *int `json:"max_retries" yaml:"max_retries"`
+	// RetryBackoff is the backoff in millisecond of the first retry when slack fails, it's doubled
+	// for each retry. The retry-after hint is used if slack rate limits the message.
+	RetryBackoff int `json:"retry_backoff" yaml:"retry_backoff"`
+}
+
+func (c *slackConfig) Validate() error {
+	if c.Token != "" || c.WebhookURL != "" {
+		if c.DefaultWorkspace != "" {
+			return errors.New("slack: the default_workspace can't be set with token or webhook_url")
+		}
+		ws := c.defaultWorkspace()
+		if err := ws.validate(); err != nil {
+			return fmt.Errorf("slack: %w", err)
+		}
+	} else if len(c.Workspaces) == 0 {
+		return errors.New("slack: one of token, webhook_url and workspaces must be set")
+	}
+	for name, ws := range c.Workspaces {
+		if err := ws.validate(); err != nil {
+			return fmt.Errorf("slack: workspace %q is invalid: %w", name, err)
+		}
+	}
+	if c.DefaultWorkspace != "" {
+		if _, ok := c.Workspaces[c.DefaultWorkspace]; !ok {
+			return fmt.Errorf("slack: the default_workspace %q isn't in workspaces", c.DefaultWorkspace)
+		}
+	}
+	if c.RateLimit < 0 || c.Burst < 0 || (c.MaxRetries != nil && *c.MaxRetries < 0) || c.RetryBackoff < 0 {
+		return errors.New("slack: the rate_limit, burst, max_retries and retry_backoff can't be negative")
+	}
+	if c.RateLimit == 0 {
+		c.RateLimit = defaultRateLimit
+	}
+	if c.Burst == 0 {
+		c.Burst = defaultBurst
+	}
+	if c.MaxRetries == nil {
+		maxRetries := defaultMaxRetries
+		c.MaxRetries = &maxRetries
+	}
+	if c.RetryBackoff == 0 {
+		c.RetryBackoff = defaultRetryBackoff
+	}
+	return c.SinkConfig.Validate()
+}
+
+func (c *slackConfig) defaultWorkspace() WorkspaceConfig {
+	return WorkspaceConfig{
+		Token:          c.Token,
+		WebhookURL:     c.WebhookURL,
+		DefaultChannel: c.DefaultChannel,
+	}
 }
 
 func NewConfig() cdkgo.SinkConfigAccessor {
@@ -65,52 +134,88 @@ func NewSlackSink() cdkgo.Sink {
 var _ cdkgo.Sink = &slackSink{}
 
 type slackSink struct {
+	cfg            *slackConfig
 	count          int64
-	client         *slack.Client
-	defaultChannel string
+	workspaces     map[string]*workspace
+	defaultWS      *workspace
 	defaultMsgType string
 	logger         zerolog.Logger
+	// channels serializes the messages to each channel and limits the rate of them.
+	channels *keyed.Queues[*channelState]
 }
 
+// Arrived sends the messages of the events, the messages to a channel are sent in the order of
+// the events, and the messages to different channels are sent concurrently. The invalid events
+// are logged and skipped, so they don't fail the valid ones.
 func (e *slackSink) Arrived(ctx context.Context, events ...*v2.Event) cdkgo.Result {
+	var byChannel keyed.Group[delivery]
 	for idx := range events {
-		event := events[idx]
-
-		channelID, ok := event.Extensions()[xvChannel].(string)
-		if !ok {
-			channelID = e.defaultChannel
-		}
-		m := &Message{}
-		if err := json.Unmarshal(event.Data(), m); err != nil {
-			e.logger.Error().Err(err).Str("channel", channelID).Str("event_id", event.ID()).Msg("json unmarshal failed")
-			return errInvalidMessage
-		}
-		if err := m.validate(); err != nil {
-			e.logger.Error().Err(err).Str("channel", channelID).Str("event_id", event.ID()).Msg("message validate failed")
-			return errInvalidMessage
+		d, result := e.newDelivery(events[idx])
+		if result != cdkgo.SuccessResult {
+			e.logger.Error().Str("event_id", events[idx].ID()).Str("error", result.GetMsg()).
+				Msg("invalid event, skip it")
+			continue
 		}
-		start := time.Now()
-		if err := e.send(ctx, channelID, m); err != nil {
-			e.logger.Error().Err(err).Str("channel", channelID).Str("event_id", event.ID()).Msg("failed to send slack")
-			return errFailedToSend
-		} else if time.Now().Sub(start) > time.Second {
-			e.logger.Info().Str("channel", channelID).Str("event_id", event.ID()).
-				Interface("used_time", time.Now().Sub(start)).Msg("success to send slack, but takes too long")
-		} else {
-			e.logger.Info().Str("channel", channelID).Str("event_id", event.ID()).Msg("success to send slack")
+		// the channels of different workspaces may have the same name.
+		byChannel.Add(d.ws.name+"/"+d.channel, d)
+	}
+	results := keyed.Each(&byChannel, func(key string, deliveries []delivery) cdkgo.Result {
+		return e.deliverAll(ctx, key, deliveries)
+	})
+	for _, result := range results {
+		if result != cdkgo.SuccessResult {
+			return result
 		}
 	}
 	return cdkgo.SuccessResult
 }
 
+// newDelivery returns the delivery of the event to its workspace and channel.
+func (e *slackSink) newDelivery(event *v2.Event) (delivery, cdkgo.Result) {
+	ws := e.defaultWS
+	if name, ok := event.Extensions()[xvWorkspace].(string); ok {
+		if ws, ok = e.workspaces[name]; !ok {
+			return delivery{}, cdkgo.NewResult(http.StatusBadRequest, fmt.Sprintf("slack: workspace %q not found", name))
+		}
+	}
+	if ws == nil {
+		return delivery{}, errNoWorkspace
+	}
+	channelID, ok := event.Extensions()[xvChannel].(string)
+	if !ok || ws.client == nil {
+		// the channel of incoming webhook can't be changed.
+		channelID = ws.defaultChannel
+	}
+	m, err := newMessage(event)
+	if err == nil && ws.client == nil && m.action != actionPost {
+		err = fmt.Errorf("the action %s isn't supported by incoming webhook", m.action)
+	}
+	if err != nil {
+		return delivery{}, cdkgo.NewResult(http.StatusBadRequest, errInvalidMessage.GetMsg()+": "+err.Error())
+	}
+	return delivery{event: event, ws: ws, channel: channelID, msg: m}, cdkgo.SuccessResult
+}
+
 func (e *slackSink) Initialize(ctx context.Context, cfg cdkgo.ConfigAccessor) error {
 	e.logger = log.FromContext(ctx)
 	config := cfg.(*slackConfig)
-	e.defaultChannel = config.DefaultChannel
+	e.cfg = config
+	e.channels = newChannelQueues(config)
 	e.defaultMsgType = "plain_text"
-	e.client = slack.New(config.Token)
-	_, err := e.client.AuthTest()
-	return err
+	e.workspaces = make(map[string]*workspace, len(config.Workspaces))
+	for name, wsCfg := range config.Workspaces {
+		ws := newWorkspace(name, wsCfg)
+		if err := ws.init(ctx); err != nil {
+			return err
+		}
+		e.workspaces[name] = ws
+	}
+	if config.Token != "" || config.WebhookURL != "" {
+		e.defaultWS = newWorkspace("", config.defaultWorkspace())
+		return e.defaultWS.init(ctx)
+	}
+	e.defaultWS = e.workspaces[config.DefaultWorkspace]
+	return nil
 }
 
 func (e *slackSink) Name() string {
@@ -122,18 +227,52 @@ func (e *slackSink) Destroy() error {
 	return nil
 }
 
-func (e *slackSink) send(ctx context.Context, channelID string, m *Message) (err error) {
-	_, _, err = e.client.PostMessageContext(ctx, channelID, slack.MsgOptionBlocks(m.Blocks.BlockSet...))
-	return err
-}
-
-type Message struct {
-	Blocks *slack.Blocks `json:"blocks"`
+// send sends the message to the channel of workspace, it returns the ts of the message, which is
+// empty if it's sent by incoming webhook.
+func (e *slackSink) send(ctx context.Context, ws *workspace, channelID string, m *Message) (string, error) {
+	if ws.client == nil {
+		return "", ws.postWebhook(ctx, m)
+	}
+	switch m.action {
+	case actionUpdate:
+		_, ts, _, err := ws.client.UpdateMessageContext(ctx, channelID, m.TS, m.options()...)
+		return ts, err
+	case actionDelete:
+		_, ts, err := ws.client.DeleteMessageContext(ctx, channelID, m.TS)
+		return ts, err
+	case actionEphemeral:
+		return ws.client.PostEphemeralContext(ctx, channelID, m.User, m.options()...)
+	case actionUpload:
+		return e.upload(ctx, ws, channelID, m)
+	default:
+		_, ts, err := ws.client.PostMessageContext(ctx, channelID, m.options()...)
+		return ts, err
+	}
 }
 
-func (m *Message) validate() error {
-	if m.Blocks != nil && len(m.Blocks.BlockSet) > 0 {
-		return nil
+// upload uploads the file of message to the channel, the content of file is decoded when the
+// message is built, or downloaded when it's delivered.
+func (e *slackSink) upload(ctx context.Context, ws *workspace, channelID string, m *Message) (string, error) {
+	content := m.File.data
+	initialComment := m.File.InitialComment
+	if initialComment == "" {
+		initialComment = m.Text
+	}
+	filename, title := m.File.filename(), m.File.Title
+	if title == "" {
+		title = filename
+	}
+	file, err := ws.client.UploadFileV2Context(ctx, slack.UploadFileV2Parameters{
+		Reader:          bytes.NewReader(content),
+		FileSize:        len(content),
+		Filename:        filename,
+		Title:           title,
+		InitialComment:  initialComment,
+		Channel:         channelID,
+		ThreadTimestamp: m.ThreadTS,
+	})
+	if err != nil {
+		return "", err
 	}
-	return fmt.Errorf("message is invalid")
+	return file.ID, nil
 }
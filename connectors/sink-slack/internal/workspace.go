@@ -0,0 +1,134 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/slack-go/slack"
+)
+
+const (
+	webhookTimeout = 30 * time.Second
+	// defaultWebhookRetryAfter is the wait of a rate limited webhook without the Retry-After header.
+	defaultWebhookRetryAfter = time.Second
+)
+
+// webhookClient posts messages to incoming webhooks.
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type WorkspaceConfig struct {
+	// Token is the bot OAuth token of the app in the workspace.
+	Token string `json:"token" yaml:"token"`
+	// WebhookURL is the incoming webhook, the messages are posted to the channel of the webhook.
+	WebhookURL     string `json:"webhook_url" yaml:"webhook_url"`
+	DefaultChannel string `json:"default_channel" yaml:"default_channel"`
+}
+
+func (c *WorkspaceConfig) validate() error {
+	if (c.Token == "") == (c.WebhookURL == "") {
+		return fmt.Errorf("one and only one of token and webhook_url must be set")
+	}
+	if c.Token != "" && c.DefaultChannel == "" {
+		return fmt.Errorf("the default_channel can't be empty when token is set")
+	}
+	return nil
+}
+
+// workspace is a Slack workspace the messages are posted to, by the Web API with a token or by an
+// incoming webhook.
+type workspace struct {
+	name           string
+	client         *slack.Client
+	webhookURL     string
+	defaultChannel string
+}
+
+func newWorkspace(name string, cfg WorkspaceConfig, options ...slack.Option) *workspace {
+	ws := &workspace{
+		name:           name,
+		webhookURL:     cfg.WebhookURL,
+		defaultChannel: cfg.DefaultChannel,
+	}
+	if cfg.Token != "" {
+		ws.client = slack.New(cfg.Token, options...)
+	}
+	return ws
+}
+
+func (ws *workspace) init(ctx context.Context) error {
+	if ws.client == nil {
+		return nil
+	}
+	if _, err := ws.client.AuthTestContext(ctx); err != nil {
+		return fmt.Errorf("slack: auth test of workspace %q failed: %w", ws.name, err)
+	}
+	return nil
+}
+
+// postWebhook posts the message to the incoming webhook, which can only post new messages to its
+// channel.
+func (ws *workspace) postWebhook(ctx context.Context, m *Message) error {
+	msg := &slack.WebhookMessage{
+		Text:            m.Text,
+		Blocks:          m.Blocks,
+		ThreadTimestamp: m.ThreadTS,
+		ReplyBroadcast:  m.ReplyBroadcast,
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("marshal webhook message failed: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	return webhookError(resp)
+}
+
+// webhookError maps the status of a webhook response to the errors of the Web API client, so
+// a rate limited or failed webhook is retried and reported in the same way.
+func webhookError(resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter := defaultWebhookRetryAfter
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+			retryAfter = time.Duration(sec) * time.Second
+		}
+		return &slack.RateLimitedError{RetryAfter: retryAfter}
+	case resp.StatusCode != http.StatusOK:
+		// the body is the error of slack such as invalid_payload or channel_not_found.
+		status := resp.Status
+		if b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)); len(bytes.TrimSpace(b)) > 0 {
+			status += ": " + strings.TrimSpace(string(b))
+		}
+		return slack.StatusCodeError{Code: resp.StatusCode, Status: status}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2023 Linkall Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+
+	cdkgo "github.com/vanus-labs/cdk-go"
+)
+
+func TestPostWebhookErrors(t *testing.T) {
+	cases := []struct {
+		name           string
+		status         int
+		retryAfter     string
+		body           string
+		wantRetryAfter time.Duration
+		wantCode       int
+	}{
+		{name: "ok", status: http.StatusOK, body: "ok"},
+		{name: "rate limited", status: http.StatusTooManyRequests, retryAfter: "3",
+			wantRetryAfter: 3 * time.Second, wantCode: http.StatusTooManyRequests},
+		{name: "rate limited without retry after", status: http.StatusTooManyRequests,
+			wantRetryAfter: defaultWebhookRetryAfter, wantCode: http.StatusTooManyRequests},
+		{name: "server error", status: http.StatusServiceUnavailable, wantCode: http.StatusInternalServerError},
+		{name: "invalid payload", status: http.StatusBadRequest, body: "invalid_payload", wantCode: http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if c.retryAfter != "" {
+					w.Header().Set("Retry-After", c.retryAfter)
+				}
+				w.WriteHeader(c.status)
+				_, _ = w.Write([]byte(c.body))
+			}))
+			defer srv.Close()
+			ws := newWorkspace("", WorkspaceConfig{WebhookURL: srv.URL})
+			err := ws.postWebhook(context.Background(), &Message{Text: "hello"})
+			if c.wantCode == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var rateLimitErr *slack.RateLimitedError
+			if c.wantRetryAfter > 0 && (!errors.As(err, &rateLimitErr) || rateLimitErr.RetryAfter != c.wantRetryAfter) {
+				t.Errorf("got %v, want rate limited error with retry after %s", err, c.wantRetryAfter)
+			}
+			if result := errorResult(err); int(result.GetCode()) != c.wantCode {
+				t.Errorf("got %d %s, want %d", result.GetCode(), result.GetMsg(), c.wantCode)
+			}
+		})
+	}
+}
+
+func TestWebhookServerErrorIsRetried(t *testing.T) {
+	var posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&posts, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	cfg := &slackConfig{WebhookURL: srv.URL, RetryBackoff: 1}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	s := &slackSink{
+		cfg:       cfg,
+		defaultWS: newWorkspace("", cfg.defaultWorkspace()),
+		logger:    zerolog.Nop(),
+		channels:  newChannelQueues(cfg),
+	}
+	if result := s.Arrived(context.Background(), newTestEvent("", "hello")); result != cdkgo.SuccessResult {
+		t.Fatal(result.GetMsg())
+	}
+	if n := atomic.LoadInt32(&posts); n != 2 {
+		t.Errorf("got %d posts, want the failed post retried", n)
+	}
+}